@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// the environment variable that holds the admin token if --admin-token is not specified. Using the
+// environment keeps the token out of the process list
+const adminTokenEnv = "KAFKA_SCALE_ADMIN_TOKEN"
+
+// Blocks the results loop while consumption is paused
+type pauseGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+var gate = newPauseGate()
+
+func newPauseGate() *pauseGate {
+	g := &pauseGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// blocks as long as the gate is paused
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.cond.Wait()
+	}
+}
+
+func (g *pauseGate) set(paused bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = paused
+	g.cond.Broadcast()
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// The offsets of one partition of the results topic as seen by this results replica. Applied is the
+// offset of the last message applied to the results or -1. Committed and Last are the consumer group's
+// committed offset and the last offset of the partition
+type AppliedOffsets struct {
+	Partition int
+	Applied   int64
+	Committed int64
+	Last      int64
+	Segments  []OffsetSegment
+}
+
+// What the admin endpoints return
+type AdminStatus struct {
+	Action  string
+	Paused  bool
+	Applied int64
+	Offsets []AppliedOffsets `json:",omitempty"`
+	Error   string           `json:",omitempty"`
+}
+
+// Adds the admin routes to the passed router. Every admin route requires the header 'Authorization: Bearer
+// <token>'. If no token is configured, the admin routes are disabled
+func addAdminRoutes(r *mux.Router, offsets OffsetsFunc, token string, snapshotFile string) {
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, fmt.Sprintf("admin routes are disabled - specify --admin-token or %v", adminTokenEnv), http.StatusForbidden)
+				return
+			}
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	admin.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
+		resetResults(offsets)
+		writeJSON(w, adminStatus("reset"))
+	}).Methods(http.MethodPost)
+	admin.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		status := adminStatus("snapshot")
+		if snapshotFile == "" {
+			status.Error = "no --snapshot-file is configured"
+			w.WriteHeader(http.StatusConflict)
+		} else if err := writeSnapshot(snapshotFile); err != nil {
+			status.Error = err.Error()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		writeJSON(w, status)
+	}).Methods(http.MethodPost)
+	admin.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		gate.set(true)
+		writeJSON(w, adminStatus("pause"))
+	}).Methods(http.MethodPost)
+	admin.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		gate.set(false)
+		writeJSON(w, adminStatus("resume"))
+	}).Methods(http.MethodPost)
+	admin.HandleFunc("/offsets", func(w http.ResponseWriter, r *http.Request) {
+		status := adminStatus("offsets")
+		var err error
+		if status.Offsets, err = appliedOffsets(offsets); err != nil {
+			status.Error = err.Error()
+		}
+		writeJSON(w, status)
+	}).Methods(http.MethodGet)
+}
+
+func adminStatus(action string) AdminStatus {
+	return AdminStatus{Action: action, Paused: gate.isPaused(), Applied: aggregator.Applied()}
+}
+
+// Clears the results, the offset segments and the reconciliation counts. Streaming subscribers are resynced
+// so they see the empty results. Consumption continues from the committed offsets - so to re-run a scale
+// test, reset the consumer group offsets or write new data. The committed offsets become the baseline of the
+// results, so the results gateway doesn't expect the offsets applied before the reset
+func resetResults(getOffsets OffsetsFunc) {
+	aggregator.Reset(committedOffsets(getOffsets))
+	fmt.Printf("results were reset\n")
+}
+
+// Returns the offset committed by the results consumer group on each partition of the results topic.
+// Partitions the group hasn't committed are left out. An error is logged and returns no offsets - the
+// baseline of a reset then only has the partitions this replica applied
+func committedOffsets(getOffsets OffsetsFunc) map[int]int64 {
+	committed := map[int]int64{}
+	offsets, err := getOffsets(results_topic, consumerGrpForTopic[results_topic])
+	if err != nil {
+		fmt.Printf("error getting the committed offsets of topic %v for the results baseline, error is: %v\n", results_topic, err)
+	}
+	for _, o := range offsets {
+		if o.Committed >= 0 {
+			committed[o.Partition] = o.Committed
+		}
+	}
+	return committed
+}
+
+// combines the offsets applied by this replica with the offsets of the results consumer group
+func appliedOffsets(getOffsets OffsetsFunc) ([]AppliedOffsets, error) {
+	byPartition := map[int]*AppliedOffsets{}
+	for partition, segs := range aggregator.Snapshot().Segments {
+		a := &AppliedOffsets{Partition: partition, Applied: -1, Committed: -1, Last: -1, Segments: segs}
+		if n := len(segs); n != 0 {
+			a.Applied = segs[n-1].Next - 1
+		}
+		byPartition[partition] = a
+	}
+	offsets, err := getOffsets(results_topic, consumerGrpForTopic[results_topic])
+	for _, o := range offsets {
+		a, ok := byPartition[o.Partition]
+		if !ok {
+			a = &AppliedOffsets{Partition: o.Partition, Applied: -1}
+			byPartition[o.Partition] = a
+		}
+		a.Committed, a.Last = o.Committed, o.Last
+	}
+	result := make([]AppliedOffsets, 0, len(byPartition))
+	for _, a := range byPartition {
+		result = append(result, *a)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Partition < result[j].Partition })
+	return result, err
+}
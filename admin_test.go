@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the admin token of the results servers the tests run
+const testAdminToken = "test-token"
+
+// Makes a request to an admin route of the results server at the passed URL, with the passed token if it isn't
+// empty, and checks the status code. Returns the decoded response, which is empty if it isn't JSON - e.g. a
+// request the token check refused
+func adminTestRequest(t *testing.T, url string, method string, path string, token string, wantStatus int) AdminStatus {
+	t.Helper()
+	req, err := http.NewRequest(method, url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("got status %v from %v %v, want %v: %s", resp.StatusCode, method, path, wantStatus, body)
+	}
+	var status AdminStatus
+	if bytes.HasPrefix(body, []byte("{")) {
+		if err := json.Unmarshal(body, &status); err != nil {
+			t.Fatalf("error decoding %v %v: %v", method, path, err)
+		}
+	}
+	return status
+}
+
+// Runs the results role against the fake broker and drives it with the admin routes: the token checks,
+// offsets, pause and resume, snapshot and reset
+func TestAdminRoutes(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, results_topic, 2)
+	aggregator.Restore(newAggregateState())
+	defer aggregator.Restore(newAggregateState())
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	server := httptest.NewServer(resultsRouter(kafkaOffsets(brokers), testAdminToken, snapshotFile))
+	defer server.Close()
+
+	r := newKafkaReader(brokers, results_topic)
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		consumeResults(r, false, 0)
+	}()
+	defer func() {
+		gate.set(false)
+		r.Close()
+		<-consumed
+	}()
+	writeTestResults(t, brokers, 4)
+	waitFor(t, 30*time.Second, "the results to be applied", func() bool { return aggregator.Applied() == 4 })
+
+	// the token
+	disabled := httptest.NewServer(resultsRouter(kafkaOffsets(brokers), "", ""))
+	defer disabled.Close()
+	adminTestRequest(t, disabled.URL, http.MethodGet, "/admin/offsets", testAdminToken, http.StatusForbidden)
+	adminTestRequest(t, server.URL, http.MethodGet, "/admin/offsets", "", http.StatusUnauthorized)
+	adminTestRequest(t, server.URL, http.MethodPost, "/admin/reset", "wrong", http.StatusUnauthorized)
+	adminTestRequest(t, server.URL, http.MethodGet, "/admin/reset", testAdminToken, http.StatusMethodNotAllowed)
+	if applied := aggregator.Applied(); applied != 4 {
+		t.Fatalf("got %v results applied after refused resets, want 4", applied)
+	}
+
+	// every message read was applied and committed
+	status := adminTestRequest(t, server.URL, http.MethodGet, "/admin/offsets", testAdminToken, http.StatusOK)
+	if status.Error != "" || len(status.Offsets) != 2 {
+		t.Fatalf("got offsets: %+v, want 2 partitions", status)
+	}
+	var applied int64
+	for _, o := range status.Offsets {
+		applied += o.Applied + 1
+		if o.Last != o.Applied+1 || (o.Applied >= 0 && o.Committed != o.Last) {
+			t.Errorf("got offsets of partition %v: %+v", o.Partition, o)
+		}
+	}
+	if applied != 4 {
+		t.Errorf("got %v offsets applied, want 4", applied)
+	}
+
+	// the read in progress when paused still applies its message, then consumption stops until resumed
+	if status := adminTestRequest(t, server.URL, http.MethodPost, "/admin/pause", testAdminToken, http.StatusOK); !status.Paused {
+		t.Errorf("got status after pausing: %+v", status)
+	}
+	writeTestResults(t, brokers, 2)
+	waitFor(t, 30*time.Second, "the read in progress to be applied", func() bool { return aggregator.Applied() == 5 })
+	time.Sleep(500 * time.Millisecond)
+	if applied := aggregator.Applied(); applied != 5 {
+		t.Errorf("got %v results applied while paused, want 5", applied)
+	}
+	if status := adminTestRequest(t, server.URL, http.MethodPost, "/admin/resume", testAdminToken, http.StatusOK); status.Paused {
+		t.Errorf("got status after resuming: %+v", status)
+	}
+	waitFor(t, 30*time.Second, "the results to be applied after resuming", func() bool { return aggregator.Applied() == 6 })
+
+	// snapshot
+	noSnapshot := httptest.NewServer(resultsRouter(kafkaOffsets(brokers), testAdminToken, ""))
+	defer noSnapshot.Close()
+	if status := adminTestRequest(t, noSnapshot.URL, http.MethodPost, "/admin/snapshot", testAdminToken, http.StatusConflict); status.Error == "" {
+		t.Errorf("got no error taking a snapshot with no snapshot file")
+	}
+	adminTestRequest(t, server.URL, http.MethodPost, "/admin/snapshot", testAdminToken, http.StatusOK)
+	js, err := ioutil.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot ResultsSnapshot
+	if err := json.Unmarshal(js, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Seq != 6 || snapshot.Results["2020-01"][1].Count != 12 {
+		t.Errorf("got snapshot: %+v, want 6 results with 12 code 1s", snapshot.AggregateState)
+	}
+
+	// reset
+	if status := adminTestRequest(t, server.URL, http.MethodPost, "/admin/reset", testAdminToken, http.StatusOK); status.Applied != 0 {
+		t.Errorf("got status after a reset: %+v", status)
+	}
+	state := aggregator.Snapshot()
+	var baseline int64
+	for _, offset := range state.Baseline {
+		baseline += offset
+	}
+	if len(state.Segments) != 0 || baseline != 6 {
+		t.Errorf("got state after a reset: %+v, want no segments and a baseline of the 6 committed offsets", state)
+	}
+}
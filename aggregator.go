@@ -0,0 +1,272 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The state accumulated by the results role: the housing counts by period, the offset segments of the
+// results topic they were accumulated from, the reconciliation counts by source, and the stats of the
+// bench runs by run. Seq is the number of results messages applied. Baseline has the offset of each
+// partition that the state was last reset at - the state only accounts for the offsets from there on. A
+// state returned by the Aggregator shares nothing with the Aggregator - or with any other state - so it
+// can be marshaled, rolled up or merged by any goroutine without locking
+type AggregateState struct {
+	Seq            int64
+	Results        map[string]map[int]HousingResult
+	Segments       map[int][]OffsetSegment
+	Reconciliation map[string]*SourceCounts
+	Bench          map[string]*BenchStats `json:",omitempty"`
+	Baseline       map[int]int64          `json:",omitempty"`
+}
+
+// returns an empty state
+func newAggregateState() AggregateState {
+	return AggregateState{
+		Results:        map[string]map[int]HousingResult{},
+		Segments:       map[int][]OffsetSegment{},
+		Reconciliation: map[string]*SourceCounts{},
+		Bench:          map[string]*BenchStats{},
+		Baseline:       map[int]int64{},
+	}
+}
+
+// returns a deep copy of the state
+func (s AggregateState) copy() AggregateState {
+	c := newAggregateState()
+	c.Merge(s)
+	return c
+}
+
+// Merge adds the passed state into this one. Counts are summed and segments are appended. The baseline of
+// each partition is the lower of the two, because the state reset later doesn't have the offsets applied
+// between the two resets. This is how the results gateway combines the partial states of the results
+// replicas, which consume disjoint partitions. Nothing in the passed state is referenced by this state
+// afterwards
+func (s *AggregateState) Merge(other AggregateState) {
+	s.Seq += other.Seq
+	mergeHousingResults(s.Results, other.Results)
+	for partition, segs := range other.Segments {
+		s.Segments[partition] = append(s.Segments[partition], segs...)
+	}
+	for partition, offset := range other.Baseline {
+		if cur, ok := s.Baseline[partition]; !ok || offset < cur {
+			s.Baseline[partition] = offset
+		}
+	}
+	mergeSourceCounts(s.Reconciliation, other.Reconciliation)
+	mergeBenchStats(s.Bench, other.Bench)
+}
+
+// One parsed results message. Codes maps each housing code in the message to the number of times it
+// occurred - valid or not. Unparsable is the number of values that weren't integers. Records is the
+// value of the records header, or -1 if the message doesn't have one
+type ResultMessage struct {
+	Partition  int
+	Offset     int64
+	Period     string
+	Source     string
+	Records    int
+	Codes      map[int]int
+	Unparsable int
+}
+
+// Notified by the Aggregator of every change to its state. The methods are called with the Aggregator
+// lock held, so they see changes in the order they were made, but they must not call the Aggregator
+type aggregateObserver interface {
+	// a results message was applied. Counts has only the valid codes. Seq is the new Seq of the state
+	applied(seq int64, period string, counts map[int]int)
+	// the state was replaced - by a reset or a restore
+	replaced()
+}
+
+// Aggregator accumulates results messages into an AggregateState. All methods are safe for concurrent use.
+// The state is only touched with the lock held and never leaves the Aggregator: callers get deep copies.
+// So the http handlers - which marshal the state while messages are being applied - only ever see
+// immutable snapshots
+type Aggregator struct {
+	mu       sync.Mutex
+	state    AggregateState
+	observer aggregateObserver
+}
+
+// the aggregator of the results role. Streaming subscribers are fed from it
+var aggregator = newAggregator(hub)
+
+// returns an empty Aggregator. The observer can be nil
+func newAggregator(observer aggregateObserver) *Aggregator {
+	return &Aggregator{state: newAggregateState(), observer: observer}
+}
+
+// Apply adds a results message to the state and returns the number of valid and invalid codes in it.
+// Invalid codes are not counted in the results, but they are counted as rejected for the source
+func (a *Aggregator) Apply(m ResultMessage) (accepted int, rejected int) {
+	counts := map[int]int{}
+	rejected = m.Unparsable
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	results, ok := a.state.Results[m.Period]
+	if !ok {
+		results = newHousingResults()
+		a.state.Results[m.Period] = results
+	}
+	for code, cnt := range m.Codes {
+		if result, ok := results[code]; ok {
+			result.Count += cnt
+			results[code] = result
+			counts[code] = cnt
+			accepted += cnt
+		} else {
+			rejected += cnt
+		}
+	}
+	records := m.Records
+	if records < 0 {
+		// results written before record counts were carried - assume no record was dropped by compute
+		records = accepted + rejected
+	}
+	c := sourceCounts(a.state.Reconciliation, m.Source)
+	c.ResultMessages++
+	c.Records += records
+	c.Accepted += accepted
+	c.Rejected += rejected
+	if m.Source != "" {
+		updateReconcileMetrics(m.Source, *c)
+	}
+	a.recordOffset(m.Partition, m.Offset)
+	a.state.Seq++
+	if a.observer != nil {
+		a.observer.applied(a.state.Seq, m.Period, counts)
+	}
+	return accepted, rejected
+}
+
+// ApplySummary records the reader's summary for a source, which was read from the passed partition and offset
+func (a *Aggregator) ApplySummary(partition int, offset int64, summary SourceSummary) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c := sourceCounts(a.state.Reconciliation, summary.Source)
+	c.Summary = &summary
+	updateReconcileMetrics(summary.Source, *c)
+	a.recordOffset(partition, offset)
+}
+
+// ApplyBench adds a results message of a bench run, which was read from the passed partition and offset, to
+// the stats of the run. Bench results aren't census data so aren't counted in the results
+func (a *Aggregator) ApplyBench(partition int, offset int64, run string, records int, sent time.Time, received time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.state.Bench[run]
+	if !ok {
+		s = &BenchStats{}
+		a.state.Bench[run] = s
+	}
+	s.add(records, received.Sub(sent), received)
+	a.recordOffset(partition, offset)
+}
+
+// Skip records that the message at the passed partition and offset was consumed but had nothing to apply -
+// e.g. it was invalid - so the offset segments stay contiguous
+func (a *Aggregator) Skip(partition int, offset int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recordOffset(partition, offset)
+}
+
+// records that the message at the passed partition and offset was consumed, either extending the last
+// segment for the partition or - if the offset isn't contiguous - starting a new one. A partition that
+// is revoked in a rebalance and later re-assigned gets a new segment. Must be called with the lock held
+func (a *Aggregator) recordOffset(partition int, offset int64) {
+	segs := a.state.Segments[partition]
+	if n := len(segs); n != 0 && segs[n-1].Next == offset {
+		segs[n-1].Next = offset + 1
+	} else {
+		segs = append(segs, OffsetSegment{First: offset, Next: offset + 1})
+	}
+	a.state.Segments[partition] = segs
+}
+
+// Snapshot returns a deep copy of the state
+func (a *Aggregator) Snapshot() AggregateState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state.copy()
+}
+
+// View calls the passed func with a deep copy of the state while no change can be made to the state. This
+// lets an observer line a snapshot up with the changes it was notified of. The func must not call the Aggregator
+func (a *Aggregator) View(fn func(AggregateState)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fn(a.state.copy())
+}
+
+// Applied returns the number of results messages applied
+func (a *Aggregator) Applied() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state.Seq
+}
+
+// Restore replaces the state with a copy of the passed state. Nil maps in the passed state are treated as empty
+func (a *Aggregator) Restore(s AggregateState) {
+	a.replace(s.copy())
+}
+
+// Reset replaces the state with an empty state whose baseline is the passed offsets - the offset consumption
+// resumes from on each partition. A partition this replica has applied messages of at or past its passed
+// offset - or that isn't in the passed offsets - gets the offset after the last message applied instead, so
+// messages applied between getting the offsets and the reset aren't expected in the new state
+func (a *Aggregator) Reset(baseline map[int]int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := newAggregateState()
+	for partition, offset := range baseline {
+		s.Baseline[partition] = offset
+	}
+	for partition, segs := range a.state.Segments {
+		for _, seg := range segs {
+			if cur, ok := s.Baseline[partition]; !ok || seg.Next > cur {
+				s.Baseline[partition] = seg.Next
+			}
+		}
+	}
+	a.replaceLocked(s)
+}
+
+func (a *Aggregator) replace(s AggregateState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.replaceLocked(s)
+}
+
+// replaces the state. Must be called with the lock held
+func (a *Aggregator) replaceLocked(s AggregateState) {
+	a.state = s
+	reconcileMismatch.Reset()
+	for source, c := range s.Reconciliation {
+		if source != unknownSource {
+			updateReconcileMetrics(source, *c)
+		}
+	}
+	if a.observer != nil {
+		a.observer.replaced()
+	}
+}
+
+// adds the counts in src into dst. Nothing in src is referenced by dst afterwards
+func mergeHousingResults(dst map[string]map[int]HousingResult, src map[string]map[int]HousingResult) {
+	for key, codes := range src {
+		keyResults, ok := dst[key]
+		if !ok {
+			keyResults = newHousingResults()
+			dst[key] = keyResults
+		}
+		for code, result := range codes {
+			r := keyResults[code]
+			r.Description = result.Description
+			r.Count += result.Count
+			keyResults[code] = r
+		}
+	}
+}
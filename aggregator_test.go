@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// returns a results message with the passed codes for period 2020-01
+func resultMessage(partition int, offset int64, source string, records int, codes map[int]int) ResultMessage {
+	return ResultMessage{
+		Partition: partition,
+		Offset:    offset,
+		Period:    "2020-01",
+		Source:    source,
+		Records:   records,
+		Codes:     codes,
+	}
+}
+
+func TestAggregatorApply(t *testing.T) {
+	a := newAggregator(nil)
+	m := resultMessage(0, 0, "s1", 10, map[int]int{1: 3, 2: 1, 99: 2})
+	m.Unparsable = 1
+	accepted, rejected := a.Apply(m)
+	if accepted != 4 || rejected != 3 {
+		t.Fatalf("got accepted: %v rejected: %v, want 4 and 3", accepted, rejected)
+	}
+	// no records header - all the codes are taken to be records
+	a.Apply(resultMessage(0, 1, "s1", -1, map[int]int{1: 2}))
+
+	s := a.Snapshot()
+	if s.Seq != 2 || a.Applied() != 2 {
+		t.Errorf("got seq: %v applied: %v, want 2", s.Seq, a.Applied())
+	}
+	if got := s.Results["2020-01"][1].Count; got != 5 {
+		t.Errorf("got code 1 count: %v, want 5", got)
+	}
+	if got := s.Results["2020-01"][2].Count; got != 1 {
+		t.Errorf("got code 2 count: %v, want 1", got)
+	}
+	if _, ok := s.Results["2020-01"][99]; ok {
+		t.Errorf("invalid code 99 was counted")
+	}
+	want := SourceCounts{ResultMessages: 2, Records: 12, Accepted: 6, Rejected: 3}
+	if got := *s.Reconciliation["s1"]; got != want {
+		t.Errorf("got source counts: %+v, want %+v", got, want)
+	}
+	if got := s.Segments[0]; !reflect.DeepEqual(got, []OffsetSegment{{0, 2}}) {
+		t.Errorf("got segments: %v, want [{0 2}]", got)
+	}
+}
+
+func TestAggregatorApplyNoSource(t *testing.T) {
+	a := newAggregator(nil)
+	a.Apply(resultMessage(0, 0, "", 1, map[int]int{1: 1}))
+	if c, ok := a.Snapshot().Reconciliation[unknownSource]; !ok || c.ResultMessages != 1 {
+		t.Errorf("message with no source was not counted as source %v", unknownSource)
+	}
+}
+
+func TestAggregatorSkip(t *testing.T) {
+	a := newAggregator(nil)
+	a.Apply(resultMessage(0, 0, "s1", 1, map[int]int{1: 1}))
+	a.Skip(0, 1)
+	a.Apply(resultMessage(0, 2, "s1", 1, map[int]int{1: 1}))
+	a.Skip(0, 5)
+	a.Skip(1, 7)
+
+	s := a.Snapshot()
+	if s.Seq != 2 {
+		t.Errorf("got seq: %v, want 2 - a skip isn't an applied message", s.Seq)
+	}
+	if got := s.Results["2020-01"][1].Count; got != 2 {
+		t.Errorf("got code 1 count: %v, want 2", got)
+	}
+	want := map[int][]OffsetSegment{0: {{0, 3}, {5, 6}}, 1: {{7, 8}}}
+	if !reflect.DeepEqual(s.Segments, want) {
+		t.Errorf("got segments: %v, want %v", s.Segments, want)
+	}
+}
+
+func TestAggregatorApplySummary(t *testing.T) {
+	a := newAggregator(nil)
+	a.Apply(resultMessage(0, 0, "s1", 3, map[int]int{1: 3}))
+	summary := SourceSummary{Source: "s1", Period: "2020-01", LinesRead: 3, LinesChunked: 3, Chunks: 1, Complete: true}
+	a.ApplySummary(0, 1, summary)
+
+	s := a.Snapshot()
+	if s.Seq != 1 {
+		t.Errorf("got seq: %v, want 1 - a summary isn't a results message", s.Seq)
+	}
+	c := s.Reconciliation["s1"]
+	if c.Summary == nil || *c.Summary != summary {
+		t.Fatalf("got summary: %v, want %v", c.Summary, summary)
+	}
+	if c.ResultMessages != 1 || c.Records != 3 {
+		t.Errorf("summary changed the counts: %+v", *c)
+	}
+	if r := reconcileSource("s1", *c); r.Status != statusOK {
+		t.Errorf("got status: %v, want %v", r.Status, statusOK)
+	}
+	if got := s.Segments[0]; !reflect.DeepEqual(got, []OffsetSegment{{0, 2}}) {
+		t.Errorf("got segments: %v, want [{0 2}]", got)
+	}
+}
+
+func TestAggregatorApplyBench(t *testing.T) {
+	a := newAggregator(nil)
+	sent := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.ApplyBench(2, 10, "run1", 100, sent, sent.Add(20*time.Millisecond))
+	a.ApplyBench(2, 11, "run1", 50, sent, sent.Add(40*time.Millisecond))
+	a.ApplyBench(2, 12, "run2", 10, sent, sent.Add(time.Millisecond))
+
+	s := a.Snapshot()
+	if s.Seq != 0 || len(s.Results) != 0 {
+		t.Errorf("bench messages were counted in the results: seq %v results %v", s.Seq, s.Results)
+	}
+	b := s.Bench["run1"]
+	if b == nil || b.Messages != 2 || b.Records != 150 {
+		t.Fatalf("got run1 stats: %+v, want 2 messages and 150 records", b)
+	}
+	if !b.First.Equal(sent.Add(20*time.Millisecond)) || !b.Last.Equal(sent.Add(40*time.Millisecond)) {
+		t.Errorf("got first: %v last: %v", b.First, b.Last)
+	}
+	if b.MaxMillis != 40 || b.SumMillis != 60 {
+		t.Errorf("got max: %v sum: %v millis, want 40 and 60", b.MaxMillis, b.SumMillis)
+	}
+	if s.Bench["run2"] == nil || s.Bench["run2"].Messages != 1 {
+		t.Errorf("got run2 stats: %+v, want 1 message", s.Bench["run2"])
+	}
+	if got := s.Segments[2]; !reflect.DeepEqual(got, []OffsetSegment{{10, 13}}) {
+		t.Errorf("got segments: %v, want [{10 13}]", got)
+	}
+}
+
+func TestAggregateStateMerge(t *testing.T) {
+	sent := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	a1 := newAggregator(nil)
+	a1.Apply(resultMessage(0, 0, "s1", 4, map[int]int{1: 3, 99: 1}))
+	a1.ApplyBench(0, 1, "run1", 10, sent, sent.Add(10*time.Millisecond))
+	a2 := newAggregator(nil)
+	a2.Apply(resultMessage(1, 0, "s1", 2, map[int]int{1: 1, 2: 1}))
+	a2.Apply(resultMessage(1, 1, "s2", 1, map[int]int{3: 1}))
+	a2.ApplySummary(1, 2, SourceSummary{Source: "s1", LinesRead: 6, LinesChunked: 6, Complete: true})
+	a2.ApplyBench(1, 3, "run1", 20, sent, sent.Add(30*time.Millisecond))
+
+	merged := newAggregateState()
+	merged.Merge(a1.Snapshot())
+	other := a2.Snapshot()
+	merged.Merge(other)
+
+	if merged.Seq != 3 {
+		t.Errorf("got seq: %v, want 3", merged.Seq)
+	}
+	results := merged.Results["2020-01"]
+	if results[1].Count != 4 || results[2].Count != 1 || results[3].Count != 1 {
+		t.Errorf("got counts 1: %v 2: %v 3: %v, want 4, 1 and 1", results[1].Count, results[2].Count, results[3].Count)
+	}
+	if results[1].Description == "" {
+		t.Errorf("merge lost the description of code 1")
+	}
+	s1 := merged.Reconciliation["s1"]
+	if s1.ResultMessages != 2 || s1.Records != 6 || s1.Accepted != 5 || s1.Rejected != 1 || s1.Summary == nil {
+		t.Errorf("got s1 counts: %+v", *s1)
+	}
+	if merged.Reconciliation["s2"].ResultMessages != 1 {
+		t.Errorf("got s2 counts: %+v", *merged.Reconciliation["s2"])
+	}
+	if b := merged.Bench["run1"]; b.Messages != 2 || b.Records != 30 || b.MaxMillis != 30 {
+		t.Errorf("got run1 stats: %+v", *b)
+	}
+	want := map[int][]OffsetSegment{0: {{0, 2}}, 1: {{0, 4}}}
+	if !reflect.DeepEqual(merged.Segments, want) {
+		t.Errorf("got segments: %v, want %v", merged.Segments, want)
+	}
+
+	// the merged state must not reference the state merged into it
+	other.Results["2020-01"][1] = HousingResult{"changed", 100}
+	other.Reconciliation["s1"].Records = 100
+	other.Reconciliation["s1"].Summary.LinesRead = 100
+	other.Bench["run1"].Records = 100
+	other.Segments[1][0].Next = 100
+	if merged.Results["2020-01"][1].Count != 4 || s1.Records != 6 || s1.Summary.LinesRead != 6 ||
+		merged.Bench["run1"].Records != 30 || merged.Segments[1][0].Next != 4 {
+		t.Errorf("changing a merged state changed the state it was merged into")
+	}
+}
+
+func TestAggregatorResetBaseline(t *testing.T) {
+	a := newAggregator(nil)
+	a.Apply(resultMessage(0, 0, "s1", 1, map[int]int{1: 1}))
+	a.Apply(resultMessage(0, 1, "s1", 1, map[int]int{1: 1}))
+	a.Skip(2, 7)
+	// partition 0 was applied past the committed offset, partition 2 wasn't committed
+	a.Reset(map[int]int64{0: 1, 1: 5})
+
+	s := a.Snapshot()
+	if s.Seq != 0 || len(s.Results) != 0 || len(s.Segments) != 0 || len(s.Reconciliation) != 0 {
+		t.Errorf("reset didn't clear the state: %+v", s)
+	}
+	want := map[int]int64{0: 2, 1: 5, 2: 8}
+	if !reflect.DeepEqual(s.Baseline, want) {
+		t.Errorf("got baseline: %v, want %v", s.Baseline, want)
+	}
+
+	// a restore replaces the baseline with the restored one
+	a.Restore(AggregateState{Baseline: map[int]int64{0: 9}})
+	if got := a.Snapshot().Baseline; !reflect.DeepEqual(got, map[int]int64{0: 9}) {
+		t.Errorf("got baseline: %v after restore, want map[0:9]", got)
+	}
+}
+
+func TestAggregateStateMergeBaseline(t *testing.T) {
+	merged := newAggregateState()
+	merged.Merge(AggregateState{Baseline: map[int]int64{0: 10, 1: 4}})
+	merged.Merge(AggregateState{Baseline: map[int]int64{0: 6, 2: 3}})
+	merged.Merge(AggregateState{})
+	want := map[int]int64{0: 6, 1: 4, 2: 3}
+	if !reflect.DeepEqual(merged.Baseline, want) {
+		t.Errorf("got baseline: %v, want %v", merged.Baseline, want)
+	}
+}
+
+func TestAggregatorSnapshotIsImmutable(t *testing.T) {
+	sent := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := newAggregator(nil)
+	a.Apply(resultMessage(0, 0, "s1", 1, map[int]int{1: 1}))
+	a.ApplySummary(0, 1, SourceSummary{Source: "s1", LinesRead: 1, LinesChunked: 1, Complete: true})
+	a.ApplyBench(0, 2, "run1", 1, sent, sent.Add(time.Millisecond))
+	before, err := json.Marshal(a.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := a.Snapshot()
+	s.Seq = 100
+	s.Results["2020-01"][1] = HousingResult{"changed", 100}
+	s.Results["2021-01"] = map[int]HousingResult{}
+	s.Segments[0][0].Next = 100
+	s.Segments[0] = append(s.Segments[0], OffsetSegment{200, 201})
+	s.Reconciliation["s1"].Accepted = 100
+	s.Reconciliation["s1"].Summary.LinesRead = 100
+	s.Bench["run1"].Messages = 100
+	s.Bench["run1"].Latencies[0] = 100
+
+	after, err := json.Marshal(a.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("changing a snapshot changed the aggregator\nbefore: %s\nafter:  %s", before, after)
+	}
+
+	// nor does applying to the aggregator change a snapshot already taken
+	s = a.Snapshot()
+	a.Apply(resultMessage(0, 3, "s1", 1, map[int]int{1: 1}))
+	if s.Seq != 1 || s.Results["2020-01"][1].Count != 1 || s.Segments[0][0].Next != 3 {
+		t.Errorf("applying to the aggregator changed a snapshot")
+	}
+}
+
+// runs Apply, Snapshot, Reset and Restore concurrently. Meant to be run with -race. Every state must be
+// consistent: each message has one code, so the code count is always the number of messages applied
+func TestAggregatorConcurrent(t *testing.T) {
+	const appliers = 4
+	const messages = 500
+	a := newAggregator(nil)
+	check := func(s AggregateState) {
+		if got := int64(s.Results["2020-01"][1].Count); got != s.Seq {
+			t.Errorf("inconsistent state: seq %v but code count %v", s.Seq, got)
+		}
+		if _, err := json.Marshal(s); err != nil {
+			t.Errorf("error marshaling snapshot: %v", err)
+		}
+	}
+	done := make(chan struct{})
+	var wg, others sync.WaitGroup
+	for i := 0; i < appliers; i++ {
+		wg.Add(1)
+		go func(partition int) {
+			defer wg.Done()
+			for offset := int64(0); offset < messages; offset++ {
+				a.Apply(resultMessage(partition, offset, "s1", 1, map[int]int{1: 1}))
+				if offset%10 == 0 {
+					a.Skip(partition, offset+messages)
+				}
+			}
+		}(i)
+	}
+	others.Add(2)
+	go func() {
+		defer others.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s := a.Snapshot()
+			check(s)
+			a.Reset(nil)
+			a.Restore(s)
+		}
+	}()
+	go func() {
+		defer others.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			a.View(check)
+			a.Applied()
+		}
+	}()
+	wg.Wait()
+	close(done)
+	others.Wait()
+	check(a.Snapshot())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// the config source Kafka reports for a config that was set on the topic - as opposed to a broker or
+// default config
+const configSourceDynamicTopic = 1
+
+// Alters the passed topic. If partitions is greater than zero the topic's partition count is increased to it.
+// Kafka can't decrease the partition count. Configs is a comma-separated list of key=value topic configs to set.
+// A config with an empty value - like retention.ms= - is removed from the topic so the broker default applies.
+// Prints the description of the topic afterwards
+func alterTopicCmd(kafkaBrokers string, topic string, partitions int, configs string, output string) {
+	if partitions > 0 {
+		if err := addPartitions(kafkaBrokers, topic, partitions, output); err != nil {
+			errorf(output, "%v\n", err)
+			return
+		}
+	}
+	if configs != "" {
+		changes, err := parseTopicConfigs(configs)
+		if err != nil {
+			errorf(output, "%v\n", err)
+			return
+		}
+		if err := setTopicConfigs(kafkaBrokers, topic, changes, output); err != nil {
+			errorf(output, "%v\n", err)
+			return
+		}
+	}
+	descriptions, err := describeTopics(kafkaBrokers, []string{topic})
+	if err != nil {
+		errorf(output, "%v\n", err)
+		return
+	}
+	outputTopicDescriptions(descriptions, output)
+}
+
+// increases the partition count of the passed topic to the passed count
+func addPartitions(kafkaBrokers string, topic string, partitions int, output string) error {
+	current, err := getPartitionsForTopic(kafkaBrokers, topic)
+	if err != nil {
+		return fmt.Errorf("error getting partitions for topic: %v, error is: %v", topic, err)
+	} else if len(current) == 0 {
+		return fmt.Errorf("topic %v not found", topic)
+	} else if partitions < len(current) {
+		return fmt.Errorf("topic %v has %v partitions - Kafka can't decrease the partition count", topic, len(current))
+	} else if partitions == len(current) {
+		logf(output, "topic %v already has %v partitions\n", topic, partitions)
+		return nil
+	}
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+	res, err := client.CreatePartitions(context.Background(), &kafka.CreatePartitionsRequest{
+		Topics: []kafka.TopicPartitionsConfig{{Name: topic, Count: int32(partitions)}},
+	})
+	if err != nil {
+		return fmt.Errorf("error adding partitions to topic: %v, error is: %v", topic, err)
+	} else if err := res.Errors[topic]; err != nil {
+		return fmt.Errorf("error adding partitions to topic: %v, error is: %v", topic, err)
+	}
+	logf(output, "increased the partitions of topic %v from %v to %v\n", topic, len(current), partitions)
+	return nil
+}
+
+// parses comma-separated key=value topic configs like retention.ms=3600000,cleanup.policy=delete
+func parseTopicConfigs(configs string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, kv := range strings.Split(configs, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid config: %v. Must be like key=value", kv)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+// Sets the passed configs on the passed topic. A config with an empty value is removed. Kafka replaces all the
+// configs set on a topic with the configs in an alter request, so the configs already set on the topic are read
+// first and sent along with the new ones
+func setTopicConfigs(kafkaBrokers string, topic string, changes map[string]string, output string) error {
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+
+	res, err := client.DescribeConfigs(context.Background(), &kafka.DescribeConfigsRequest{
+		Resources: []kafka.DescribeConfigRequestResource{{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: topic,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing configs for topic: %v, error is: %v", topic, err)
+	}
+	merged := map[string]string{}
+	for _, r := range res.Resources {
+		if r.Error != nil {
+			return fmt.Errorf("error describing configs for topic: %v, error is: %v", topic, r.Error)
+		}
+		for _, e := range r.ConfigEntries {
+			// older brokers don't report the config source but do report whether the config is a default
+			if e.ConfigSource == configSourceDynamicTopic || (e.ConfigSource == 0 && !e.IsDefault && !e.ReadOnly) {
+				merged[e.ConfigName] = e.ConfigValue
+			}
+		}
+	}
+	for name, value := range changes {
+		if value == "" {
+			delete(merged, name)
+		} else {
+			merged[name] = value
+		}
+	}
+	resource := kafka.AlterConfigRequestResource{ResourceType: kafka.ResourceTypeTopic, ResourceName: topic}
+	for _, name := range sortedKeys(merged) {
+		resource.Configs = append(resource.Configs, kafka.AlterConfigRequestConfig{Name: name, Value: merged[name]})
+	}
+	alterRes, err := client.AlterConfigs(context.Background(), &kafka.AlterConfigsRequest{
+		Resources: []kafka.AlterConfigRequestResource{resource},
+	})
+	if err != nil {
+		return fmt.Errorf("error altering configs for topic: %v, error is: %v", topic, err)
+	}
+	for _, err := range alterRes.Errors {
+		if err != nil {
+			return fmt.Errorf("error altering configs for topic: %v, error is: %v", topic, err)
+		}
+	}
+	var set []string
+	for _, name := range sortedKeys(changes) {
+		set = append(set, name+"="+changes[name])
+	}
+	logf(output, "set configs on topic %v: %v\n", topic, strings.Join(set, " "))
+	return nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka message headers of the synthetic chunks written by the bench command. The run identifies the bench
+// run and sent is when the chunk was written, in Unix nanoseconds. The compute role copies both onto the
+// results message it computes from a chunk, so the results role can measure the end-to-end latency
+const (
+	headerBenchRun = "bench-run"
+	headerSent     = "sent"
+)
+
+const (
+	// census records in each synthetic chunk - the same as the read command
+	benchLines = 10
+	// length of a synthetic census record - about that of a CPS basic monthly record
+	benchLineLen = 1000
+	// chunks passed to the writer in one call. Also the batch size of the writer
+	benchBatch = 100
+	// each bucket of the latency histogram is this factor wider than the one before it, so a percentile
+	// computed from the histogram is within 5% of the exact value
+	benchBucketFactor = 1.05
+)
+
+// relative frequency of each housing code in the synthetic records - most households are in a house,
+// apartment or flat (code 1)
+var benchHousingWeights = []int{1, 900, 5, 5, 5, 30, 20, 5, 5, 5, 2, 15, 2}
+
+// What the results role accumulates for one bench run. Received is the time the first and last results
+// messages of the run were read. Latencies is a histogram of the end-to-end latencies in milliseconds,
+// keyed by bucket. Stats from multiple results replicas can simply be merged
+type BenchStats struct {
+	Messages  int
+	Records   int
+	First     time.Time
+	Last      time.Time
+	Latencies map[int]int
+	SumMillis float64
+	MaxMillis float64
+}
+
+// What the bench command reports for one run. ComputeReplicas is the number of members of the compute
+// consumer group when the run started, or -1 if it couldn't be determined. SendRate is the chunks written
+// per second. EndToEndSeconds is from the first chunk written to the last result read, and Throughput is
+// the census records per second over that time. The latencies are from the time each chunk was written to
+// the time its results message was read by the results role
+type BenchReport struct {
+	Run             string
+	Time            time.Time
+	ComputeReplicas int
+	Chunks          int
+	Records         int
+	TargetRate      int
+	SendRate        float64
+	Received        int
+	EndToEndSeconds float64
+	Throughput      float64
+	P50Millis       float64
+	P90Millis       float64
+	P99Millis       float64
+	MaxMillis       float64
+	MeanMillis      float64
+	Error           string `json:",omitempty"`
+}
+
+// Writes the passed number of synthetic chunks to the compute topic at the passed rate in chunks per second -
+// or as fast as possible if the rate is zero - then waits up to timeout seconds for the results role or
+// gateway at resultsURL to read all the results. If resultsURL is empty, only the send rate is measured. The
+// report is appended to reportFile if not empty, and all the reports in the file are printed, grouped by
+// compute replica count, so runs at different scales can be compared
+func benchCmd(kafkaBrokers string, spec TopicSpec, onDrift string, chunks int, rate int, resultsURL string, timeout int,
+	reportFile string, output string) {
+	start := time.Now()
+	report := BenchReport{
+		Run:             fmt.Sprintf("bench-%v", start.Format("20060102-150405")),
+		Time:            start,
+		ComputeReplicas: -1,
+		TargetRate:      rate,
+	}
+	runBench(kafkaBrokers, spec, onDrift, chunks, resultsURL, timeout, &report, output)
+	if report.Error != "" {
+		outputErrorf(output, "%v\n", report.Error)
+	}
+	reports := []BenchReport{report}
+	if reportFile != "" {
+		var err error
+		if reports, err = appendBenchReport(reportFile, report); err != nil {
+			errorf(output, "%v\n", err)
+			reports = []BenchReport{report}
+		}
+	}
+	if !outputBenchReports(reports, output) {
+		printBenchReports(reports)
+	}
+}
+
+// does the bench run, filling in the passed report
+func runBench(kafkaBrokers string, spec TopicSpec, onDrift string, chunks int, resultsURL string, timeout int,
+	report *BenchReport, output string) {
+	if err := ensureTopic(kafkaBrokers, spec, onDrift); err != nil {
+		report.Error = fmt.Sprintf("error creating topic %v, error is: %v", compute_topic, err)
+		return
+	}
+	if d, err := describeGroup(kafkaBrokers, consumerGrpForTopic[compute_topic], ""); err != nil {
+		logf(output, "can't count the compute replicas, error is: %v\n", err)
+	} else {
+		report.ComputeReplicas = len(d.Members)
+	}
+	logf(output, "bench run %v: writing %v chunks to topic %v\n", report.Run, chunks, compute_topic)
+	writer := newKafkaWriter(kafkaBrokers, compute_topic)
+	writer.BatchSize = benchBatch
+	writer.BatchTimeout = 5 * time.Millisecond
+	defer writer.Close()
+	sent, err := sendBenchChunks(writer, report.Run, chunks, report.TargetRate)
+	report.Chunks = sent
+	report.Records = sent * benchLines
+	if elapsed := time.Since(report.Time).Seconds(); elapsed > 0 {
+		report.SendRate = float64(sent) / elapsed
+	}
+	if err != nil {
+		report.Error = fmt.Sprintf("error writing chunks, error is: %v", err)
+	}
+	if resultsURL == "" {
+		logf(output, "no --results-url - only the send rate is measured\n")
+		return
+	}
+	logf(output, "waiting up to %v seconds for the results of %v chunks\n", timeout, sent)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	var stats BenchStats
+	for {
+		stats, err = getBenchStats(resultsURL, report.Run)
+		if err != nil {
+			logf(output, "%v\n", err)
+		} else if stats.Messages >= sent {
+			break
+		}
+		if time.Now().After(deadline) {
+			if report.Error == "" {
+				report.Error = fmt.Sprintf("timed out with %v of %v results read", stats.Messages, sent)
+			}
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	report.Received = stats.Messages
+	if stats.Messages > 0 {
+		report.EndToEndSeconds = stats.Last.Sub(report.Time).Seconds()
+		if report.EndToEndSeconds > 0 {
+			report.Throughput = float64(stats.Records) / report.EndToEndSeconds
+		}
+		report.P50Millis = stats.percentile(50)
+		report.P90Millis = stats.percentile(90)
+		report.P99Millis = stats.percentile(99)
+		report.MaxMillis = stats.MaxMillis
+		report.MeanMillis = stats.SumMillis / float64(stats.Messages)
+	}
+}
+
+// writes the passed number of synthetic chunks for the passed run. If rate is more than zero, chunks are
+// written when they are due at that rate. Otherwise as fast as the writer takes them. Returns the number of
+// chunks written
+func sendBenchChunks(writer *kafka.Writer, run string, chunks int, rate int) (int, error) {
+	start := time.Now()
+	rnd := rand.New(rand.NewSource(start.UnixNano()))
+	period := Period{start.Year(), int(start.Month())}.String()
+	sent := 0
+	for sent < chunks {
+		n := chunks - sent
+		if n > benchBatch {
+			n = benchBatch
+		}
+		if rate > 0 {
+			// the chunks due by now, or if none are, sleep until the next one is
+			due := int(time.Since(start).Seconds()*float64(rate)) + 1 - sent
+			if due <= 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(sent) * time.Second / time.Duration(rate))))
+				continue
+			}
+			if due < n {
+				n = due
+			}
+		}
+		messages := make([]kafka.Message, n)
+		now := time.Now()
+		for i := range messages {
+			messages[i] = benchChunk(rnd, run, period, now)
+		}
+		if err := writer.WriteMessages(context.Background(), messages...); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// builds one synthetic chunk: the period line followed by records that only have a housing code at the
+// position the compute role reads it from, and digits everywhere else
+func benchChunk(rnd *rand.Rand, run string, period string, sent time.Time) kafka.Message {
+	var b strings.Builder
+	b.WriteString(period + "\n")
+	line := make([]byte, benchLineLen)
+	for i := 0; i < benchLines; i++ {
+		for j := range line {
+			line[j] = '0' + byte(rnd.Intn(10))
+		}
+		copy(line[30:32], fmt.Sprintf("%2d", benchHousingCode(rnd)))
+		b.Write(line)
+		b.WriteString("\n")
+	}
+	value := b.String()
+	headers := append(recordHeaders(kindChunk, run, benchLines),
+		kafka.Header{Key: headerBenchRun, Value: []byte(run)},
+		kafka.Header{Key: headerSent, Value: []byte(strconv.FormatInt(sent.UnixNano(), 10))},
+	)
+	return kafka.Message{Key: []byte(messageKey(value)), Value: []byte(value), Headers: headers}
+}
+
+// returns a random housing code with the frequencies in benchHousingWeights
+func benchHousingCode(rnd *rand.Rand) int {
+	total := 0
+	for _, w := range benchHousingWeights {
+		total += w
+	}
+	n := rnd.Intn(total)
+	for code, w := range benchHousingWeights {
+		if n < w {
+			return code
+		}
+		n -= w
+	}
+	return 0
+}
+
+// returns the bench headers of the passed message, so the compute role can copy them onto the results
+// message. Returns nil if the message isn't from a bench run
+func benchHeaders(m kafka.Message) []kafka.Header {
+	var headers []kafka.Header
+	for _, h := range m.Headers {
+		if h.Key == headerBenchRun || h.Key == headerSent {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// parses the send time and record count of a bench results message
+func parseBenchMessage(m kafka.Message) (sent time.Time, records int, err error) {
+	nanos, err := strconv.ParseInt(headerValue(m, headerSent), 10, 64)
+	if err != nil {
+		return sent, 0, fmt.Errorf("invalid %v header: %v", headerSent, err)
+	}
+	if records, err = strconv.Atoi(headerValue(m, headerRecords)); err != nil {
+		return sent, 0, fmt.Errorf("invalid %v header: %v", headerRecords, err)
+	}
+	return time.Unix(0, nanos), records, nil
+}
+
+// adds one results message with the passed latency to the stats
+func (s *BenchStats) add(records int, latency time.Duration, received time.Time) {
+	millis := float64(latency) / float64(time.Millisecond)
+	if millis < 0 {
+		// the clocks of the bench host and the results replica disagree
+		millis = 0
+	}
+	s.Messages++
+	s.Records += records
+	if s.First.IsZero() || received.Before(s.First) {
+		s.First = received
+	}
+	if received.After(s.Last) {
+		s.Last = received
+	}
+	if s.Latencies == nil {
+		s.Latencies = map[int]int{}
+	}
+	s.Latencies[int(math.Log1p(millis)/math.Log(benchBucketFactor))]++
+	s.SumMillis += millis
+	s.MaxMillis = math.Max(s.MaxMillis, millis)
+}
+
+// returns the passed percentile of the latencies in milliseconds, as the upper bound of the histogram bucket
+// it falls in - or the max if that is lower
+func (s BenchStats) percentile(p float64) float64 {
+	buckets := make([]int, 0, len(s.Latencies))
+	for b := range s.Latencies {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+	rank := int(math.Ceil(p / 100 * float64(s.Messages)))
+	seen := 0
+	for _, b := range buckets {
+		seen += s.Latencies[b]
+		if seen >= rank {
+			return math.Min(math.Expm1(float64(b+1)*math.Log(benchBucketFactor)), s.MaxMillis)
+		}
+	}
+	return s.MaxMillis
+}
+
+// adds the stats in src into dst. Nothing in src is referenced by dst afterwards
+func mergeBenchStats(dst map[string]*BenchStats, src map[string]*BenchStats) {
+	for run, s := range src {
+		d, ok := dst[run]
+		if !ok {
+			d = &BenchStats{}
+			dst[run] = d
+		}
+		d.Messages += s.Messages
+		d.Records += s.Records
+		if !s.First.IsZero() && (d.First.IsZero() || s.First.Before(d.First)) {
+			d.First = s.First
+		}
+		if s.Last.After(d.Last) {
+			d.Last = s.Last
+		}
+		if d.Latencies == nil {
+			d.Latencies = map[int]int{}
+		}
+		for b, cnt := range s.Latencies {
+			d.Latencies[b] += cnt
+		}
+		d.SumMillis += s.SumMillis
+		d.MaxMillis = math.Max(d.MaxMillis, s.MaxMillis)
+	}
+}
+
+// provides a JSON response of the stats of all bench runs, or of one run if the request has the query
+// param run. A run with no results yet has empty stats
+func writeBenchStats(w http.ResponseWriter, r *http.Request, stats map[string]*BenchStats) {
+	run := r.URL.Query().Get("run")
+	if run == "" {
+		writeJSON(w, stats)
+	} else if s, ok := stats[run]; ok {
+		writeJSON(w, s)
+	} else {
+		writeJSON(w, BenchStats{})
+	}
+}
+
+// provides a JSON response of the bench stats of this replica
+func benchHandler(w http.ResponseWriter, r *http.Request) {
+	writeBenchStats(w, r, aggregator.Snapshot().Bench)
+}
+
+// gets the stats of the passed bench run from the /bench endpoint of the results role or gateway at the
+// passed URL
+func getBenchStats(resultsURL string, run string) (BenchStats, error) {
+	var stats BenchStats
+	u := strings.TrimSuffix(resultsURL, "/") + "/bench?run=" + url.QueryEscape(run)
+	resp, err := gatewayClient.Get(u)
+	if err != nil {
+		return stats, fmt.Errorf("error getting %v, error is: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return stats, fmt.Errorf("error getting %v, status is: %v", u, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return stats, fmt.Errorf("error decoding %v, error is: %v", u, err)
+	}
+	return stats, nil
+}
+
+// appends the passed report as a JSON line to the report file and returns all the reports in the file
+func appendBenchReport(reportFile string, report BenchReport) ([]BenchReport, error) {
+	f, err := os.OpenFile(reportFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening bench report file: %v, error is: %v", reportFile, err)
+	}
+	defer f.Close()
+	var reports []BenchReport
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r BenchReport
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		} else if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("error parsing bench report file: %v, error is: %v", reportFile, err)
+		}
+		reports = append(reports, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading bench report file: %v, error is: %v", reportFile, err)
+	}
+	js, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append(js, '\n')); err != nil {
+		return nil, fmt.Errorf("error writing bench report file: %v, error is: %v", reportFile, err)
+	}
+	return append(reports, report), nil
+}
+
+// Writes bench reports in the passed machine-readable output format. CSV has one row per report. Returns
+// false if the output is table
+func outputBenchReports(reports []BenchReport, output string) bool {
+	header := []string{"run", "time", "compute_replicas", "chunks", "records", "target_rate", "send_rate", "received",
+		"end_to_end_seconds", "throughput", "p50_ms", "p90_ms", "p99_ms", "max_ms", "mean_ms", "error"}
+	return writeOutput(output, reports, header, func() [][]string {
+		var rows [][]string
+		for _, r := range reports {
+			rows = append(rows, []string{r.Run, r.Time.Format(time.RFC3339), cell(r.ComputeReplicas), cell(r.Chunks),
+				cell(r.Records), cell(r.TargetRate), cell(r.SendRate), cell(r.Received), cell(r.EndToEndSeconds),
+				cell(r.Throughput), cell(r.P50Millis), cell(r.P90Millis), cell(r.P99Millis), cell(r.MaxMillis),
+				cell(r.MeanMillis), r.Error})
+		}
+		return rows
+	})
+}
+
+// prints bench reports to the console sorted by compute replica count then time, so the runs at each scale
+// are together, followed by the mean throughput and latencies of the runs at each scale
+func printBenchReports(reports []BenchReport) {
+	sort.SliceStable(reports, func(i, j int) bool {
+		if reports[i].ComputeReplicas != reports[j].ComputeReplicas {
+			return reports[i].ComputeReplicas < reports[j].ComputeReplicas
+		}
+		return reports[i].Time.Before(reports[j].Time)
+	})
+	format := "%-10v%-25v%-10v%-10v%-10v%-10v%-12v%-10v%-10v%-10v%-10v%v\n"
+	fmt.Printf(format, "Replicas", "Run", "Chunks", "Target/s", "Sent/s", "Received", "Records/s", "P50 ms", "P90 ms", "P99 ms", "Max ms", "Error")
+	for _, r := range reports {
+		target := "max"
+		if r.TargetRate > 0 {
+			target = strconv.Itoa(r.TargetRate)
+		}
+		fmt.Printf(format, replicaCount(r.ComputeReplicas), r.Run, r.Chunks, target, fmt.Sprintf("%.1f", r.SendRate), r.Received,
+			fmt.Sprintf("%.1f", r.Throughput), millis(r.P50Millis), millis(r.P90Millis), millis(r.P99Millis), millis(r.MaxMillis), r.Error)
+	}
+	fmt.Printf("\n")
+	format = "%-10v%-10v%-12v%-10v%v\n"
+	fmt.Printf(format, "Replicas", "Runs", "Records/s", "P50 ms", "P99 ms")
+	for i := 0; i < len(reports); {
+		j, n := i, 0
+		var throughput, p50, p99 float64
+		for ; j < len(reports) && reports[j].ComputeReplicas == reports[i].ComputeReplicas; j++ {
+			// runs that didn't get all their results back aren't comparable
+			if reports[j].Error == "" && reports[j].Received > 0 {
+				throughput += reports[j].Throughput
+				p50 += reports[j].P50Millis
+				p99 += reports[j].P99Millis
+				n++
+			}
+		}
+		if n > 0 {
+			fmt.Printf(format, replicaCount(reports[i].ComputeReplicas), n, fmt.Sprintf("%.1f", throughput/float64(n)),
+				millis(p50/float64(n)), millis(p99/float64(n)))
+		}
+		i = j
+	}
+}
+
+// formats a compute replica count, or a question mark if it is unknown
+func replicaCount(replicas int) string {
+	if replicas < 0 {
+		return "?"
+	}
+	return strconv.Itoa(replicas)
+}
+
+// formats a latency in milliseconds
+func millis(ms float64) string {
+	return fmt.Sprintf("%.1f", ms)
+}
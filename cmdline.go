@@ -4,22 +4,37 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 // initialize command line args and default values
 func init() {
-	flag.StringVar(&years, "years", "", "Years. E.g. --years=2015,2016. Ignored unless role is 'read'")
-	flag.StringVar(&months, "months", "", "Months. E.g. --months=jan,feb. Ignored unless role is 'read'. Asterisk (*) is also allowed, meaning 'all'")
-	flag.StringVar(&kafkaBrokers, "kafka", "", "Kafka broker URLs. E.g. 192.168.0.45:32355,192.168.0.46:32355,192.168.0.47:32355")
-	flag.IntVar(&chunkCount, "chunks", -1, "Chunk count - the number of chunks of census data to read or calculate. If omitted, or -1, then all")
+	flag.StringVar(&years, "years", "", "Years. E.g. --years=2015,2016. Ignored unless role is 'read' or 'local'")
+	flag.StringVar(&months, "months", "", "Months. E.g. --months=jan,feb. Ignored unless role is 'read' or 'local'. Asterisk (*) is also allowed, meaning 'all'")
+	flag.StringVar(&kafkaBrokers, "kafka", "", "Kafka broker URLs. E.g. 192.168.0.45:32355,192.168.0.46:32355,192.168.0.47:32355. Each is tried in turn until one responds")
+	flag.IntVar(&chunkCount, "chunks", -1, "Chunk count - the number of chunks of census data to read or calculate. If omitted, or -1, then all. The bench command requires it")
 	flag.BoolVar(&dryRun, "dry-run", false, "Displays how the command would run, but doesn't actually run it")
-	flag.StringVar(&writeTo, "write-to", writeToKafka, "Where to send the output of the read and compute commands. Valid values are: 'kafka', 'stdout', and 'null'")
+	flag.StringVar(&writeTo, "write-to", writeToKafka, "Where to send the output of the read and compute commands. Valid values are: 'kafka', 'stdout', 'null' and 'file'")
+	flag.StringVar(&writeFile, "write-file", "", "File the read and compute commands append their messages to as NDJSON, with --write-to=file")
+	flag.StringVar(&readFrom, "read-from", readFromKafka, "Where the compute and results commands read their input from. Valid values are: 'kafka' and 'file'")
+	flag.StringVar(&readFile, "read-file", "", "NDJSON file of messages - as written with --write-to=file - the compute and results commands read, with --read-from=file")
+	flag.StringVar(&pipeline, "pipeline", "", "Names an isolated pipeline. Prefixes the default topic and consumer group names with the pipeline name and a dash, so pipelines sharing a cluster don't share topics or groups")
+	flag.StringVar(&computeTopicName, "compute-topic", "", "Name of the compute topic. Defaults to 'compute', prefixed by --pipeline")
+	flag.StringVar(&resultsTopicName, "results-topic", "", "Name of the results topic. Defaults to 'results', prefixed by --pipeline")
+	flag.StringVar(&computeGroup, "compute-group", "", "Consumer group of the compute command. Defaults to '"+computeConsumer+"', prefixed by --pipeline")
+	flag.StringVar(&resultsGroup, "results-group", "", "Consumer group of the results command. Defaults to '"+resultConsumer+"', prefixed by --pipeline")
 	flag.IntVar(&partitionCnt, "compute-topic-partitions", 1, "Partitions for the compute topic. Tune to the number of compute pods")
 	flag.IntVar(&replicationFactor, "compute-topic-replfactor", 1, "Replication factor for the compute topic. Tune to your Kafka cluster size")
-	flag.StringVar(&fromFile, "from-file", "", "FQPN of census file to load (i.e. don't download from the census site - use a file on the filesystem). Also requires you to specify a year via the --years option")
-	flag.StringVar(&topic, "topic", "", "If listing offsets, this is the topic for which to list offsets. If deleting topics, this is a comma-separated list of topics to delete")
+	flag.StringVar(&computeTopicConfigs, "compute-topic-configs", "", "Comma-separated key=value configs for the compute topic. Valid keys are retention.ms, retention.bytes, cleanup.policy, min.insync.replicas and compression.type")
+	flag.IntVar(&resultsPartitionCnt, "results-topic-partitions", 1, "Partitions for the results topic")
+	flag.IntVar(&resultsReplicationFactor, "results-topic-replfactor", 1, "Replication factor for the results topic. Tune to your Kafka cluster size")
+	flag.StringVar(&resultsTopicConfigs, "results-topic-configs", "", "Comma-separated key=value configs for the results topic. Same keys as --compute-topic-configs")
+	flag.StringVar(&topicSpecFile, "topic-specs", "", "YAML file of topic specs that override the topic flags. See the README")
+	flag.StringVar(&onDrift, "on-drift", onDriftWarn, "What the read and compute commands do when a topic they write to has drifted from its spec: 'warn' or 'fail'")
+	flag.StringVar(&fromFile, "from-file", "", "FQPN of census file to load (i.e. don't download from the census site - use a file on the filesystem). Also requires you to specify a year via the --years option. The month is taken from the file name (e.g. dec20pub.dat.gz) unless one month is specified via --months")
+	flag.StringVar(&topic, "topic", "", "If listing offsets, this is the topic for which to list offsets. If deleting or describing topics, this is a comma-separated list of topics to delete or describe. Describe defaults to the compute and results topics")
 	flag.BoolVar(&verbose, "verbose", false, "Prints verbose diagnostic messages")
 	flag.IntVar(&resultsPort, "results-port", 8888, "REST endpoint port for results")
 	flag.IntVar(&delay, "delay", 0, "slows down processing by introducing a delay in the processing loops. Value is millis. Supports testing")
@@ -27,10 +42,51 @@ func init() {
 	flag.StringVar(&metricsPort, "metrics-port", "9123", "The Prometheus metrics exposition port")
 	flag.BoolVar(&printVersion, "version", false, "Prints the version number and exits")
 	flag.BoolVar(&noShutdownReader, "no-shutdown-reader", false, "If true, leaves the reader running (inactive) after all gzips have been processed and chunked")
-	flag.BoolVar(&force, "force", false, "Forces some commands. So far - only applies to the rmtopics command")
+	flag.BoolVar(&force, "force", false, "Forces some commands. Applies to the rmtopics command, and to the resetoffsets command when the group has active members")
+	flag.StringVar(&resultsReplicas, "results-replicas", "", "Comma-separated host:port list of results replicas for the results-gateway command to merge. Each host may resolve to many addresses - e.g. a headless Service")
+	flag.IntVar(&adminPort, "admin-port", 0, "Port for the admin http server with the /healthz and /readyz endpoints. Zero (the default) disables it. Ignored unless role is 'read', 'compute', 'results' or 'results-gateway'")
+	flag.IntVar(&livenessSecs, "liveness-secs", 120, "How long the Kafka reader or writer can be failing before /healthz fails")
+	flag.StringVar(&snapshotFile, "snapshot-file", "", "File the results command restores its results from at startup, and writes snapshots of its results to")
+	flag.IntVar(&snapshotSecs, "snapshot-secs", 0, "Seconds between results snapshots. Zero means only on demand via the /admin/snapshot route. Requires --snapshot-file")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required by the /admin routes of the results command. If omitted, the "+adminTokenEnv+" environment variable is used. If neither is set, the admin routes are disabled")
+	flag.StringVar(&group, "group", "", "Consumer group for the lag, resetoffsets and groups commands. Defaults to the group the app uses for --topic, except for groups, which lists all groups if omitted")
+	flag.StringVar(&resetTo, "to", "", "Where the resetoffsets command resets to: 'earliest', 'latest' or an RFC3339 timestamp like 2021-03-01T15:04:05Z")
+	flag.Int64Var(&shiftBy, "shift-by", 0, "Moves the committed offsets of the resetoffsets command by this many messages. Negative rewinds")
+	flag.StringVar(&toOffsets, "to-offsets", "", "Explicit offsets for the resetoffsets command as comma-separated partition:offset pairs. E.g. --to-offsets=0:100,1:250")
+	flag.BoolVar(&execute, "execute", false, "Commits the offsets computed by the resetoffsets command. Without it the resets are only previewed")
+	flag.BoolVar(&watch, "watch", false, "Refreshes the lag, groups or status command output every --interval seconds until interrupted")
+	flag.StringVar(&resultsURL, "results-url", "", "URL of the results role or results gateway - e.g. http://192.168.0.46:32099. If specified, the status command includes the per-source record counts from its /reconcile endpoint, and the bench command measures end-to-end throughput and latency from its /bench endpoint")
+	flag.IntVar(&benchRate, "rate", 0, "Chunks per second the bench command writes. Zero means as fast as possible")
+	flag.IntVar(&benchTimeout, "bench-timeout", 300, "Seconds the bench command waits for the results of its chunks after writing them")
+	flag.StringVar(&benchReport, "bench-report", "", "File the bench command appends its report to as a JSON line. All the reports in the file are printed, so runs at different compute replica counts can be compared")
+	flag.IntVar(&workers, "workers", 2, "Compute workers the local command runs. Workers beyond --compute-topic-partitions are idle")
+	flag.IntVar(&interval, "interval", 5, "Seconds between refreshes when watching")
+	flag.IntVar(&partition, "partition", -1, "Partition the tail command reads. -1 means all partitions")
+	flag.StringVar(&from, "from", fromEarliest, "Where the tail command starts reading each partition: 'earliest', 'latest', an offset, or an RFC3339 timestamp like 2021-03-01T15:04:05Z")
+	flag.IntVar(&limit, "limit", 0, "Maximum number of messages the tail command prints. Zero means no limit")
+	flag.BoolVar(&follow, "follow", false, "Keeps the tail command reading new messages as they are written, until interrupted")
+	flag.BoolVar(&decode, "decode", false, "Prints chunk, result and summary messages in decoded form in the tail command")
+	flag.StringVar(&input, "input", "", "File the produce command reads messages from. Empty or '-' means stdin")
+	flag.StringVar(&format, "format", formatLines, "Input format of the produce command: 'lines' (each line is a message value) or 'ndjson' (each line is a JSON object with key, value and headers)")
+	flag.IntVar(&partitions, "partitions", 0, "The partition count the alter-topic command increases --topic to")
+	flag.StringVar(&topicConfigs, "topic-configs", "", "Comma-separated key=value configs the alter-topic command sets on --topic. E.g. --topic-configs=retention.ms=3600000,cleanup.policy=delete. An empty value removes the config from the topic")
+	flag.StringVar(&output, "output", outputTable, "Output format of the topiclist, offsets, describe, lag, resetoffsets, groups, alter-topic, apply-topics, status and bench commands: 'table', 'json', 'yaml' or 'csv'")
+	flag.BoolVar(&tlsEnabled, "tls", false, "Connects to Kafka with TLS. Implied by any of the other --tls-* file flags")
+	flag.StringVar(&tlsCAFile, "tls-ca-file", "", "PEM file of the CA certificates that signed the broker certificates - e.g. the Strimzi cluster CA. If omitted, the system roots are used")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "PEM client certificate file for mutual TLS. Requires --tls-key-file")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "PEM client key file for mutual TLS. Requires --tls-cert-file")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "Server name verified in the broker certificates. If omitted, the host name of each broker is verified")
+	flag.BoolVar(&tlsInsecure, "tls-insecure-skip-verify", false, "Doesn't verify the broker certificates. For testing only")
+	flag.StringVar(&saslMechanism, "sasl-mechanism", "", "SASL mechanism to authenticate to Kafka with: 'plain', 'scram-sha-256' or 'scram-sha-512'. If omitted, there is no authentication")
+	flag.StringVar(&saslUsername, "sasl-username", "", "SASL username. If omitted, the "+saslUsernameEnv+" environment variable is used")
+	flag.StringVar(&saslPasswordFile, "sasl-password-file", "", "File holding the SASL password. If omitted, the "+saslPasswordEnv+" environment variable is used")
+	flag.IntVar(&streamBuffer, "stream-buffer", 256, "Updates queued per streaming results subscriber. A subscriber that falls further behind is resynced with a snapshot")
 }
 
-var validCommands = []string {read, compute, results, topiclist, offsets, rmtopics}
+// the topic names Kafka accepts
+var validTopicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+var validCommands = []string{read, compute, results, resultsGateway, topiclist, offsets, rmtopics, describe, lag, resetoffsets, tail, produce, groups, alterTopic, applyTopics, status, bench, local}
 
 var version = "1.0.1"
 
@@ -39,6 +95,9 @@ func validateCmdline() bool {
 	flag.Parse()
 	tmp := flag.Args()
 
+	if adminToken == "" {
+		adminToken = os.Getenv(adminTokenEnv)
+	}
 	if len(os.Args) == 1 || printVersion {
 		fmt.Printf("kakfa-scale version: %v\n", version)
 		return false
@@ -62,22 +121,35 @@ func validateCmdline() bool {
 			return false
 		}
 	}
-	if writeTo != writeToKafka && writeTo != writeToStdout && writeTo != WriteToNull {
+	if writeTo != writeToKafka && writeTo != writeToStdout && writeTo != WriteToNull && writeTo != writeToFile {
 		fmt.Printf("unknown value %v for --write-to\n", writeTo)
 		return false
+	} else if writeTo == writeToFile && writeFile == "" {
+		fmt.Printf("--write-to=file requires --write-file\n")
+		return false
+	} else if readFrom != readFromKafka && readFrom != readFromFile {
+		fmt.Printf("unknown value %v for --read-from\n", readFrom)
+		return false
+	} else if readFrom == readFromFile && readFile == "" {
+		fmt.Printf("--read-from=file requires --read-file\n")
+		return false
 	}
 	needKafkaUrl := false
-	if (command == results || command == rmtopics || command == topiclist || command == compute) || (command == read && writeTo == writeToKafka) {
+	if (command == rmtopics || command == topiclist || command == describe || command == lag || command == resetoffsets || command == tail || command == produce || command == groups || command == alterTopic || command == applyTopics || command == status || command == bench || command == resultsGateway) ||
+		((command == compute || command == results) && readFrom == readFromKafka) || ((command == read || command == compute) && writeTo == writeToKafka) {
 		needKafkaUrl = true
 	}
 	if needKafkaUrl && kafkaBrokers == "" {
 		fmt.Printf("need Kafka cluster broker URL(s)\n")
 		return false
-	} else if command == read && fromFile == "" && (years == "" || months == "") {
-		fmt.Printf("if command is 'read' then '--years' and '--months' are both required\n")
+	} else if (command == read || command == local) && fromFile == "" && (years == "" || months == "") {
+		fmt.Printf("if command is '%v' then '--years' and '--months' are both required\n", command)
+		return false
+	} else if (command == read || command == local) && fromFile != "" && years == "" {
+		fmt.Printf("if command is '%v' and --from-file is specified, then '--years' is required with one value like --years=2018 - that being the year of the file\n", command)
 		return false
-	} else if command == read && fromFile != "" && years == "" {
-		fmt.Printf("if command is 'read' and --from-file is specified, then '--years' is required with one value like --years=2018 - that being the year of the file\n")
+	} else if command == local && workers < 1 {
+		fmt.Printf("--workers must be at least 1\n")
 		return false
 	} else if months != "" && !parseMonths() {
 		fmt.Printf("Can't parse months: %v. Must be comma-separated and abbreviated like '--months=jan,feb,mar' etc. ('*' is also allowed)\n", months)
@@ -85,8 +157,50 @@ func validateCmdline() bool {
 	} else if years != "" && !parseYears() {
 		fmt.Printf("Can't parse years: %v. Must be comma-separated and each year between 1970 and 2020 inclusive like --years=2019,2020\n", years)
 		return false
-	} else if (command == rmtopics || command == offsets) && topic == "" {
-		fmt.Printf("Must specify --topic with 'rmtopics' nad 'offsets' commands\n")
+	} else if command == resultsGateway && resultsReplicas == "" {
+		fmt.Printf("if command is 'results-gateway' then '--results-replicas' is required\n")
+		return false
+	} else if snapshotSecs > 0 && snapshotFile == "" {
+		fmt.Printf("--snapshot-secs requires --snapshot-file\n")
+		return false
+	} else if (command == results || command == local) && streamBuffer < 1 {
+		fmt.Printf("--stream-buffer must be at least 1\n")
+		return false
+	} else if (command == rmtopics || command == offsets || command == lag || command == resetoffsets || command == tail || command == produce || command == alterTopic) && topic == "" {
+		fmt.Printf("Must specify --topic with 'rmtopics', 'offsets', 'lag', 'resetoffsets', 'tail', 'produce' and 'alter-topic' commands\n")
+		return false
+	} else if command == alterTopic && partitions <= 0 && topicConfigs == "" {
+		fmt.Printf("the 'alter-topic' command requires --partitions or --topic-configs or both\n")
+		return false
+	} else if onDrift != onDriftWarn && onDrift != onDriftFail {
+		fmt.Printf("unknown value %v for --on-drift\n", onDrift)
+		return false
+	} else if !configurePipeline() {
+		return false
+	} else if !parseTopicSpecs() {
+		return false
+	} else if !parseSecurity() {
+		return false
+	} else if output != outputTable && output != outputJSON && output != outputYAML && output != outputCSV {
+		fmt.Printf("unknown value %v for --output\n", output)
+		return false
+	} else if command == produce && format != formatLines && format != formatNDJSON {
+		fmt.Printf("unknown value %v for --format\n", format)
+		return false
+	} else if (command == lag || command == resetoffsets) && group == "" && consumerGrpForTopic[topic] == "" {
+		fmt.Printf("topic %v is not read by the app - specify the consumer group with --group\n", topic)
+		return false
+	} else if command == resetoffsets && countSet(resetTo != "", shiftBy != 0, toOffsets != "") != 1 {
+		fmt.Printf("the 'resetoffsets' command requires exactly one of --to, --shift-by and --to-offsets\n")
+		return false
+	} else if command == bench && chunkCount <= 0 {
+		fmt.Printf("the 'bench' command requires --chunks\n")
+		return false
+	} else if command == bench && (benchRate < 0 || benchTimeout < 0) {
+		fmt.Printf("--rate and --bench-timeout can't be negative\n")
+		return false
+	} else if watch && interval < 1 {
+		fmt.Printf("--interval must be at least 1\n")
 		return false
 	}
 	return true
@@ -95,7 +209,18 @@ func validateCmdline() bool {
 // Print how the program is interpreting the command line
 func doDryRun() {
 	fmt.Printf("Command: %v\n", command)
-	if command == read {
+	fmt.Printf("Pipeline: %v\n", pipeline)
+	fmt.Printf("Compute topic: %v (group: %v)\n", compute_topic, consumerGrpForTopic[compute_topic])
+	fmt.Printf("Results topic: %v (group: %v)\n", results_topic, consumerGrpForTopic[results_topic])
+	fmt.Printf("TLS: %v\n", kafkaTLS != nil)
+	if kafkaTLS != nil {
+		fmt.Printf("TLS CA file: %v\n", tlsCAFile)
+		fmt.Printf("TLS client cert file: %v\n", tlsCertFile)
+		fmt.Printf("TLS server name: %v\n", tlsServerName)
+		fmt.Printf("TLS skip verify: %v\n", tlsInsecure)
+	}
+	fmt.Printf("SASL mechanism: %v\n", saslMechanism)
+	if command == read || command == local {
 		fmt.Printf("Years: %v\n", years)
 		fmt.Printf("Months: %v\n", months)
 		fmt.Printf("From file: %v\n", fromFile)
@@ -103,26 +228,121 @@ func doDryRun() {
 		fmt.Printf("Months: %v\n", monthsArr)
 		fmt.Printf("Year: %v\n", yearsArr)
 	}
+	if command == bench {
+		fmt.Printf("Chunk count: %v\n", chunkCount)
+		fmt.Printf("Rate: %v\n", benchRate)
+		fmt.Printf("Results URL: %v\n", resultsURL)
+		fmt.Printf("Bench timeout: %v\n", benchTimeout)
+		fmt.Printf("Bench report: %v\n", benchReport)
+		fmt.Printf("Compute Topic Spec: %v\n", formatTopicSpec(topicSpecs[compute_topic]))
+		fmt.Printf("On drift: %v\n", onDrift)
+	}
+	if command == compute || command == results {
+		fmt.Printf("Read from: %v\n", readFrom)
+		if readFrom == readFromFile {
+			fmt.Printf("Read file: %v\n", readFile)
+		}
+	}
 	if command == read || command == compute {
 		fmt.Printf("Write to: %v\n", writeTo)
+		if writeTo == writeToFile {
+			fmt.Printf("Write file: %v\n", writeFile)
+		}
 		fmt.Printf("Kafka bootstrap URL: %v\n", kafkaBrokers)
 		if command == read && writeTo == writeToKafka {
-			fmt.Printf("Compute Topic Partitions: %v\n", partitionCnt)
-			fmt.Printf("Compute Topic Replication Factor: %v\n", replicationFactor)
+			fmt.Printf("Compute Topic Spec: %v\n", formatTopicSpec(topicSpecs[compute_topic]))
+		} else if command == compute && writeTo == writeToKafka {
+			fmt.Printf("Results Topic Spec: %v\n", formatTopicSpec(topicSpecs[results_topic]))
 		}
+		fmt.Printf("On drift: %v\n", onDrift)
 	}
-	if command == results {
+	if command == applyTopics {
+		for _, t := range sortedTopics(topicSpecs) {
+			fmt.Printf("Topic Spec: %v\n", formatTopicSpec(topicSpecs[t]))
+		}
+	}
+	if command == local {
+		fmt.Printf("Compute workers: %v\n", workers)
+		fmt.Printf("Compute topic partitions: %v\n", topicSpecs[compute_topic].Partitions)
+		fmt.Printf("Results topic partitions: %v\n", topicSpecs[results_topic].Partitions)
+	}
+	if command == results || command == local {
+		if command == results {
+			fmt.Printf("Kafka bootstrap URL: %v\n", kafkaBrokers)
+		}
+		fmt.Printf("Results port: %v\n", resultsPort)
+		fmt.Printf("Stream buffer: %v\n", streamBuffer)
+		fmt.Printf("Snapshot file: %v\n", snapshotFile)
+		fmt.Printf("Snapshot seconds: %v\n", snapshotSecs)
+		fmt.Printf("Admin routes enabled: %v\n", adminToken != "")
+	}
+	if command == resultsGateway {
 		fmt.Printf("Kafka bootstrap URL: %v\n", kafkaBrokers)
+		fmt.Printf("Results replicas: %v\n", resultsReplicas)
 		fmt.Printf("Results port: %v\n", resultsPort)
 	}
-	if command == topiclist || command == rmtopics || command == offsets {
+	if command == topiclist || command == rmtopics || command == offsets || command == describe || command == lag || command == resetoffsets || command == tail || command == produce || command == alterTopic {
+		fmt.Printf("Topic: %v\n", topic)
+	}
+	if command == topiclist || command == offsets || command == describe || command == lag || command == resetoffsets || command == groups || command == alterTopic || command == applyTopics || command == status || command == bench {
+		fmt.Printf("Output: %v\n", output)
+	}
+	if command == alterTopic {
+		fmt.Printf("Partitions: %v\n", partitions)
+		fmt.Printf("Topic configs: %v\n", topicConfigs)
+	}
+	if command == status {
+		fmt.Printf("Results URL: %v\n", resultsURL)
+		fmt.Printf("Watch: %v\n", watch)
+		fmt.Printf("Interval: %v\n", interval)
+	}
+	if command == groups {
+		fmt.Printf("Group: %v\n", group)
 		fmt.Printf("Topic: %v\n", topic)
+		fmt.Printf("Watch: %v\n", watch)
+		fmt.Printf("Interval: %v\n", interval)
+	}
+	if command == produce {
+		fmt.Printf("Input: %v\n", input)
+		fmt.Printf("Format: %v\n", format)
+	}
+	if command == tail {
+		fmt.Printf("Partition: %v\n", partition)
+		fmt.Printf("From: %v\n", from)
+		fmt.Printf("Limit: %v\n", limit)
+		fmt.Printf("Follow: %v\n", follow)
+		fmt.Printf("Decode: %v\n", decode)
+	}
+	if command == resetoffsets {
+		fmt.Printf("Group: %v\n", group)
+		fmt.Printf("To: %v\n", resetTo)
+		fmt.Printf("Shift by: %v\n", shiftBy)
+		fmt.Printf("To offsets: %v\n", toOffsets)
+		fmt.Printf("Execute: %v\n", execute)
+		fmt.Printf("Force: %v\n", force)
+	}
+	if command == lag {
+		fmt.Printf("Group: %v\n", group)
+		fmt.Printf("Watch: %v\n", watch)
+		fmt.Printf("Interval: %v\n", interval)
 	}
-	if command == read || command == compute || command == results {
+	if command == read || command == compute || command == results || command == resultsGateway {
+		fmt.Printf("Admin port: %v\n", adminPort)
 		fmt.Printf("Metrics exposition: %v\n", withMetrics)
 	}
 }
 
+// returns how many of the passed conditions are true
+func countSet(conditions ...bool) int {
+	n := 0
+	for _, c := range conditions {
+		if c {
+			n++
+		}
+	}
+	return n
+}
+
 // parses the --years command line param
 func parseYears() bool {
 	for _, s := range strings.Split(years, ",") {
@@ -135,17 +355,109 @@ func parseYears() bool {
 	return true
 }
 
+// the month abbreviations used by the census site, in calendar order
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+
+// returns the calendar month number (1-12) of the passed month abbreviation, or zero if not valid
+func monthNumber(month string) int {
+	for i, m := range monthNames {
+		if m == month {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Sets the topic names and consumer groups from --pipeline and the topic and group overrides. An override is
+// used as is. Otherwise the default name is prefixed by the pipeline
+func configurePipeline() bool {
+	prefix := ""
+	if pipeline != "" {
+		prefix = pipeline + "-"
+	}
+	compute_topic, results_topic = prefix+"compute", prefix+"results"
+	if computeTopicName != "" {
+		compute_topic = computeTopicName
+	}
+	if resultsTopicName != "" {
+		results_topic = resultsTopicName
+	}
+	computeGrp, resultsGrp := prefix+computeConsumer, prefix+resultConsumer
+	if computeGroup != "" {
+		computeGrp = computeGroup
+	}
+	if resultsGroup != "" {
+		resultsGrp = resultsGroup
+	}
+	for _, t := range []string{compute_topic, results_topic} {
+		if !validTopicName.MatchString(t) {
+			fmt.Printf("invalid topic name: %v. Topic names are up to 249 letters, digits, '.', '_' and '-'\n", t)
+			return false
+		}
+	}
+	if compute_topic == results_topic {
+		fmt.Printf("the compute and results topics must be different - both are %v\n", compute_topic)
+		return false
+	} else if computeGrp == resultsGrp {
+		fmt.Printf("the compute and results consumer groups must be different - both are %v\n", computeGrp)
+		return false
+	}
+	consumerGrpForTopic = map[string]string{compute_topic: computeGrp, results_topic: resultsGrp}
+	return true
+}
+
+// builds the TLS config and SASL mechanism of the Kafka connections from the --tls-* and --sasl-* flags
+func parseSecurity() bool {
+	var err error
+	if kafkaTLS, err = newTLSConfig(tlsEnabled, tlsCAFile, tlsCertFile, tlsKeyFile, tlsServerName, tlsInsecure); err != nil {
+		fmt.Printf("%v\n", err)
+		return false
+	}
+	if kafkaSASL, err = newSASLMechanism(saslMechanism, saslUsername, saslPasswordFile); err != nil {
+		fmt.Printf("%v\n", err)
+		return false
+	}
+	return true
+}
+
+// builds the topic specs from the topic flags and the --topic-specs file
+func parseTopicSpecs() bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	compute := TopicSpec{Topic: compute_topic, Partitions: partitionCnt, ReplicationFactor: replicationFactor,
+		PartitionsSet: set["compute-topic-partitions"], ReplicationSet: set["compute-topic-replfactor"]}
+	results := TopicSpec{Topic: results_topic, Partitions: resultsPartitionCnt, ReplicationFactor: resultsReplicationFactor,
+		PartitionsSet: set["results-topic-partitions"], ReplicationSet: set["results-topic-replfactor"]}
+	var err error
+	if computeTopicConfigs != "" {
+		if compute.Configs, err = parseTopicConfigs(computeTopicConfigs); err != nil {
+			fmt.Printf("--compute-topic-configs: %v\n", err)
+			return false
+		}
+	}
+	if resultsTopicConfigs != "" {
+		if results.Configs, err = parseTopicConfigs(resultsTopicConfigs); err != nil {
+			fmt.Printf("--results-topic-configs: %v\n", err)
+			return false
+		}
+	}
+	if topicSpecs, err = loadTopicSpecs([]TopicSpec{compute, results}, topicSpecFile); err != nil {
+		fmt.Printf("%v\n", err)
+		return false
+	}
+	return true
+}
+
 // parses the --months command line param
 func parseMonths() bool {
-	valid := map[string]int {"jan":0,"feb":0,"mar":0,"apr":0,"may":0,"jun":0,"jul":0,"aug":0,"sep":0,"oct":0,"nov":0,"dec":0}
 	if months == "*" {
-		for k := range valid {
-			monthsArr = append(monthsArr, k)
-		}
+		monthsArr = append(monthsArr, monthNames...)
 		return true
 	}
 	for _, s := range strings.Split(months, ",") {
-		if _, ok := valid[s]; !ok {
+		if monthNumber(s) == 0 {
 			return false
 		}
 		monthsArr = append(monthsArr, s)
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// writes the passed values to the passed topic with the produce command, one message per value
+func produceTestMessages(t *testing.T, kafkaBrokers string, topic string, values ...string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "messages.txt")
+	if err := ioutil.WriteFile(file, []byte(strings.Join(values, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := runCmd(t, func() { produceCmd(kafkaBrokers, topic, file, formatLines, false) })
+	if want := fmt.Sprintf("%v messages written to topic %v, 0 failed", len(values), topic); !strings.Contains(out, want) {
+		t.Fatalf("got: %v, want: %v", out, want)
+	}
+}
+
+// Joins the passed group on the passed topic and reads the passed number of messages, which commits their
+// offsets. Returns the reader, which is still a member of the group until it is closed
+func consumeTestMessages(t *testing.T, kafkaBrokers string, topic string, group string, n int) *kafka.Reader {
+	t.Helper()
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  brokerList(kafkaBrokers),
+		GroupID:  group,
+		Topic:    topic,
+		MinBytes: 1,
+		MaxBytes: 10e6,
+		Dialer:   newDialer(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadMessage(ctx); err != nil {
+			r.Close()
+			t.Fatalf("error reading message %v from topic %v: %v", i, topic, err)
+		}
+	}
+	return r
+}
+
+// unmarshals the JSON output of a command into the passed value
+func unmarshalOutput(t *testing.T, out string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		t.Fatalf("error unmarshaling output: %v\noutput is: %v", err, out)
+	}
+}
+
+// returns the lag of the passed group on the passed topic from the lag command
+func testLag(t *testing.T, kafkaBrokers string, topic string, group string) LagReport {
+	t.Helper()
+	out, code := runCmd(t, func() { lagCmd(kafkaBrokers, topic, group, false, 0, outputJSON) })
+	if code != 0 {
+		t.Fatalf("lag exited %v", code)
+	}
+	var report LagReport
+	unmarshalOutput(t, out, &report)
+	return report
+}
+
+func TestProduceAndTail(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 2)
+	produceTestMessages(t, brokers, "t1", "m1", "m2", "m3", "m4")
+
+	file := filepath.Join(t.TempDir(), "messages.ndjson")
+	lines := `{"key":"k5","value":"m5","headers":{"kind":"result","source":"s1"}}
+not json
+{"value":"m6"}
+`
+	if err := ioutil.WriteFile(file, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := runCmd(t, func() { produceCmd(brokers, "t1", file, formatNDJSON, false) })
+	if !strings.Contains(out, "line 2: error parsing message") || !strings.Contains(out, "2 messages written to topic t1, 1 failed") {
+		t.Errorf("got: %v", out)
+	}
+
+	out, _ = runCmd(t, func() { tailCmd(brokers, "t1", -1, fromEarliest, 0, false, false) })
+	if !strings.Contains(out, "6 messages") {
+		t.Errorf("tail from earliest got: %v, want 6 messages", out)
+	}
+	for _, value := range []string{"m1", "m2", "m3", "m4", "m5", "m6"} {
+		if !strings.Contains(out, "\n"+value+"\n") {
+			t.Errorf("tail from earliest is missing message %v", value)
+		}
+	}
+	if !strings.Contains(out, "key: k5 headers: [kind=result source=s1]") {
+		t.Errorf("tail is missing the key and headers of m5: %v", out)
+	}
+
+	out, _ = runCmd(t, func() { tailCmd(brokers, "t1", -1, fromEarliest, 2, false, false) })
+	if !strings.Contains(out, "2 messages") {
+		t.Errorf("tail with a limit of 2 got: %v", out)
+	}
+	out, _ = runCmd(t, func() { tailCmd(brokers, "t1", -1, fromLatest, 0, false, false) })
+	if !strings.Contains(out, "0 messages") {
+		t.Errorf("tail from latest got: %v", out)
+	}
+	out, _ = runCmd(t, func() { tailCmd(brokers, "t1", 0, "1", 0, false, false) })
+	if strings.Contains(out, "partition: 1 ") || strings.Contains(out, "offset: 0 ") {
+		t.Errorf("tail of partition 0 from offset 1 got: %v", out)
+	}
+	out, _ = runCmd(t, func() { tailCmd(brokers, "t1", 5, fromEarliest, 0, false, false) })
+	if !strings.Contains(out, "topic t1 has no partition 5") {
+		t.Errorf("tail of a missing partition got: %v", out)
+	}
+}
+
+func TestTailDecode(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, results_topic, 1)
+	file := filepath.Join(t.TempDir(), "messages.ndjson")
+	if err := ioutil.WriteFile(file, []byte(`{"value":"2020-01:1,1,12,x","headers":{"kind":"result"}}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, func() { produceCmd(brokers, results_topic, file, formatNDJSON, false) })
+	out, _ := runCmd(t, func() { tailCmd(brokers, results_topic, -1, fromEarliest, 0, false, true) })
+	if !strings.Contains(out, "result: period: 2020-01 unparsable: 1 housing codes:") {
+		t.Errorf("got: %v", out)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 3)
+	produceTestMessages(t, brokers, "t1", "m1", "m2", "m3", "m4", "m5")
+
+	out, code := runCmd(t, func() { describeCmd(brokers, "t1", outputJSON) })
+	if code != 0 {
+		t.Fatalf("describe exited %v", code)
+	}
+	var descriptions []TopicDescription
+	unmarshalOutput(t, out, &descriptions)
+	if len(descriptions) != 1 || len(descriptions[0].Partitions) != 3 {
+		t.Fatalf("got: %+v, want one topic with 3 partitions", descriptions)
+	}
+	d := descriptions[0]
+	var latest int64
+	for _, p := range d.Partitions {
+		if p.Leader == "" || len(p.Replicas) != 1 || len(p.Isr) != 1 || p.Offline != 0 || p.Earliest != 0 || p.Error != "" {
+			t.Errorf("got partition: %+v", p)
+		}
+		latest += p.Latest
+	}
+	if latest != 5 {
+		t.Errorf("got %v messages in the latest offsets, want 5", latest)
+	}
+	if d.Configs["retention.ms"] != fakeTopicDefaults["retention.ms"] {
+		t.Errorf("got configs: %v", d.Configs)
+	}
+
+	// CSV has a row per partition
+	out, _ = runCmd(t, func() { describeCmd(brokers, "t1", outputCSV) })
+	if rows := strings.Split(strings.TrimSpace(out), "\n"); len(rows) != 4 {
+		t.Errorf("got CSV: %v, want a header and 3 rows", out)
+	}
+}
+
+func TestLagAndResetOffsets(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 3)
+	values := make([]string, 10)
+	for i := range values {
+		values[i] = fmt.Sprintf("m%v", i)
+	}
+	produceTestMessages(t, brokers, "t1", values...)
+	consumeTestMessages(t, brokers, "t1", "g1", 4).Close()
+
+	report := testLag(t, brokers, "t1", "g1")
+	if report.TotalLag != 6 || len(report.Partitions) != 3 {
+		t.Fatalf("got lag: %+v, want 6 over 3 partitions", report)
+	}
+
+	// preview
+	out, code := runCmd(t, func() { resetOffsetsCmd(brokers, "t1", "g1", fromEarliest, 0, "", false, false, outputJSON) })
+	var reset ResetReport
+	unmarshalOutput(t, out, &reset)
+	if code != 0 || reset.Committed || len(reset.Resets) != 3 {
+		t.Fatalf("preview exited %v with: %+v", code, reset)
+	}
+	for _, r := range reset.Resets {
+		if r.Target != 0 {
+			t.Errorf("got target %v for partition %v, want 0", r.Target, r.Partition)
+		}
+	}
+	if lag := testLag(t, brokers, "t1", "g1").TotalLag; lag != 6 {
+		t.Errorf("a preview changed the lag to %v", lag)
+	}
+
+	// refused while the group has a member
+	member := consumeTestMessages(t, brokers, "t1", "g1", 1)
+	out, code = runCmd(t, func() { resetOffsetsCmd(brokers, "t1", "g1", fromEarliest, 0, "", true, false, outputJSON) })
+	reset = ResetReport{}
+	unmarshalOutput(t, out, &reset)
+	if code == 0 || reset.Committed || len(reset.ActiveMembers) != 1 {
+		t.Errorf("reset with an active member exited %v with: %+v", code, reset)
+	}
+	member.Close()
+
+	// executed
+	out, code = runCmd(t, func() { resetOffsetsCmd(brokers, "t1", "g1", fromEarliest, 0, "", true, false, outputJSON) })
+	reset = ResetReport{}
+	unmarshalOutput(t, out, &reset)
+	if code != 0 || !reset.Committed {
+		t.Fatalf("reset exited %v with: %+v", code, reset)
+	}
+	if lag := testLag(t, brokers, "t1", "g1").TotalLag; lag != 10 {
+		t.Errorf("got lag %v after resetting to earliest, want 10", lag)
+	}
+
+	// shift by
+	runCmd(t, func() { resetOffsetsCmd(brokers, "t1", "g1", "", 1, "", true, false, outputJSON) })
+	if lag := testLag(t, brokers, "t1", "g1").TotalLag; lag != 7 {
+		t.Errorf("got lag %v after shifting by 1, want 7", lag)
+	}
+
+	// a topic that doesn't exist
+	_, code = runCmd(t, func() { lagCmd(brokers, "nope", "g1", false, 0, outputJSON) })
+	if code == 0 {
+		t.Errorf("lag of a topic that doesn't exist exited zero")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 2)
+	produceTestMessages(t, brokers, "t1", "m1", "m2", "m3")
+	member := consumeTestMessages(t, brokers, "t1", "g1", 1)
+	defer member.Close()
+	consumeTestMessages(t, brokers, "t1", "g2", 3).Close()
+
+	out, code := runCmd(t, func() { groupsCmd(brokers, "", "", false, 0, outputJSON) })
+	var summaries []GroupSummary
+	unmarshalOutput(t, out, &summaries)
+	if code != 0 || len(summaries) != 2 {
+		t.Fatalf("groups exited %v with: %+v", code, summaries)
+	}
+	if s := summaries[0]; s.Group != "g1" || s.State != groupStable || s.Members != 1 {
+		t.Errorf("got g1: %+v", s)
+	}
+	if s := summaries[1]; s.Group != "g2" || s.State != groupEmpty || s.Members != 0 {
+		t.Errorf("got g2: %+v", s)
+	}
+
+	out, code = runCmd(t, func() { groupsCmd(brokers, "g1", "", false, 0, outputJSON) })
+	var d GroupDescription
+	unmarshalOutput(t, out, &d)
+	if code != 0 || d.State != groupStable || len(d.Members) != 1 {
+		t.Fatalf("describing g1 exited %v with: %+v", code, d)
+	}
+	if got := d.Members[0].Assignments["t1"]; len(got) != 2 {
+		t.Errorf("got assignments: %v, want both partitions of t1", d.Members[0].Assignments)
+	}
+	if len(d.Offsets["t1"]) != 2 {
+		t.Errorf("got offsets: %v", d.Offsets)
+	}
+
+	// an empty group is shown with the offsets of the passed topic
+	out, _ = runCmd(t, func() { groupsCmd(brokers, "g2", "t1", false, 0, outputJSON) })
+	d = GroupDescription{}
+	unmarshalOutput(t, out, &d)
+	var lag int64
+	for _, o := range d.Offsets["t1"] {
+		lag += o.Lag
+	}
+	if len(d.Members) != 0 || len(d.Offsets["t1"]) != 2 || lag != 0 {
+		t.Errorf("got g2: %+v", d)
+	}
+}
+
+func TestAlterTopic(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 2)
+
+	out, code := runCmd(t, func() { alterTopicCmd(brokers, "t1", 4, "retention.ms=3600000,cleanup.policy=compact", outputJSON) })
+	var descriptions []TopicDescription
+	unmarshalOutput(t, out, &descriptions)
+	if code != 0 || len(descriptions) != 1 {
+		t.Fatalf("alter-topic exited %v with: %+v", code, descriptions)
+	}
+	d := descriptions[0]
+	if len(d.Partitions) != 4 || d.Configs["retention.ms"] != "3600000" || d.Configs["cleanup.policy"] != "compact" {
+		t.Errorf("got: %+v", d)
+	}
+
+	// an empty value removes the config so the default applies
+	out, _ = runCmd(t, func() { alterTopicCmd(brokers, "t1", 0, "retention.ms=", outputJSON) })
+	descriptions = nil
+	unmarshalOutput(t, out, &descriptions)
+	if got := descriptions[0].Configs["retention.ms"]; got != fakeTopicDefaults["retention.ms"] {
+		t.Errorf("got retention.ms: %v after removing it, want the default", got)
+	}
+
+	// Kafka can't decrease the partition count
+	out, code = runCmd(t, func() { alterTopicCmd(brokers, "t1", 2, "", outputJSON) })
+	if code == 0 || out != "" {
+		t.Errorf("decreasing the partitions exited %v with: %v", code, out)
+	}
+	_, code = runCmd(t, func() { alterTopicCmd(brokers, "t1", 0, "retention.ms", outputJSON) })
+	if code == 0 {
+		t.Errorf("an invalid config exited zero")
+	}
+}
+
+func TestApplyTopics(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	specs := map[string]TopicSpec{
+		"t1": {Topic: "t1", Partitions: 2, ReplicationFactor: 1, Configs: map[string]string{"retention.ms": "3600000"}, PartitionsSet: true},
+		"t2": {Topic: "t2", Partitions: 1, ReplicationFactor: 1},
+	}
+	apply := func() []TopicApplyResult {
+		out, code := runCmd(t, func() { applyTopicsCmd(brokers, specs, outputJSON) })
+		if code != 0 {
+			t.Fatalf("apply-topics exited %v", code)
+		}
+		var results []TopicApplyResult
+		unmarshalOutput(t, out, &results)
+		if len(results) != 2 {
+			t.Fatalf("got: %+v, want 2 topics", results)
+		}
+		return results
+	}
+
+	for _, r := range apply() {
+		if !r.Created || len(r.Drift) != 0 {
+			t.Errorf("first apply got: %+v, want created", r)
+		}
+	}
+	for _, r := range apply() {
+		if r.Created || len(r.Drift) != 0 {
+			t.Errorf("second apply got: %+v, want in sync", r)
+		}
+	}
+
+	// drift the topics: more partitions than the spec can't be fixed, but the config can
+	runCmd(t, func() { alterTopicCmd(brokers, "t1", 3, "retention.ms=1000", outputTable) })
+	results := apply()
+	drift := map[string]TopicDrift{}
+	for _, d := range results[0].Drift {
+		drift[d.Setting] = d
+	}
+	if d := drift["partitions"]; d.Declared != "2" || d.Actual != "3" || d.Fixable {
+		t.Errorf("got partitions drift: %+v", d)
+	}
+	if d := drift["retention.ms"]; d.Declared != "3600000" || d.Actual != "1000" || !d.Fixable || !d.Fixed {
+		t.Errorf("got retention.ms drift: %+v", d)
+	}
+	if len(results[1].Drift) != 0 {
+		t.Errorf("got t2 drift: %+v", results[1].Drift)
+	}
+	out, _ := runCmd(t, func() { describeCmd(brokers, "t1", outputJSON) })
+	var descriptions []TopicDescription
+	unmarshalOutput(t, out, &descriptions)
+	if got := descriptions[0].Configs["retention.ms"]; got != "3600000" {
+		t.Errorf("got retention.ms: %v after apply, want 3600000", got)
+	}
+}
+
+func TestEnsureTopicDrift(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 3)
+
+	// partitions above a default aren't drift, and the fake broker's replication factor of 1 matches
+	if err := ensureTopic(brokers, TopicSpec{Topic: "t1", Partitions: 1, ReplicationFactor: 3}, onDriftFail); err != nil {
+		t.Errorf("got error: %v for undeclared settings", err)
+	}
+	for _, spec := range []TopicSpec{
+		{Topic: "t1", Partitions: 1, ReplicationFactor: 1, PartitionsSet: true},
+		{Topic: "t1", Partitions: 3, ReplicationFactor: 3, ReplicationSet: true},
+		{Topic: "t1", Partitions: 4, ReplicationFactor: 1},
+		{Topic: "t1", Partitions: 3, ReplicationFactor: 1, Configs: map[string]string{"retention.ms": "1000"}},
+	} {
+		var err error
+		out, _ := runCmd(t, func() { err = ensureTopic(brokers, spec, onDriftFail) })
+		if err == nil || !strings.Contains(out, "WARNING: topic t1 has drifted") {
+			t.Errorf("got error: %v output: %v for spec: %+v, want drift", err, out, spec)
+		}
+		out, _ = runCmd(t, func() { err = ensureTopic(brokers, spec, onDriftWarn) })
+		if err != nil || !strings.Contains(out, "WARNING") {
+			t.Errorf("got error: %v output: %v warning about spec: %+v", err, out, spec)
+		}
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, compute_topic, 2)
+	produceTestMessages(t, brokers, compute_topic, "m1", "m2", "m3", "m4", "m5")
+	consumeTestMessages(t, brokers, compute_topic, consumerGrpForTopic[compute_topic], 3).Close()
+
+	out, code := runCmd(t, func() { offsetsCmd(brokers, compute_topic, outputJSON) })
+	var report TopicOffsets
+	unmarshalOutput(t, out, &report)
+	if code != 0 || report.Topic != compute_topic || report.Group != consumerGrpForTopic[compute_topic] || len(report.Partitions) != 2 {
+		t.Fatalf("offsets exited %v with: %+v", code, report)
+	}
+	var last, lag int64
+	for _, o := range report.Partitions {
+		last += o.Last
+		lag += o.Lag
+	}
+	if last != 5 || lag != 2 {
+		t.Errorf("got last: %v lag: %v, want 5 and 2", last, lag)
+	}
+
+	out, _ = runCmd(t, func() { offsetsCmd(brokers, compute_topic, outputTable) })
+	if !strings.Contains(out, "Listing offsets for topic: "+compute_topic) || !strings.Contains(out, "CommittedOffset") {
+		t.Errorf("got: %v", out)
+	}
+	if _, code = runCmd(t, func() { offsetsCmd(brokers, "nope", outputJSON) }); code == 0 {
+		t.Errorf("offsets of a topic that doesn't exist exited zero")
+	}
+}
+
+func TestRmTopics(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 1)
+	createTestTopic(t, brokers, "t2", 1)
+	exists := func(topic string) bool {
+		t.Helper()
+		partitions, err := getPartitionsForTopic(brokers, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(partitions) != 0
+	}
+
+	out, _ := runCmd(t, func() { rmTopicsCmd(brokers, "t1,t2", false) })
+	if !strings.Contains(out, "--force") || !exists("t1") || !exists("t2") {
+		t.Errorf("rmtopics without --force got: %v", out)
+	}
+	runCmd(t, func() { rmTopicsCmd(brokers, "t1", true) })
+	if exists("t1") || !exists("t2") {
+		t.Errorf("got t1 exists: %v t2 exists: %v after deleting t1", exists("t1"), exists("t2"))
+	}
+	out, _ = runCmd(t, func() { rmTopicsCmd(brokers, "t1,t2", true) })
+	if !strings.Contains(out, "error deleting topic: t1") || exists("t2") {
+		t.Errorf("deleting t1 again and t2 got: %v", out)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, compute_topic, 2)
+	createTestTopic(t, brokers, results_topic, 2)
+	produceTestMessages(t, brokers, compute_topic, "m1", "m2", "m3", "m4")
+	consumeTestMessages(t, brokers, compute_topic, consumerGrpForTopic[compute_topic], 1).Close()
+	writeTestResults(t, brokers, 2)
+	// a source the reader chunked 5 records of, 3 of which reached the results role
+	aggregator.Restore(newAggregateState())
+	defer aggregator.Restore(newAggregateState())
+	aggregator.Apply(resultMessage(0, 0, "s1", 3, map[int]int{1: 3}))
+	aggregator.ApplySummary(0, 1, SourceSummary{Source: "s1", Period: "2020-01", LinesRead: 5, LinesChunked: 5, Chunks: 2, Complete: true})
+	server := httptest.NewServer(resultsRouter(kafkaOffsets(brokers), "", ""))
+	defer server.Close()
+
+	out, code := runCmd(t, func() { statusCmd(brokers, server.URL, false, 0, outputJSON) })
+	var report PipelineReport
+	unmarshalOutput(t, out, &report)
+	if code != 0 || len(report.Stages) != 2 || report.ResultsError != "" {
+		t.Fatalf("status exited %v with: %+v", code, report)
+	}
+	if s := report.Stages[0]; s.Topic != compute_topic || s.TotalLag != 3 {
+		t.Errorf("got compute stage: %+v, want a lag of 3", s)
+	}
+	if s := report.Stages[1]; s.Topic != results_topic || s.TotalLag != 2 {
+		t.Errorf("got results stage: %+v, want a lag of 2", s)
+	}
+	if len(report.Sources) != 1 || report.Expected != 5 || report.Counted != 3 || report.InFlight != 2 {
+		t.Errorf("got sources: %+v expected: %v counted: %v in flight: %v", report.Sources, report.Expected, report.Counted, report.InFlight)
+	}
+
+	out, _ = runCmd(t, func() { statusCmd(brokers, server.URL, false, 0, outputTable) })
+	if !strings.Contains(out, compute_topic) || !strings.Contains(out, "s1") {
+		t.Errorf("got: %v", out)
+	}
+
+	// a results URL that can't be reached is an error, but the stages are still reported
+	out, code = runCmd(t, func() { statusCmd(brokers, "http://127.0.0.1:1", false, 0, outputJSON) })
+	report = PipelineReport{}
+	unmarshalOutput(t, out, &report)
+	if code == 0 || report.ResultsError == "" || len(report.Stages) != 2 {
+		t.Errorf("status with a failing results URL exited %v with: %+v", code, report)
+	}
+}
+
+// Runs the compute and results roles against the fake broker and benches them, then does a run with no results
+// URL, which only measures the send rate. Both runs are in the report file
+func TestBench(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	spec := TopicSpec{Topic: compute_topic, Partitions: 2, ReplicationFactor: 1}
+	createTestTopic(t, brokers, compute_topic, 2)
+	createTestTopic(t, brokers, results_topic, 2)
+	aggregator.Restore(newAggregateState())
+	defer aggregator.Restore(newAggregateState())
+	server := httptest.NewServer(resultsRouter(kafkaOffsets(brokers), "", ""))
+	defer server.Close()
+
+	sink, err := newSink(writeToKafka, "", brokers, TopicSpec{Topic: results_topic, Partitions: 2, ReplicationFactor: 1}, onDriftFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := newKafkaReader(brokers, compute_topic)
+	computed := make(chan struct{})
+	go func() {
+		defer close(computed)
+		calc(sink, chunks, false, 0)
+	}()
+	resultsReader := newKafkaReader(brokers, results_topic)
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		consumeResults(resultsReader, false, 0)
+	}()
+	defer func() {
+		chunks.Close()
+		resultsReader.Close()
+		<-computed
+		<-consumed
+		sink.Close()
+	}()
+	// the compute role has joined its group, so the bench counts it
+	waitFor(t, 30*time.Second, "the compute role to join", func() bool {
+		d, err := describeGroup(brokers, consumerGrpForTopic[compute_topic], "")
+		return err == nil && d.State == groupStable
+	})
+
+	reportFile := filepath.Join(t.TempDir(), "bench.ndjson")
+	out, code := runCmd(t, func() { benchCmd(brokers, spec, onDriftFail, 20, 0, server.URL, 30, reportFile, outputJSON) })
+	var reports []BenchReport
+	unmarshalOutput(t, out, &reports)
+	if code != 0 || len(reports) != 1 {
+		t.Fatalf("bench exited %v with: %+v", code, reports)
+	}
+	r := reports[0]
+	if r.Error != "" || r.ComputeReplicas != 1 || r.Chunks != 20 || r.Records != 20*benchLines || r.Received != 20 {
+		t.Errorf("got report: %+v", r)
+	}
+	if r.Throughput <= 0 || r.P50Millis > r.P99Millis || r.P99Millis > r.MaxMillis*benchBucketFactor {
+		t.Errorf("got throughput and latencies: %+v", r)
+	}
+
+	out, code = runCmd(t, func() { benchCmd(brokers, spec, onDriftFail, 5, 0, "", 30, reportFile, outputJSON) })
+	reports = nil
+	unmarshalOutput(t, out, &reports)
+	if code != 0 || len(reports) != 2 {
+		t.Fatalf("bench exited %v with: %+v, want both runs", code, reports)
+	}
+	if r := reports[1]; r.Chunks != 5 || r.Received != 0 || r.SendRate <= 0 {
+		t.Errorf("got report of a run with no results URL: %+v", r)
+	}
+
+	out, _ = runCmd(t, func() { benchCmd(brokers, spec, onDriftFail, 1, 0, "", 30, "", outputTable) })
+	if !strings.Contains(out, "Replicas") || !strings.Contains(out, "Records/s") {
+		t.Errorf("got: %v", out)
+	}
+}
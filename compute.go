@@ -13,28 +13,34 @@ import (
 
 // Reads from the 'compute' topic, calculates results, and writes to the 'results' topic. Blocks reading from the
 // compute topic indefinitely. So once the topic is emptied, this function will block indefinitely. On the other hand
-// since it is sitting blocking, you can add more results using the read command and processing here will just resume
-func computeCmd(kafkaBrokers string, partitionCnt int, replicationFactor int, verbose bool, writeTo string, delay int) {
-	if err := createTopicIfNotExists(kafkaBrokers, results_topic, partitionCnt, replicationFactor); err != nil {
-		fmt.Printf("error creating topic %v, error is:%v\n", results_topic, err)
+// since it is sitting blocking, you can add more results using the read command and processing here will just resume.
+// The source and sink are chosen by --read-from and --write-to, so compute can also read a file, and write to the
+// console, a file or nowhere. A file source is read to the end, then this function returns
+func computeCmd(kafkaBrokers string, spec TopicSpec, onDrift string, verbose bool, readFrom string, readFile string,
+	writeTo string, writeFile string, delay int) {
+	sink, err := newSink(writeTo, writeFile, kafkaBrokers, spec, onDrift)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	defer sink.Close()
+	r, err := newSource(readFrom, readFile, kafkaBrokers, compute_topic)
+	if err != nil {
+		fmt.Printf("%v\n", err)
 		return
 	}
-	writer := newKafkaWriter(kafkaBrokers, results_topic)
-	defer writer.Close()
-	calc(writer, kafkaBrokers, verbose, writeTo, delay)
-}
-
-func calc(writer *kafka.Writer, url string, verbose bool, writeTo string, delay int) bool {
-	r := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:       strings.Split(url, ","),
-		GroupID:       consumerGrpForTopic[compute_topic],
-		Topic:         compute_topic,
-		QueueCapacity: 1,
-		MinBytes:      10e3, // 10KB
-		MaxBytes:      10e6, // 10MB
-	})
 	defer r.Close()
+	if kr, ok := r.(*kafka.Reader); ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		monitorConsumer(ctx, kafkaBrokers, kr, consumerGrpForTopic[compute_topic])
+	}
+	calc(sink, r, verbose, delay)
+}
 
+// Reads chunks from the passed source and writes the results to the passed sink until the source fails or
+// has no more messages. Returns false
+func calc(sink MessageSink, r MessageSource, verbose bool, delay int) bool {
 	for {
 		// ReadMessage blocks
 		if verbose {
@@ -43,7 +49,7 @@ func calc(writer *kafka.Writer, url string, verbose bool, writeTo string, delay
 		m, err := r.ReadMessage(context.Background())
 		if err != nil {
 			if err == io.EOF {
-				fmt.Printf("reader for topic %v has been closed\n", compute_topic)
+				fmt.Printf("no more messages from topic %v\n", compute_topic)
 				return false
 			}
 			fmt.Printf("error getting chunk from topic: %v, error is: %v\n", compute_topic, err)
@@ -53,39 +59,60 @@ func calc(writer *kafka.Writer, url string, verbose bool, writeTo string, delay
 		if verbose {
 			fmt.Printf("message was read. key: %v, topic: %v, part: %v, offset: %v\n", m.Key, m.Topic, m.Partition, m.Offset)
 		}
+		if headerValue(m, headerKind) == kindSummary {
+			// source summaries from the reader are forwarded as is to the results role for reconciliation
+			if !forward(sink, m, verbose) {
+				return false
+			}
+			continue
+		}
 		scanner := bufio.NewScanner(strings.NewReader(string(m.Value)))
 		codes := ""
 		separator := ""
 		lineCnt := 0
+		records := 0
 		for scanner.Scan() {
 			// get the HEHOUSUT value which is a one or two character code at position 30, zero-relative. So
 			// like " 1" and up to "12". This is the housing code. Just string the codes together into a comma-
-			// separated list like nnnn:1,1,1,2,12,3 where nnnn is the year (year is always the first line in
-			// the message)
+			// separated list like yyyy-mm:1,1,1,2,12,3 where yyyy-mm is the period (period is always the first
+			// line in the message)
 			line := scanner.Text()
 			if lineCnt == 0 {
-				// first line is the year
+				// first line is the period
 				codes = strings.TrimSpace(line) + ":"
 			} else {
-				codes += separator + strings.TrimSpace(line[30:32])
-				separator = ","
+				records++
+				if len(line) < 32 {
+					// a truncated record has no housing code - reconciliation reports it as dropped
+					computeDroppedRecords.Inc()
+				} else {
+					codes += separator + strings.TrimSpace(line[30:32])
+					separator = ","
+				}
 			}
 			lineCnt++
 		}
+		computeRecords.Add(float64(records))
 		if delay > 0 {
 			time.Sleep(time.Duration(delay) * time.Millisecond)
 		}
 		if verbose {
 			fmt.Printf("Message: %v\n", codes)
 		}
-		if writeTo == writeToStdout {
-			fmt.Printf("codes: %v\n", codes)
-		} else if writeTo == writeToKafka {
-			if err := writeMessage(writer, codes, verbose); err != nil {
-				fmt.Printf("error writing codes to Kafka - error is: %v\n", err)
-				return false
-			}
-			resultMessagesWritten.Inc()
+		source := headerValue(m, headerSource)
+		if err := writeMessage(sink, codes, verbose, append(recordHeaders(kindResult, source, records), benchHeaders(m)...)...); err != nil {
+			fmt.Printf("error writing codes - error is: %v\n", err)
+			return false
 		}
+		resultMessagesWritten.Inc()
+	}
+}
+
+// writes the passed message value and headers unchanged to the passed sink
+func forward(sink MessageSink, m kafka.Message, verbose bool) bool {
+	if err := writeMessage(sink, string(m.Value), verbose, m.Headers...); err != nil {
+		fmt.Printf("error forwarding message - error is: %v\n", err)
+		return false
 	}
+	return true
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// the single-page dashboard served by the results role. It is plain HTML and JavaScript with no external
+// dependencies so it works in a cluster without internet access
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// The progress of one consumer group through one topic. The offsets are summed over all partitions
+type TopicProgress struct {
+	Topic      string
+	Group      string
+	Committed  int64
+	Last       int64
+	Lag        int64
+	Partitions []PartitionOffsets
+	Error      string `json:",omitempty"`
+}
+
+// What the /pipeline endpoint returns: the number of results messages applied by this results replica and
+// the progress of the compute and results consumer groups. The dashboard polls this to chart throughput
+// and lag
+type PipelineStatus struct {
+	Time    time.Time
+	Applied int64
+	Topics  []TopicProgress
+}
+
+// returns a handler that serves the embedded dashboard under /dashboard/
+func dashboardHandler() http.Handler {
+	sub, _ := fs.Sub(dashboardFiles, "dashboard")
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(sub)))
+}
+
+// gets the progress of the consumer group for the passed topic
+func getTopicProgress(getOffsets OffsetsFunc, topic string) TopicProgress {
+	progress := TopicProgress{Topic: topic, Group: consumerGrpForTopic[topic]}
+	offsets, err := getOffsets(topic, progress.Group)
+	if err != nil {
+		progress.Error = err.Error()
+		return progress
+	}
+	progress.Partitions = offsets
+	for _, o := range offsets {
+		if o.Committed > 0 {
+			progress.Committed += o.Committed
+		}
+		progress.Last += o.Last
+		progress.Lag += o.Lag
+	}
+	return progress
+}
+
+// returns a handler that provides a JSON response of the pipeline status
+func pipelineHandler(offsets OffsetsFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, PipelineStatus{
+			Time:    time.Now(),
+			Applied: aggregator.Applied(),
+			Topics: []TopicProgress{
+				getTopicProgress(offsets, compute_topic),
+				getTopicProgress(offsets, results_topic),
+			},
+		})
+	}
+}
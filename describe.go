@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// the topic configs shown by the describe command, and the configs a topic spec can declare
+var describeConfigNames = []string{"retention.ms", "retention.bytes", "cleanup.policy", "min.insync.replicas", "compression.type"}
+
+// One partition of a described topic. Replicas are the IDs of the brokers holding a replica that are up,
+// and Isr the IDs of the in-sync replicas. Offline is the number of replicas on brokers that are not in the
+// cluster metadata - i.e. they are down. The client library doesn't report the IDs of those brokers so
+// only the count is known. Earliest and Latest are the first and last offsets
+type PartitionDescription struct {
+	Partition int
+	Leader    string
+	Replicas  []int
+	Isr       []int
+	Offline   int
+	Earliest  int64
+	Latest    int64
+	Error     string `json:",omitempty"`
+}
+
+// What the describe command shows for one topic
+type TopicDescription struct {
+	Topic      string
+	Partitions []PartitionDescription
+	Configs    map[string]string
+	Error      string `json:",omitempty"`
+}
+
+// Describes the passed topics to the console: per-partition leader, replicas, ISR, offline replicas and
+// earliest/latest offsets, then the topic configs. Topics is a comma-separated list. If empty, the compute
+// and results topics are described
+func describeCmd(kafkaBrokers string, topics string, output string) {
+	var topicArray []string
+	if topics == "" {
+		topicArray = []string{compute_topic, results_topic}
+	} else {
+		topicArray = strings.Split(topics, ",")
+	}
+	descriptions, err := describeTopics(kafkaBrokers, topicArray)
+	if err != nil {
+		errorf(output, "%v\n", err)
+		return
+	}
+	outputTopicDescriptions(descriptions, output)
+}
+
+// prints the passed topic descriptions in the passed output format. CSV has one row per partition with the
+// topic configs repeated on each row
+func outputTopicDescriptions(descriptions []TopicDescription, output string) {
+	for _, d := range descriptions {
+		if d.Error != "" {
+			outputErrorf(output, "error describing topic: %v, error is: %v\n", d.Topic, d.Error)
+		}
+		for _, p := range d.Partitions {
+			if p.Error != "" {
+				outputErrorf(output, "error describing partition %v of topic: %v, error is: %v\n", p.Partition, d.Topic, p.Error)
+			}
+		}
+	}
+	header := append([]string{"topic", "partition", "leader", "replicas", "isr", "offline", "earliest", "latest", "error"}, describeConfigNames...)
+	if writeOutput(output, descriptions, header, func() [][]string {
+		var rows [][]string
+		for _, d := range descriptions {
+			if d.Error != "" {
+				rows = append(rows, append([]string{d.Topic, "", "", "", "", "", "", "", d.Error}, make([]string, len(describeConfigNames))...))
+				continue
+			}
+			for _, p := range d.Partitions {
+				row := []string{d.Topic, cell(p.Partition), p.Leader, joinIDs(p.Replicas), joinIDs(p.Isr), cell(p.Offline), cell(p.Earliest), cell(p.Latest), p.Error}
+				for _, name := range describeConfigNames {
+					row = append(row, d.Configs[name])
+				}
+				rows = append(rows, row)
+			}
+		}
+		return rows
+	}) {
+		return
+	}
+	for _, d := range descriptions {
+		printTopicDescription(d)
+	}
+}
+
+// gets the description of each of the passed topics
+func describeTopics(kafkaBrokers string, topics []string) ([]TopicDescription, error) {
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+
+	meta, err := client.Metadata(context.Background(), &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, fmt.Errorf("error getting metadata for topics: %v, error is: %v", topics, err)
+	}
+	byTopic := map[string]kafka.Topic{}
+	for _, t := range meta.Topics {
+		byTopic[t.Name] = t
+	}
+	var descriptions []TopicDescription
+	for _, topic := range topics {
+		d := TopicDescription{Topic: topic, Configs: map[string]string{}}
+		t, ok := byTopic[topic]
+		if !ok {
+			d.Error = "topic not found"
+		} else if t.Error != nil {
+			d.Error = t.Error.Error()
+		} else if err := describePartitions(client, t, &d); err != nil {
+			d.Error = err.Error()
+		} else if err := describeConfigs(client, &d); err != nil {
+			d.Error = err.Error()
+		}
+		descriptions = append(descriptions, d)
+	}
+	return descriptions, nil
+}
+
+// fills in the partitions of the passed description from the topic metadata and the partition offsets
+func describePartitions(client *kafka.Client, t kafka.Topic, d *TopicDescription) error {
+	var partitions []int
+	for _, p := range t.Partitions {
+		pd := PartitionDescription{Partition: p.ID, Leader: brokerName(p.Leader), Earliest: -1, Latest: -1}
+		for _, b := range p.Replicas {
+			if b.Host == "" {
+				pd.Offline++
+			} else {
+				pd.Replicas = append(pd.Replicas, b.ID)
+			}
+		}
+		for _, b := range p.Isr {
+			pd.Isr = append(pd.Isr, b.ID)
+		}
+		if p.Error != nil {
+			pd.Error = p.Error.Error()
+		}
+		d.Partitions = append(d.Partitions, pd)
+		partitions = append(partitions, p.ID)
+	}
+	sort.Slice(d.Partitions, func(i, j int) bool { return d.Partitions[i].Partition < d.Partitions[j].Partition })
+
+	first, err := listOffsets(client, t.Name, partitions, kafka.FirstOffsetOf)
+	if err != nil {
+		return err
+	}
+	last, err := listOffsets(client, t.Name, partitions, kafka.LastOffsetOf)
+	if err != nil {
+		return err
+	}
+	for i := range d.Partitions {
+		pd := &d.Partitions[i]
+		if o, ok := first[pd.Partition]; ok {
+			pd.Earliest = o.FirstOffset
+		}
+		if o, ok := last[pd.Partition]; ok {
+			pd.Latest = o.LastOffset
+			if o.Error != nil && pd.Error == "" {
+				pd.Error = o.Error.Error()
+			}
+		}
+	}
+	return nil
+}
+
+// fills in the configs of the passed description
+func describeConfigs(client *kafka.Client, d *TopicDescription) error {
+	res, err := client.DescribeConfigs(context.Background(), &kafka.DescribeConfigsRequest{
+		Resources: []kafka.DescribeConfigRequestResource{{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: d.Topic,
+			ConfigNames:  describeConfigNames,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error describing configs for topic: %v, error is: %v", d.Topic, err)
+	}
+	for _, r := range res.Resources {
+		if r.Error != nil {
+			return fmt.Errorf("error describing configs for topic: %v, error is: %v", d.Topic, r.Error)
+		}
+		for _, e := range r.ConfigEntries {
+			d.Configs[e.ConfigName] = e.ConfigValue
+		}
+	}
+	return nil
+}
+
+// returns id/host:port of the passed broker, or 'none' for the zero broker - e.g. a partition without a leader
+func brokerName(b kafka.Broker) string {
+	if b.Host == "" {
+		return "none"
+	}
+	return fmt.Sprintf("%v/%v:%v", b.ID, b.Host, b.Port)
+}
+
+// joins broker IDs with commas
+func joinIDs(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+// prints one topic description to the console
+func printTopicDescription(d TopicDescription) {
+	fmt.Printf("Topic: %v\n", d.Topic)
+	if d.Error != "" {
+		fmt.Printf("  error: %v\n\n", d.Error)
+		return
+	}
+	format := "  %-12v%-40v%-15v%-15v%-10v%-15v%-15v%v\n"
+	fmt.Printf(format, "Partition", "Leader", "Replicas", "ISR", "Offline", "Earliest", "Latest", "Error")
+	for _, p := range d.Partitions {
+		fmt.Printf(format, p.Partition, p.Leader, joinIDs(p.Replicas), joinIDs(p.Isr), p.Offline, p.Earliest, p.Latest, p.Error)
+	}
+	fmt.Printf("  Configs:\n")
+	for _, name := range describeConfigNames {
+		value, ok := d.Configs[name]
+		if !ok {
+			value = "(not reported)"
+		}
+		fmt.Printf("    %-25v%v\n", name, value)
+	}
+	fmt.Printf("\n")
+}
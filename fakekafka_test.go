@@ -0,0 +1,1459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/alterconfigs"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/createpartitions"
+	"github.com/segmentio/kafka-go/protocol/createtopics"
+	"github.com/segmentio/kafka-go/protocol/deletetopics"
+	"github.com/segmentio/kafka-go/protocol/describeconfigs"
+	"github.com/segmentio/kafka-go/protocol/describegroups"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/findcoordinator"
+	"github.com/segmentio/kafka-go/protocol/listgroups"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/offsetfetch"
+	produceapi "github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// Starts a fake broker in the test process and connects every Kafka dialer and transport to it over a net.Pipe,
+// so the commands under test need no socket. Returns the broker and the --kafka value to pass to the commands.
+// The broker advertises a host that doesn't resolve, so a connection that bypassed the pipes would fail
+func startTestBroker(t *testing.T) (*fakeBroker, string) {
+	b := newFakeBroker("fake-kafka.invalid", 9092, false)
+	kafkaDialFunc = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go b.serveConn(server)
+		return client, nil
+	}
+	t.Cleanup(func() {
+		kafkaDialFunc = nil
+		b.Close()
+	})
+	return b, b.Addr()
+}
+
+// Runs the passed func - a command - with stdout captured. Returns what it printed and the exit code it set
+func runCmd(t *testing.T, cmd func()) (string, int) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	printed := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		printed <- string(out)
+	}()
+	exitCode = 0
+	defer func() {
+		exitCode = 0
+	}()
+	cmd()
+	os.Stdout = stdout
+	w.Close()
+	out := <-printed
+	if testing.Verbose() {
+		t.Logf("output:\n%v", out)
+	}
+	return out, exitCode
+}
+
+// creates the passed topic with the passed number of partitions on the broker at kafkaBrokers
+func createTestTopic(t *testing.T, kafkaBrokers string, topic string, partitions int) {
+	t.Helper()
+	if _, err := createTopicIfNotExists(kafkaBrokers, TopicSpec{Topic: topic, Partitions: partitions, ReplicationFactor: 1}); err != nil {
+		t.Fatalf("error creating topic %v: %v", topic, err)
+	}
+}
+
+// calls the passed func every 100ms until it returns true, failing the test if that takes longer than the passed
+// timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting for %v", timeout, what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestFakeBrokerTopics(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, "t1", 3)
+	created, err := createTopicIfNotExists(brokers, TopicSpec{Topic: "t1", Partitions: 3, ReplicationFactor: 1})
+	if err != nil || created {
+		t.Fatalf("got created: %v error: %v creating an existing topic, want false and no error", created, err)
+	}
+	partitions, err := getPartitionsForTopic(brokers, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 3 {
+		t.Errorf("got partitions: %v, want 3", partitions)
+	}
+	out, code := runCmd(t, func() { topicListCmd(brokers, outputCSV) })
+	if code != 0 || !strings.Contains(out, "t1,2,") {
+		t.Errorf("topiclist exited %v with: %v", code, out)
+	}
+}
+
+func TestFakeBrokerUnknownTopic(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	out, code := runCmd(t, func() { describeCmd(brokers, "nope", outputJSON) })
+	if code == 0 {
+		t.Errorf("describing a topic that doesn't exist exited zero")
+	}
+	if !strings.Contains(out, `"Topic": "nope"`) || !strings.Contains(out, "Unknown Topic") {
+		t.Errorf("got: %v", out)
+	}
+}
+
+// A single-broker, in-memory stand-in for a Kafka cluster that speaks enough of the Kafka protocol for the
+// kafka-go readers, writers, clients and consumer groups the app uses: metadata, produce, fetch, list offsets,
+// consumer groups with offset commits, and creating, deleting, describing and altering topics. It exists so the
+// tests can run the commands end to end with no Kafka. Nothing is persisted, there is one replica of each
+// partition, and there are no transactions, compaction or retention.
+//
+// The kafka-go protocol package encodes most of the requests and responses. It doesn't register the consumer
+// group APIs, and it can't encode a fetch response that doesn't start at offset zero, so those are encoded here,
+// in the versions kafka-go sends
+type fakeBroker struct {
+	mu      sync.Mutex
+	host    string
+	port    int32
+	verbose bool
+	topics  map[string]*fakeTopic
+	groups  map[string]*fakeGroup
+	// the count of member IDs given out, to make them unique
+	memberIDs int
+	// closed and replaced whenever a partition is written to or a group changes, to wake up waiting requests
+	changed chan struct{}
+	done    chan struct{}
+}
+
+// a topic of the fake broker. Configs are the configs set on the topic - not the defaults
+type fakeTopic struct {
+	partitions [][]fakeRecord
+	configs    map[string]string
+}
+
+type fakeRecord struct {
+	time    time.Time
+	key     []byte
+	value   []byte
+	headers []protocol.Header
+}
+
+// A consumer group of the fake broker. Offsets are the committed offsets by topic and partition. A rebalance
+// starts when a member joins or leaves and completes once every member has rejoined - or the rebalance timeout
+// passes, which removes the members that didn't
+type fakeGroup struct {
+	state        string
+	generation   int32
+	protocolType string
+	protocol     string
+	leader       string
+	members      map[string]*fakeMember
+	offsets      map[string]map[int32]int64
+	deadline     time.Time
+}
+
+type fakeMember struct {
+	id               string
+	clientID         string
+	host             string
+	protocols        []fakeGroupProtocol
+	sessionTimeout   time.Duration
+	rebalanceTimeout time.Duration
+	lastSeen         time.Time
+	// true once the member has rejoined the rebalance in progress
+	joined     bool
+	assignment []byte
+	// set when a rebalance completes, and taken by the member's join request
+	joinResponse *fakeJoinResponse
+}
+
+type fakeGroupProtocol struct {
+	name     string
+	metadata []byte
+}
+
+type fakeJoinResponse struct {
+	errorCode  int16
+	generation int32
+	protocol   string
+	leader     string
+	memberID   string
+	// the members and their metadata - only sent to the leader, which assigns the partitions
+	members []fakeGroupProtocol
+}
+
+// the states of a consumer group, as reported by Kafka
+const (
+	groupEmpty               = "Empty"
+	groupPreparingRebalance  = "PreparingRebalance"
+	groupCompletingRebalance = "CompletingRebalance"
+	groupStable              = "Stable"
+	groupDead                = "Dead"
+)
+
+// the ID of the one broker, which leads every partition and is the controller and every group coordinator
+const fakeBrokerID = 0
+
+// how often members that stopped heartbeating and rebalances that timed out are checked for
+const fakeExpiryInterval = 500 * time.Millisecond
+
+// the longest a fetch waits for records, whatever the max wait of the request. A closing kafka-go reader
+// waits for its fetch to return, so this keeps it from being held up for the reader's 10 second default
+const fakeMaxFetchWait = 500 * time.Millisecond
+
+// the largest request accepted. Kafka's default socket.request.max.bytes
+const fakeMaxRequestBytes = 100 * 1024 * 1024
+
+// the defaults of the topic configs the app describes, reported for a topic that doesn't set them
+var fakeTopicDefaults = map[string]string{
+	"retention.ms":        "604800000",
+	"retention.bytes":     "-1",
+	"cleanup.policy":      "delete",
+	"min.insync.replicas": "1",
+	"compression.type":    "producer",
+}
+
+// The API versions the fake broker supports, returned by ApiVersions. The kafka-go clients use the highest
+// version they share with the broker, so each maximum is kept below the first flexible version of the API,
+// which the protocol package can't write response headers for. The group APIs and fetch are encoded here in
+// the one version kafka-go sends
+var fakeAPIVersions = []apiversions.ApiKeyResponse{
+	{ApiKey: int16(protocol.Produce), MinVersion: 0, MaxVersion: 8},
+	{ApiKey: int16(protocol.Fetch), MinVersion: 5, MaxVersion: 5},
+	{ApiKey: int16(protocol.ListOffsets), MinVersion: 1, MaxVersion: 5},
+	{ApiKey: int16(protocol.Metadata), MinVersion: 1, MaxVersion: 8},
+	{ApiKey: int16(protocol.OffsetCommit), MinVersion: 2, MaxVersion: 2},
+	{ApiKey: int16(protocol.OffsetFetch), MinVersion: 1, MaxVersion: 5},
+	{ApiKey: int16(protocol.FindCoordinator), MinVersion: 0, MaxVersion: 2},
+	{ApiKey: int16(protocol.JoinGroup), MinVersion: 1, MaxVersion: 1},
+	{ApiKey: int16(protocol.Heartbeat), MinVersion: 0, MaxVersion: 0},
+	{ApiKey: int16(protocol.LeaveGroup), MinVersion: 0, MaxVersion: 0},
+	{ApiKey: int16(protocol.SyncGroup), MinVersion: 0, MaxVersion: 0},
+	{ApiKey: int16(protocol.DescribeGroups), MinVersion: 0, MaxVersion: 4},
+	{ApiKey: int16(protocol.ListGroups), MinVersion: 0, MaxVersion: 2},
+	{ApiKey: int16(protocol.ApiVersions), MinVersion: 0, MaxVersion: 2},
+	{ApiKey: int16(protocol.CreateTopics), MinVersion: 0, MaxVersion: 4},
+	{ApiKey: int16(protocol.DeleteTopics), MinVersion: 0, MaxVersion: 3},
+	{ApiKey: int16(protocol.DescribeConfigs), MinVersion: 0, MaxVersion: 3},
+	{ApiKey: int16(protocol.AlterConfigs), MinVersion: 0, MaxVersion: 1},
+	{ApiKey: int16(protocol.CreatePartitions), MinVersion: 0, MaxVersion: 1},
+}
+
+var errFakeBrokerClosed = errors.New("fake broker closed")
+
+// Creates a fake Kafka broker that advertises the passed host and port in its metadata, but doesn't listen.
+// Each connection to it must be passed to serveConn - e.g. one end of a net.Pipe, so a test can run the broker
+// in its own process with no socket
+func newFakeBroker(host string, port int32, verbose bool) *fakeBroker {
+	b := &fakeBroker{
+		host:    host,
+		port:    port,
+		verbose: verbose,
+		topics:  map[string]*fakeTopic{},
+		groups:  map[string]*fakeGroup{},
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.expire()
+	return b
+}
+
+// Addr returns the host:port the broker advertises
+func (b *fakeBroker) Addr() string {
+	return net.JoinHostPort(b.host, strconv.Itoa(int(b.port)))
+}
+
+// Close fails the requests that are waiting
+func (b *fakeBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.done:
+		return nil
+	default:
+		close(b.done)
+	}
+	return nil
+}
+
+// Reads requests from the passed connection and writes the responses, one request at a time in the order they
+// arrive - as Kafka does. Returns when the connection is closed or a request can't be handled
+func (b *fakeBroker) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		// e.g. a net.Pipe, whose address is just "pipe"
+		host = conn.RemoteAddr().String()
+	}
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && b.verbose {
+				fmt.Printf("fake broker: error reading request from %v, error is: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		res, err := b.handle(frame, host)
+		if err != nil {
+			if b.verbose {
+				fmt.Printf("fake broker: error handling request from %v, error is: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if res == nil {
+			// a produce request that doesn't want acks has no response
+			continue
+		}
+		if _, err := w.Write(res); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// reads one size-prefixed request, and returns it with the size
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int32(binary.BigEndian.Uint32(size[:]))
+	if n < 8 || n > fakeMaxRequestBytes {
+		return nil, fmt.Errorf("invalid request size: %v", n)
+	}
+	frame := make([]byte, 4+int(n))
+	copy(frame, size[:])
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Handles one request and returns the response to write, which is nil if there is none. An error means the
+// connection should be closed
+func (b *fakeBroker) handle(frame []byte, host string) ([]byte, error) {
+	apiKey := protocol.ApiKey(int16(binary.BigEndian.Uint16(frame[4:6])))
+	version := int16(binary.BigEndian.Uint16(frame[6:8]))
+	if b.verbose {
+		fmt.Printf("fake broker: %v v%v request from %v\n", apiKey, version, host)
+	}
+	switch apiKey {
+	case protocol.JoinGroup, protocol.SyncGroup, protocol.Heartbeat, protocol.LeaveGroup, protocol.OffsetCommit:
+		return b.handleGroupRequest(apiKey, version, frame[8:], host)
+	}
+	version, correlationID, clientID, req, err := protocol.ReadRequest(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	var res protocol.Message
+	switch req := req.(type) {
+	case *apiversions.Request:
+		res = &apiversions.Response{ApiKeys: fakeAPIVersions}
+	case *metadata.Request:
+		res = b.metadata(req)
+	case *produceapi.Request:
+		res = b.produce(req)
+		if !req.HasResponse() {
+			return nil, nil
+		}
+	case *fetch.Request:
+		if version != 5 {
+			return nil, fmt.Errorf("unsupported %v version: v%v", apiKey, version)
+		}
+		body, err := b.fetch(req)
+		if err != nil {
+			return nil, err
+		}
+		return responseFrame(correlationID, body), nil
+	case *listoffsets.Request:
+		res = b.listOffsets(req)
+	case *findcoordinator.Request:
+		res = &findcoordinator.Response{NodeID: fakeBrokerID, Host: b.host, Port: b.port}
+	case *offsetfetch.Request:
+		res = b.offsetFetch(req)
+	case *describegroups.Request:
+		res = b.describeGroups(req)
+	case *listgroups.Request:
+		res = b.listGroups()
+	case *createtopics.Request:
+		res = b.createTopics(req)
+	case *deletetopics.Request:
+		res = b.deleteTopics(req)
+	case *createpartitions.Request:
+		res = b.createPartitions(req)
+	case *describeconfigs.Request:
+		res = b.describeConfigs(req)
+	case *alterconfigs.Request:
+		res = b.alterConfigs(req)
+	default:
+		return nil, fmt.Errorf("unsupported api: %v from client %v", apiKey, clientID)
+	}
+	var buf bytes.Buffer
+	if err := protocol.WriteResponse(&buf, version, correlationID, res); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handles the consumer group requests, which are decoded and encoded here in the versions kafka-go sends
+func (b *fakeBroker) handleGroupRequest(apiKey protocol.ApiKey, version int16, header []byte, host string) ([]byte, error) {
+	for _, v := range fakeAPIVersions {
+		if v.ApiKey == int16(apiKey) && (version < v.MinVersion || version > v.MaxVersion) {
+			return nil, fmt.Errorf("unsupported %v version: v%v", apiKey, version)
+		}
+	}
+	d := &fakeDecoder{b: header}
+	correlationID := d.int32()
+	clientID := d.string()
+	var body []byte
+	var err error
+	switch apiKey {
+	case protocol.JoinGroup:
+		body, err = b.joinGroup(d, clientID, host)
+	case protocol.SyncGroup:
+		body, err = b.syncGroup(d)
+	case protocol.Heartbeat:
+		body = b.heartbeat(d)
+	case protocol.LeaveGroup:
+		body = b.leaveGroup(d)
+	case protocol.OffsetCommit:
+		body = b.offsetCommit(d)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("error decoding %v request, error is: %v", apiKey, d.err)
+	} else if err != nil {
+		return nil, err
+	}
+	return responseFrame(correlationID, body), nil
+}
+
+// prefixes a response body with its size and correlation ID
+func responseFrame(correlationID int32, body []byte) []byte {
+	e := &fakeEncoder{}
+	e.int32(int32(4 + len(body)))
+	e.int32(correlationID)
+	e.Write(body)
+	return e.Bytes()
+}
+
+// wakes up the requests waiting for something to change. Must be called with the lock held
+func (b *fakeBroker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Waits until something changes or the passed deadline passes - a zero deadline means no deadline. Must be
+// called with the lock held, which is released while waiting. Returns errFakeBrokerClosed if the broker closes
+func (b *fakeBroker) wait(deadline time.Time) error {
+	changed := b.changed
+	b.mu.Unlock()
+	defer b.mu.Lock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-changed:
+	case <-timeout:
+	case <-b.done:
+		return errFakeBrokerClosed
+	}
+	return nil
+}
+
+// returns the named partition, or nil if there is no such topic or partition. Must be called with the lock held
+func (b *fakeBroker) partition(topic string, partition int32) *[]fakeRecord {
+	t, ok := b.topics[topic]
+	if !ok || partition < 0 || int(partition) >= len(t.partitions) {
+		return nil
+	}
+	return &t.partitions[partition]
+}
+
+// returns the names of the topics, sorted. Must be called with the lock held
+func (b *fakeBroker) topicNames() []string {
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describes the broker and the requested topics - or all topics if none are named
+func (b *fakeBroker) metadata(req *metadata.Request) *metadata.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &metadata.Response{
+		Brokers:      []metadata.ResponseBroker{{NodeID: fakeBrokerID, Host: b.host, Port: b.port}},
+		ClusterID:    "fake-kafka",
+		ControllerID: fakeBrokerID,
+	}
+	names := req.TopicNames
+	if names == nil {
+		names = b.topicNames()
+	}
+	for _, name := range names {
+		rt := metadata.ResponseTopic{Name: name}
+		if t, ok := b.topics[name]; !ok {
+			rt.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+		} else {
+			for p := range t.partitions {
+				rt.Partitions = append(rt.Partitions, metadata.ResponsePartition{
+					PartitionIndex: int32(p),
+					LeaderID:       fakeBrokerID,
+					ReplicaNodes:   []int32{fakeBrokerID},
+					IsrNodes:       []int32{fakeBrokerID},
+				})
+			}
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	return res
+}
+
+// appends the records in the request to their partitions
+func (b *fakeBroker) produce(req *produceapi.Request) *produceapi.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &produceapi.Response{}
+	now := time.Now()
+	for _, t := range req.Topics {
+		rt := produceapi.ResponseTopic{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			rp := produceapi.ResponsePartition{Partition: p.Partition, LogAppendTime: -1}
+			log := b.partition(t.Topic, p.Partition)
+			if log == nil {
+				rp.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+			} else if records, err := readRecords(p.RecordSet.Records, now); err != nil {
+				rp.ErrorCode = int16(kafka.InvalidMessage)
+			} else {
+				rp.BaseOffset = int64(len(*log))
+				*log = append(*log, records...)
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	b.notify()
+	return res
+}
+
+// copies the records out of a produce request. Records without a time get the passed time
+func readRecords(rr protocol.RecordReader, now time.Time) ([]fakeRecord, error) {
+	var records []fakeRecord
+	if rr == nil {
+		return nil, nil
+	}
+	for {
+		r, err := rr.ReadRecord()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		record := fakeRecord{time: r.Time}
+		if record.time.IsZero() {
+			record.time = now
+		}
+		if record.key, err = readBytes(r.Key); err != nil {
+			return nil, err
+		}
+		if record.value, err = readBytes(r.Value); err != nil {
+			return nil, err
+		}
+		// the headers may be reused by the next record, so are copied
+		for _, h := range r.Headers {
+			record.headers = append(record.headers, protocol.Header{Key: h.Key, Value: append([]byte(nil), h.Value...)})
+		}
+		records = append(records, record)
+	}
+}
+
+// reads the key or value of a record, which is nil if the record has none
+func readBytes(b protocol.Bytes) ([]byte, error) {
+	if b == nil {
+		return nil, nil
+	}
+	defer b.Close()
+	return io.ReadAll(b)
+}
+
+// Returns the records from the requested offset of each requested partition. If there are none, waits up to
+// the max wait time of the request - capped at fakeMaxFetchWait - for some to be produced. Encodes the response
+// body as version 5
+func (b *fakeBroker) fetch(req *fetch.Request) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wait := time.Duration(req.MaxWaitTime) * time.Millisecond
+	if wait > fakeMaxFetchWait {
+		wait = fakeMaxFetchWait
+	}
+	deadline := time.Now().Add(wait)
+	for !b.fetchable(req) && time.Now().Before(deadline) {
+		if err := b.wait(deadline); err != nil {
+			return nil, err
+		}
+	}
+	maxBytes := int(req.MaxBytes)
+	e := &fakeEncoder{}
+	e.int32(0) // throttle time
+	e.int32(int32(len(req.Topics)))
+	for _, t := range req.Topics {
+		e.string(t.Topic)
+		e.int32(int32(len(t.Partitions)))
+		for _, p := range t.Partitions {
+			log := b.partition(t.Topic, p.Partition)
+			errorCode, highWatermark := int16(0), int64(-1)
+			var records []protocol.Record
+			if log == nil {
+				errorCode = int16(kafka.UnknownTopicOrPartition)
+			} else if highWatermark = int64(len(*log)); p.FetchOffset < 0 || p.FetchOffset > highWatermark {
+				errorCode = int16(kafka.OffsetOutOfRange)
+			} else {
+				// at least one record is returned, so a record bigger than the max bytes can still be read
+				size := 0
+				for offset := p.FetchOffset; offset < highWatermark; offset++ {
+					r := (*log)[offset]
+					size += len(r.key) + len(r.value) + 32
+					if len(records) > 0 && (size > int(p.PartitionMaxBytes) || size > maxBytes) {
+						break
+					}
+					records = append(records, protocol.Record{
+						Offset:  offset,
+						Time:    r.time,
+						Key:     protocol.NewBytes(r.key),
+						Value:   protocol.NewBytes(r.value),
+						Headers: r.headers,
+					})
+				}
+				maxBytes -= size
+			}
+			e.int32(p.Partition)
+			e.int16(errorCode)
+			e.int64(highWatermark)
+			e.int64(highWatermark) // last stable offset
+			e.int64(0)             // log start offset
+			e.int32(-1)            // no aborted transactions
+			if err := e.recordBatch(records); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e.Bytes(), nil
+}
+
+// returns true if any requested partition has records to return, or an error. Must be called with the lock held
+func (b *fakeBroker) fetchable(req *fetch.Request) bool {
+	for _, t := range req.Topics {
+		for _, p := range t.Partitions {
+			if log := b.partition(t.Topic, p.Partition); log == nil || p.FetchOffset != int64(len(*log)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the first or last offset of each requested partition, or the offset of the first record at or after
+// the requested time
+func (b *fakeBroker) listOffsets(req *listoffsets.Request) *listoffsets.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &listoffsets.Response{}
+	for _, t := range req.Topics {
+		rt := listoffsets.ResponseTopic{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			rp := listoffsets.ResponsePartition{Partition: p.Partition, Timestamp: -1, LeaderEpoch: -1}
+			log := b.partition(t.Topic, p.Partition)
+			switch {
+			case log == nil:
+				rp.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+			case p.Timestamp == kafka.LastOffset:
+				rp.Offset = int64(len(*log))
+			case p.Timestamp == kafka.FirstOffset:
+				rp.Offset = 0
+			default:
+				rp.Offset = int64(len(*log))
+				for offset, r := range *log {
+					if ms := r.time.UnixNano() / int64(time.Millisecond); ms >= p.Timestamp {
+						rp.Offset, rp.Timestamp = int64(offset), ms
+						break
+					}
+				}
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	return res
+}
+
+// returns the committed offsets of a group for the requested partitions - or all of them if none are named.
+// Partitions without a committed offset get -1
+func (b *fakeBroker) offsetFetch(req *offsetfetch.Request) *offsetfetch.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &offsetfetch.Response{}
+	var offsets map[string]map[int32]int64
+	if g, ok := b.groups[req.GroupID]; ok {
+		offsets = g.offsets
+	}
+	topics := req.Topics
+	if topics == nil {
+		for name, partitions := range offsets {
+			t := offsetfetch.RequestTopic{Name: name}
+			for p := range partitions {
+				t.PartitionIndexes = append(t.PartitionIndexes, p)
+			}
+			sort.Slice(t.PartitionIndexes, func(i, j int) bool { return t.PartitionIndexes[i] < t.PartitionIndexes[j] })
+			topics = append(topics, t)
+		}
+		sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+	}
+	for _, t := range topics {
+		rt := offsetfetch.ResponseTopic{Name: t.Name}
+		for _, p := range t.PartitionIndexes {
+			rp := offsetfetch.ResponsePartition{PartitionIndex: p, CommittedOffset: -1, ComittedLeaderEpoch: -1}
+			if offset, ok := offsets[t.Name][p]; ok {
+				rp.CommittedOffset = offset
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	return res
+}
+
+// describes the requested groups. A group that doesn't exist is reported as dead, as Kafka does
+func (b *fakeBroker) describeGroups(req *describegroups.Request) *describegroups.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &describegroups.Response{}
+	for _, id := range req.Groups {
+		rg := describegroups.ResponseGroup{GroupID: id, GroupState: groupDead}
+		if g, ok := b.groups[id]; ok {
+			rg.GroupState, rg.ProtocolType, rg.ProtocolData = g.state, g.protocolType, g.protocol
+			for _, m := range g.sortedMembers() {
+				rg.Members = append(rg.Members, describegroups.ResponseGroupMember{
+					MemberID:         m.id,
+					ClientID:         m.clientID,
+					ClientHost:       "/" + m.host,
+					MemberMetadata:   m.metadata(g.protocol),
+					MemberAssignment: m.assignment,
+				})
+			}
+		}
+		res.Groups = append(res.Groups, rg)
+	}
+	return res
+}
+
+// lists the groups - including the groups that only have committed offsets
+func (b *fakeBroker) listGroups() *listgroups.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &listgroups.Response{}
+	for id, g := range b.groups {
+		res.Groups = append(res.Groups, listgroups.ResponseGroup{GroupID: id, ProtocolType: g.protocolType})
+	}
+	sort.Slice(res.Groups, func(i, j int) bool { return res.Groups[i].GroupID < res.Groups[j].GroupID })
+	return res
+}
+
+// Creates the requested topics. There is one broker, so the replication factor can only be one
+func (b *fakeBroker) createTopics(req *createtopics.Request) *createtopics.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &createtopics.Response{}
+	for _, t := range req.Topics {
+		rt := createtopics.ResponseTopic{Name: t.Name}
+		partitions := int(t.NumPartitions)
+		if partitions == -1 {
+			partitions = 1
+		}
+		switch _, exists := b.topics[t.Name]; {
+		case t.Name == "":
+			rt.ErrorCode, rt.ErrorMessage = int16(kafka.InvalidTopic), "topic name is empty"
+		case exists:
+			rt.ErrorCode, rt.ErrorMessage = int16(kafka.TopicAlreadyExists), fmt.Sprintf("topic '%v' already exists", t.Name)
+		case partitions < 1:
+			rt.ErrorCode, rt.ErrorMessage = int16(kafka.InvalidPartitionNumber), "number of partitions must be larger than 0"
+		case t.ReplicationFactor != -1 && t.ReplicationFactor != 1:
+			rt.ErrorCode = int16(kafka.InvalidReplicationFactor)
+			rt.ErrorMessage = fmt.Sprintf("replication factor: %v larger than available brokers: 1", t.ReplicationFactor)
+		case !req.ValidateOnly:
+			topic := &fakeTopic{partitions: make([][]fakeRecord, partitions), configs: map[string]string{}}
+			for _, c := range t.Configs {
+				topic.configs[c.Name] = c.Value
+			}
+			b.topics[t.Name] = topic
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	b.notify()
+	return res
+}
+
+// deletes the requested topics, and the offsets committed for them
+func (b *fakeBroker) deleteTopics(req *deletetopics.Request) *deletetopics.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &deletetopics.Response{}
+	for _, name := range req.TopicNames {
+		rt := deletetopics.ResponseTopic{Name: name}
+		if _, ok := b.topics[name]; !ok {
+			rt.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+		} else {
+			delete(b.topics, name)
+			for _, g := range b.groups {
+				delete(g.offsets, name)
+			}
+		}
+		res.Responses = append(res.Responses, rt)
+	}
+	b.notify()
+	return res
+}
+
+// increases the partition counts of the requested topics
+func (b *fakeBroker) createPartitions(req *createpartitions.Request) *createpartitions.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &createpartitions.Response{}
+	for _, t := range req.Topics {
+		rr := createpartitions.ResponseResult{Name: t.Name}
+		if topic, ok := b.topics[t.Name]; !ok {
+			rr.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+		} else if int(t.Count) <= len(topic.partitions) {
+			rr.ErrorCode = int16(kafka.InvalidPartitionNumber)
+			rr.ErrorMessage = fmt.Sprintf("topic currently has %v partitions, which is higher than the requested %v", len(topic.partitions), t.Count)
+		} else if !req.ValidateOnly {
+			topic.partitions = append(topic.partitions, make([][]fakeRecord, int(t.Count)-len(topic.partitions))...)
+		}
+		res.Results = append(res.Results, rr)
+	}
+	b.notify()
+	return res
+}
+
+// Describes the configs of the requested topics - the requested configs, or all configs if none are named.
+// Configs the topic doesn't set are reported with their defaults. Other resources have no configs
+func (b *fakeBroker) describeConfigs(req *describeconfigs.Request) *describeconfigs.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &describeconfigs.Response{}
+	for _, r := range req.Resources {
+		rr := describeconfigs.ResponseResource{ResourceType: r.ResourceType, ResourceName: r.ResourceName}
+		if kafka.ResourceType(r.ResourceType) == kafka.ResourceTypeTopic {
+			t, ok := b.topics[r.ResourceName]
+			if !ok {
+				rr.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+				rr.ErrorMessage = fmt.Sprintf("topic %v does not exist", r.ResourceName)
+			}
+			names := r.ConfigNames
+			if ok && names == nil {
+				all := map[string]string{}
+				for name, value := range fakeTopicDefaults {
+					all[name] = value
+				}
+				for name, value := range t.configs {
+					all[name] = value
+				}
+				names = sortedKeys(all)
+			}
+			for _, name := range names {
+				if !ok {
+					break
+				}
+				entry := describeconfigs.ResponseConfigEntry{ConfigName: name}
+				if value, set := t.configs[name]; set {
+					entry.ConfigValue, entry.ConfigSource = value, configSourceDynamicTopic
+				} else if value, known := fakeTopicDefaults[name]; known {
+					entry.ConfigValue, entry.IsDefault, entry.ConfigSource = value, true, configSourceDefault
+				} else {
+					continue
+				}
+				rr.ConfigEntries = append(rr.ConfigEntries, entry)
+			}
+		}
+		res.Resources = append(res.Resources, rr)
+	}
+	return res
+}
+
+// the config source Kafka reports for a config that has its default value
+const configSourceDefault = 5
+
+// replaces the configs set on the requested topics with the configs in the request, as Kafka does
+func (b *fakeBroker) alterConfigs(req *alterconfigs.Request) *alterconfigs.Response {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &alterconfigs.Response{}
+	for _, r := range req.Resources {
+		rr := alterconfigs.ResponseResponses{ResourceType: r.ResourceType, ResourceName: r.ResourceName}
+		t, ok := b.topics[r.ResourceName]
+		if kafka.ResourceType(r.ResourceType) != kafka.ResourceTypeTopic {
+			rr.ErrorCode, rr.ErrorMessage = int16(kafka.InvalidRequest), "only topic configs can be altered"
+		} else if !ok {
+			rr.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+		} else if !req.ValidateOnly {
+			t.configs = map[string]string{}
+			for _, c := range r.Configs {
+				t.configs[c.Name] = c.Value
+			}
+		}
+		res.Responses = append(res.Responses, rr)
+	}
+	return res
+}
+
+// returns the named group, creating it empty if it doesn't exist. Must be called with the lock held
+func (b *fakeBroker) group(id string) *fakeGroup {
+	g, ok := b.groups[id]
+	if !ok {
+		g = &fakeGroup{state: groupEmpty, members: map[string]*fakeMember{}, offsets: map[string]map[int32]int64{}}
+		b.groups[id] = g
+	}
+	return g
+}
+
+// returns the named member of the named group, or nil. Must be called with the lock held
+func (b *fakeBroker) member(groupID string, memberID string) (*fakeGroup, *fakeMember) {
+	g, ok := b.groups[groupID]
+	if !ok {
+		return nil, nil
+	}
+	return g, g.members[memberID]
+}
+
+// Adds a member to a group, or rejoins one, which starts a rebalance. Blocks until the rebalance completes,
+// then returns the generation - and if the member is the leader, the members to assign partitions to. Encodes
+// JoinGroup v1
+func (b *fakeBroker) joinGroup(d *fakeDecoder, clientID string, host string) ([]byte, error) {
+	groupID := d.string()
+	sessionTimeout := time.Duration(d.int32()) * time.Millisecond
+	rebalanceTimeout := time.Duration(d.int32()) * time.Millisecond
+	memberID := d.string()
+	protocolType := d.string()
+	protocols := make([]fakeGroupProtocol, d.arrayLen())
+	for i := range protocols {
+		protocols[i] = fakeGroupProtocol{name: d.string(), metadata: d.bytes()}
+	}
+	if d.err != nil {
+		return nil, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.group(groupID)
+	m, ok := g.members[memberID]
+	if memberID == "" {
+		b.memberIDs++
+		m = &fakeMember{id: fmt.Sprintf("%v-%v", clientID, b.memberIDs)}
+		g.members[m.id] = m
+	} else if !ok {
+		return encodeJoinResponse(&fakeJoinResponse{errorCode: int16(kafka.UnknownMemberId), generation: -1}), nil
+	}
+	if len(g.members) > 1 && protocolType != g.protocolType {
+		if memberID == "" {
+			delete(g.members, m.id)
+		}
+		return encodeJoinResponse(&fakeJoinResponse{errorCode: int16(kafka.InconsistentGroupProtocol), generation: -1}), nil
+	}
+	now := time.Now()
+	m.clientID, m.host, m.protocols = clientID, host, protocols
+	m.sessionTimeout, m.rebalanceTimeout, m.lastSeen = sessionTimeout, rebalanceTimeout, now
+	g.protocolType = protocolType
+	g.prepareRebalance(now)
+	m.joined, m.joinResponse = true, nil
+	g.completeRebalanceIfJoined()
+	b.notify()
+	for m.joinResponse == nil {
+		if g.members[m.id] != m {
+			return encodeJoinResponse(&fakeJoinResponse{errorCode: int16(kafka.UnknownMemberId), generation: -1}), nil
+		}
+		if err := b.wait(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	res := m.joinResponse
+	m.joinResponse = nil
+	return encodeJoinResponse(res), nil
+}
+
+func encodeJoinResponse(res *fakeJoinResponse) []byte {
+	e := &fakeEncoder{}
+	e.int16(res.errorCode)
+	e.int32(res.generation)
+	e.string(res.protocol)
+	e.string(res.leader)
+	e.string(res.memberID)
+	e.int32(int32(len(res.members)))
+	for _, m := range res.members {
+		e.string(m.name)
+		e.bytes(m.metadata)
+	}
+	return e.Bytes()
+}
+
+// Sets the partition assignments, if sent by the leader, and returns the assignment of the member once the
+// leader has sent them. Encodes SyncGroup v0
+func (b *fakeBroker) syncGroup(d *fakeDecoder) ([]byte, error) {
+	groupID := d.string()
+	generation := d.int32()
+	memberID := d.string()
+	assignments := make([]fakeGroupProtocol, d.arrayLen())
+	for i := range assignments {
+		assignments[i] = fakeGroupProtocol{name: d.string(), metadata: d.bytes()}
+	}
+	if d.err != nil {
+		return nil, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	errorCode, assignment := int16(0), []byte(nil)
+	g, m := b.member(groupID, memberID)
+	switch {
+	case m == nil:
+		errorCode = int16(kafka.UnknownMemberId)
+	case generation != g.generation:
+		errorCode = int16(kafka.IllegalGeneration)
+	case g.state == groupPreparingRebalance:
+		errorCode = int16(kafka.RebalanceInProgress)
+	default:
+		m.lastSeen = time.Now()
+		if memberID == g.leader && g.state == groupCompletingRebalance {
+			for _, a := range assignments {
+				if member, ok := g.members[a.name]; ok {
+					member.assignment = a.metadata
+				}
+			}
+			g.state = groupStable
+			b.notify()
+		}
+		for g.state == groupCompletingRebalance && g.generation == generation && g.members[memberID] == m {
+			if err := b.wait(time.Time{}); err != nil {
+				return nil, err
+			}
+		}
+		if g.members[memberID] != m {
+			errorCode = int16(kafka.UnknownMemberId)
+		} else if g.generation != generation || g.state != groupStable {
+			errorCode = int16(kafka.RebalanceInProgress)
+		} else {
+			assignment = m.assignment
+		}
+	}
+	e := &fakeEncoder{}
+	e.int16(errorCode)
+	e.bytes(assignment)
+	return e.Bytes(), nil
+}
+
+// keeps a member in its group, and tells it when it must rejoin for a rebalance. Encodes Heartbeat v0
+func (b *fakeBroker) heartbeat(d *fakeDecoder) []byte {
+	groupID := d.string()
+	generation := d.int32()
+	memberID := d.string()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	errorCode := int16(0)
+	g, m := b.member(groupID, memberID)
+	switch {
+	case m == nil:
+		errorCode = int16(kafka.UnknownMemberId)
+	case generation != g.generation:
+		errorCode = int16(kafka.IllegalGeneration)
+	case g.state == groupPreparingRebalance:
+		errorCode = int16(kafka.RebalanceInProgress)
+	default:
+		m.lastSeen = time.Now()
+	}
+	e := &fakeEncoder{}
+	e.int16(errorCode)
+	return e.Bytes()
+}
+
+// removes a member from its group, which rebalances the rest. Encodes LeaveGroup v0
+func (b *fakeBroker) leaveGroup(d *fakeDecoder) []byte {
+	groupID := d.string()
+	memberID := d.string()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	errorCode := int16(0)
+	if g, m := b.member(groupID, memberID); m == nil {
+		errorCode = int16(kafka.UnknownMemberId)
+	} else {
+		g.remove(m, time.Now())
+		b.notify()
+	}
+	e := &fakeEncoder{}
+	e.int16(errorCode)
+	return e.Bytes()
+}
+
+// Commits offsets for a group. A member commits as part of its generation. Offsets can also be committed with
+// no member and generation -1, but only while the group has no members - as Kafka allows. Encodes
+// OffsetCommit v2
+func (b *fakeBroker) offsetCommit(d *fakeDecoder) []byte {
+	groupID := d.string()
+	generation := d.int32()
+	memberID := d.string()
+	d.int64() // retention time
+	type partitionOffset struct {
+		partition int32
+		offset    int64
+	}
+	topics := make([]string, d.arrayLen())
+	offsets := make([][]partitionOffset, len(topics))
+	for i := range topics {
+		topics[i] = d.string()
+		offsets[i] = make([]partitionOffset, d.arrayLen())
+		for j := range offsets[i] {
+			offsets[i][j] = partitionOffset{partition: d.int32(), offset: d.int64()}
+			d.string() // metadata
+		}
+	}
+	if d.err != nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.groups[groupID]
+	groupError := int16(0)
+	if generation < 0 && memberID == "" {
+		if g == nil {
+			g = b.group(groupID)
+		} else if len(g.members) != 0 {
+			groupError = int16(kafka.UnknownMemberId)
+		}
+	} else if g == nil || g.members[memberID] == nil {
+		groupError = int16(kafka.UnknownMemberId)
+	} else if generation != g.generation {
+		groupError = int16(kafka.IllegalGeneration)
+	} else {
+		g.members[memberID].lastSeen = time.Now()
+	}
+	e := &fakeEncoder{}
+	e.int32(int32(len(topics)))
+	for i, topic := range topics {
+		e.string(topic)
+		e.int32(int32(len(offsets[i])))
+		for _, p := range offsets[i] {
+			errorCode := groupError
+			if errorCode == 0 && b.partition(topic, p.partition) == nil {
+				errorCode = int16(kafka.UnknownTopicOrPartition)
+			} else if errorCode == 0 {
+				if g.offsets[topic] == nil {
+					g.offsets[topic] = map[int32]int64{}
+				}
+				g.offsets[topic][p.partition] = p.offset
+			}
+			e.int32(p.partition)
+			e.int16(errorCode)
+		}
+	}
+	return e.Bytes()
+}
+
+// Removes the members of each group that stopped heartbeating, and completes the rebalances that timed out,
+// until the broker is closed
+func (b *fakeBroker) expire() {
+	ticker := time.NewTicker(fakeExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			b.mu.Lock()
+			changed := false
+			for _, g := range b.groups {
+				for _, m := range g.sortedMembers() {
+					// a member waiting for a rebalance to complete doesn't heartbeat
+					if !(g.state == groupPreparingRebalance && m.joined) && now.Sub(m.lastSeen) > m.sessionTimeout {
+						g.remove(m, now)
+						changed = true
+					}
+				}
+				if g.state == groupPreparingRebalance && now.After(g.deadline) {
+					g.completeRebalance()
+					changed = true
+				}
+			}
+			if changed {
+				b.notify()
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// Starts a rebalance, unless one is in progress. Every member must rejoin before the rebalance timeout.
+// Must be called with the lock held
+func (g *fakeGroup) prepareRebalance(now time.Time) {
+	if g.state == groupPreparingRebalance {
+		return
+	}
+	g.state = groupPreparingRebalance
+	g.deadline = now
+	for _, m := range g.members {
+		m.joined, m.assignment = false, nil
+		if d := now.Add(m.rebalanceTimeout); d.After(g.deadline) {
+			g.deadline = d
+		}
+	}
+}
+
+// completes the rebalance in progress if every member has rejoined. Must be called with the lock held
+func (g *fakeGroup) completeRebalanceIfJoined() {
+	for _, m := range g.members {
+		if !m.joined {
+			return
+		}
+	}
+	g.completeRebalance()
+}
+
+// Completes the rebalance in progress: removes the members that didn't rejoin, starts a new generation, and
+// sets the join response of each member. The leader is kept if it rejoined. Must be called with the lock held
+func (g *fakeGroup) completeRebalance() {
+	for id, m := range g.members {
+		if !m.joined {
+			delete(g.members, id)
+		}
+	}
+	g.generation++
+	if len(g.members) == 0 {
+		g.state, g.leader, g.protocol = groupEmpty, "", ""
+		return
+	}
+	members := g.sortedMembers()
+	if _, ok := g.members[g.leader]; !ok {
+		g.leader = members[0].id
+	}
+	g.protocol = g.selectProtocol()
+	g.state = groupCompletingRebalance
+	for _, m := range members {
+		m.joinResponse = &fakeJoinResponse{generation: g.generation, protocol: g.protocol, leader: g.leader, memberID: m.id}
+		if m.id == g.leader {
+			for _, member := range members {
+				m.joinResponse.members = append(m.joinResponse.members, fakeGroupProtocol{name: member.id, metadata: member.metadata(g.protocol)})
+			}
+		}
+	}
+}
+
+// returns the first protocol of the leader that every member supports. Must be called with the lock held
+func (g *fakeGroup) selectProtocol() string {
+	for _, p := range g.members[g.leader].protocols {
+		supported := true
+		for _, m := range g.members {
+			supported = supported && m.metadata(p.name) != nil
+		}
+		if supported {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// removes a member from the group, and rebalances the rest. Must be called with the lock held
+func (g *fakeGroup) remove(m *fakeMember, now time.Time) {
+	delete(g.members, m.id)
+	if len(g.members) == 0 {
+		g.state, g.leader, g.protocol = groupEmpty, "", ""
+		return
+	}
+	g.prepareRebalance(now)
+	g.completeRebalanceIfJoined()
+}
+
+// returns the members sorted by ID. Must be called with the lock held
+func (g *fakeGroup) sortedMembers() []*fakeMember {
+	members := make([]*fakeMember, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].id < members[j].id })
+	return members
+}
+
+// returns the metadata the member joined with for the passed protocol, or nil
+func (m *fakeMember) metadata(protocol string) []byte {
+	for _, p := range m.protocols {
+		if p.name == protocol {
+			if p.metadata == nil {
+				return []byte{}
+			}
+			return p.metadata
+		}
+	}
+	return nil
+}
+
+// Encodes the parts of a response that are written here rather than by the protocol package
+type fakeEncoder struct {
+	bytes.Buffer
+}
+
+func (e *fakeEncoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *fakeEncoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *fakeEncoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *fakeEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *fakeEncoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// Writes the passed records as one size-prefixed record batch - or an empty record set if there are none. The
+// protocol package writes the batch with a base offset of zero, so the base offset is set afterwards. It isn't
+// covered by the batch checksum
+func (e *fakeEncoder) recordBatch(records []protocol.Record) error {
+	if len(records) == 0 {
+		e.int32(0)
+		return nil
+	}
+	var batch bytes.Buffer
+	rs := protocol.RecordSet{Version: 2, Records: protocol.NewRecordReader(records...)}
+	if _, err := rs.WriteTo(&batch); err != nil {
+		return err
+	}
+	b := batch.Bytes()
+	// the batch follows the 4-byte size, and starts with the base offset
+	binary.BigEndian.PutUint64(b[4:12], uint64(records[0].Offset))
+	e.Write(b)
+	return nil
+}
+
+// Decodes the requests that are decoded here rather than by the protocol package. The first error is kept,
+// and the values read after it are zero
+type fakeDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *fakeDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *fakeDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *fakeDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *fakeDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// reads a string, which is empty if null
+func (d *fakeDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// reads bytes, which are nil if null
+func (d *fakeDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return append([]byte(nil), d.next(int(n))...)
+}
+
+// reads the length of an array. A null array has no elements
+func (d *fakeDecoder) arrayLen() int {
+	n := int(d.int32())
+	if n > len(d.b) {
+		// every element takes at least a byte, so the array can't fit
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	} else if n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/kafka-go"
+)
+
+// The outcome of merging the partials from all results replicas. Results has the same shape as the
+// response of the /results endpoint on a single results replica. Replicas lists the replica endpoints that
+// were queried and - for any that failed - the error. Warnings lists overlapping or missing offset ranges -
+// including ranges the results consumer group has committed but no replica applied - which indicate the
+// merged results can't be trusted. It also says if the offset ranges couldn't be checked
+type MergedResults struct {
+	Results        map[string]map[int]HousingResult
+	Reconciliation map[string]*SourceCounts `json:"-"`
+	Bench          map[string]*BenchStats   `json:"-"`
+	Replicas       map[string]string
+	Segments       map[int][]OffsetSegment
+	Baseline       map[int]int64 `json:",omitempty"`
+	Warnings       []string
+}
+
+var gatewayClient = &http.Client{Timeout: 5 * time.Second}
+
+// Runs the results gateway. The gateway doesn't read any messages. It serves the same /results endpoint
+// as the results role, but each request queries the /results/partials endpoint of every results replica
+// and sums them. The replicas arg is a comma-separated list of host:port. Each host is resolved on every
+// request and every address it resolves to is queried. So a headless Service name for the results
+// replicas will follow the results Deployment as it scales. The gateway only uses Kafka to get the
+// offsets committed by the results consumer group, which the merged offset ranges are checked against
+func resultsGatewayCmd(kafkaBrokers string, replicas string, resultsPort int) {
+	fmt.Printf("Starting results gateway http server on port: %v\n", resultsPort)
+	srv := &http.Server{
+		Handler:      gatewayRouter(kafkaBrokers, replicas),
+		Addr:         ":" + strconv.Itoa(resultsPort),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	fmt.Printf("Results gateway server terminated with result: %v\n", srv.ListenAndServe())
+}
+
+// returns the routes of the results gateway http server
+func gatewayRouter(kafkaBrokers string, replicas string) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/results", func(w http.ResponseWriter, r *http.Request) {
+		merged := mergePartials(kafkaBrokers, replicas)
+		if !checkMerged(w, merged) {
+			return
+		}
+		res, err := rollup(merged.Results, r.URL.Query().Get("rollup"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, res)
+	})
+	r.HandleFunc("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		merged := mergePartials(kafkaBrokers, replicas)
+		if !checkMerged(w, merged) {
+			return
+		}
+		writeJSON(w, reconcileReport(merged.Reconciliation))
+	})
+	r.HandleFunc("/bench", func(w http.ResponseWriter, r *http.Request) {
+		merged := mergePartials(kafkaBrokers, replicas)
+		if !checkMerged(w, merged) {
+			return
+		}
+		writeBenchStats(w, r, merged.Bench)
+	})
+	r.HandleFunc("/results/merge", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mergePartials(kafkaBrokers, replicas))
+	})
+	return r
+}
+
+// the response header that carries each warning of a merge
+const mergeWarningHeader = "X-Merge-Warning"
+
+// Checks the passed merge before it is written as the response. If any replica failed it writes a 502 and
+// returns false, because a missing partial would silently under-count. Otherwise it adds each warning of the
+// merge to the response as a mergeWarningHeader header - /results/merge has the detail - and returns true
+func checkMerged(w http.ResponseWriter, merged MergedResults) bool {
+	for endpoint, status := range merged.Replicas {
+		if status != "" {
+			http.Error(w, fmt.Sprintf("results replica %v failed: %v", endpoint, status), http.StatusBadGateway)
+			return false
+		}
+	}
+	for _, warning := range merged.Warnings {
+		w.Header().Add(mergeWarningHeader, warning)
+	}
+	return true
+}
+
+// marshals the passed value as the JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// expands the comma-separated host:port list into one host:port for each address each host resolves to
+func resolveReplicas(replicas string) ([]string, error) {
+	var endpoints []string
+	for _, replica := range strings.Split(replicas, ",") {
+		host, port, err := net.SplitHostPort(strings.TrimSpace(replica))
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			endpoints = append(endpoints, net.JoinHostPort(addr, port))
+		}
+	}
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+// gets the partials from all replicas concurrently and merges them
+func mergePartials(kafkaBrokers string, replicas string) MergedResults {
+	state := newAggregateState()
+	merged := MergedResults{
+		Results:        state.Results,
+		Reconciliation: state.Reconciliation,
+		Bench:          state.Bench,
+		Replicas:       map[string]string{},
+		Segments:       state.Segments,
+		Baseline:       state.Baseline,
+	}
+	// the committed offsets are read before the partials, so every message committed now was read by a
+	// replica before its partial is fetched. A replica commits each message when it reads it, and applies it
+	// after, so the last message committed on a partition may not be in a partial yet - checkSegments allows
+	// for that
+	expected, err := expectedSegments(kafkaBrokers)
+	if err != nil {
+		merged.Warnings = append(merged.Warnings, fmt.Sprintf("can't check offset ranges against the committed offsets, error is: %v", err))
+	}
+	endpoints, err := resolveReplicas(replicas)
+	if err != nil {
+		merged.Replicas[replicas] = err.Error()
+		gatewayReplicaErrors.Inc()
+		return merged
+	}
+	partials := make([]ResultsPartial, len(endpoints))
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			partials[i], errs[i] = getPartial(endpoint)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	for i, endpoint := range endpoints {
+		if errs[i] != nil {
+			merged.Replicas[endpoint] = errs[i].Error()
+			gatewayReplicaErrors.Inc()
+			continue
+		}
+		merged.Replicas[endpoint] = ""
+		state.Merge(partials[i].AggregateState)
+	}
+	// the replicas only account for the offsets from their baseline on
+	for partition, first := range merged.Baseline {
+		if want, ok := expected[partition]; ok && first > want.First {
+			expected[partition] = OffsetSegment{First: first, Next: maxOffset(first, want.Next)}
+		}
+	}
+	merged.Warnings = append(merged.Warnings, checkSegments(merged.Segments, expected)...)
+	return merged
+}
+
+// gets the partial results from one results replica
+func getPartial(endpoint string) (ResultsPartial, error) {
+	var partial ResultsPartial
+	resp, err := gatewayClient.Get("http://" + endpoint + "/results/partials")
+	if err != nil {
+		return partial, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return partial, fmt.Errorf("status code %v", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&partial)
+	return partial, err
+}
+
+// gets the offset range of each partition of the results topic that the results replicas must have
+// applied between them - from the earliest offset still in the partition up to the offset committed by the
+// results consumer group. The range of a partition the group hasn't committed is empty
+func expectedSegments(kafkaBrokers string) (map[int]OffsetSegment, error) {
+	offsets, err := getTopicOffsets(kafkaBrokers, results_topic, consumerGrpForTopic[results_topic])
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]int, 0, len(offsets))
+	for _, o := range offsets {
+		partitions = append(partitions, o.Partition)
+	}
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+	first, err := listOffsets(client, results_topic, partitions, kafka.FirstOffsetOf)
+	if err != nil {
+		return nil, err
+	}
+	expected := map[int]OffsetSegment{}
+	for _, o := range offsets {
+		seg := OffsetSegment{First: first[o.Partition].FirstOffset}
+		seg.Next = seg.First
+		if o.Committed > seg.First {
+			seg.Next = o.Committed
+		}
+		expected[o.Partition] = seg
+	}
+	return expected, nil
+}
+
+// The number of messages of a partition that a results replica can have committed but not yet applied.
+// A replica commits each message when it reads it, and reads the next message only after applying it
+const inFlightResults = 1
+
+// sorts the segments of each partition and returns a warning for each overlap - meaning two replicas
+// applied the same message - and each gap - meaning a replica that applied those messages is missing
+// (or was restarted and lost its results). The expected arg has the range of each partition that the
+// segments must cover, so a gap before the first segment, after the last segment, or a partition with
+// no segments at all is also a warning - except for the last inFlightResults messages of the range,
+// which may not have been applied yet. Segments past the expected range are fine - the replicas keep
+// applying messages after the committed offsets are read
+func checkSegments(segments map[int][]OffsetSegment, expected map[int]OffsetSegment) []string {
+	var warnings []string
+	partitions := make([]int, 0, len(segments))
+	for partition := range segments {
+		partitions = append(partitions, partition)
+	}
+	for partition := range expected {
+		if _, ok := segments[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+	}
+	sort.Ints(partitions)
+	for _, partition := range partitions {
+		segs := segments[partition]
+		sort.Slice(segs, func(i, j int) bool { return segs[i].First < segs[j].First })
+		want, ok := expected[partition]
+		want.Next = maxOffset(want.First, want.Next-inFlightResults)
+		if ok && want.Next > want.First {
+			if len(segs) == 0 {
+				warnings = append(warnings, fmt.Sprintf("partition %v: offsets %v-%v are not in any partial", partition, want.First, want.Next-1))
+				continue
+			}
+			if segs[0].First > want.First {
+				warnings = append(warnings, fmt.Sprintf("partition %v: offsets %v-%v are not in any partial", partition, want.First, minOffset(segs[0].First, want.Next)-1))
+			}
+		}
+		next := int64(-1)
+		for i, cur := range segs {
+			if i > 0 {
+				if cur.First < next {
+					warnings = append(warnings, fmt.Sprintf("partition %v: offsets %v-%v were applied more than once", partition, cur.First, minOffset(cur.Next, next)-1))
+				} else if cur.First > next {
+					warnings = append(warnings, fmt.Sprintf("partition %v: offsets %v-%v are not in any partial", partition, next, cur.First-1))
+				}
+			}
+			if cur.Next > next {
+				next = cur.Next
+			}
+		}
+		if ok && len(segs) != 0 && want.Next > next && want.Next > want.First {
+			warnings = append(warnings, fmt.Sprintf("partition %v: offsets %v-%v are not in any partial", partition, maxOffset(next, want.First), want.Next-1))
+		}
+	}
+	return warnings
+}
+
+// returns the lesser of two offsets
+func minOffset(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// returns the greater of two offsets
+func maxOffset(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestCheckSegments(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		segments map[int][]OffsetSegment
+		expected map[int]OffsetSegment
+		want     []string
+	}{
+		{
+			name:     "complete",
+			segments: map[int][]OffsetSegment{0: {{5, 8}, {0, 5}}, 1: {{0, 3}}},
+			expected: map[int]OffsetSegment{0: {0, 8}, 1: {0, 3}},
+		},
+		{
+			name:     "past the committed offsets",
+			segments: map[int][]OffsetSegment{0: {{0, 10}}},
+			expected: map[int]OffsetSegment{0: {0, 8}},
+		},
+		{
+			name:     "the last committed message is in flight",
+			segments: map[int][]OffsetSegment{0: {{0, 7}}},
+			expected: map[int]OffsetSegment{0: {0, 8}, 1: {0, 1}},
+		},
+		{
+			name:     "nothing committed",
+			segments: map[int][]OffsetSegment{},
+			expected: map[int]OffsetSegment{0: {4, 4}},
+		},
+		{
+			name:     "overlap and gap",
+			segments: map[int][]OffsetSegment{0: {{0, 5}, {3, 6}, {8, 10}}},
+			expected: map[int]OffsetSegment{0: {0, 10}},
+			want: []string{
+				"partition 0: offsets 3-4 were applied more than once",
+				"partition 0: offsets 6-7 are not in any partial",
+			},
+		},
+		{
+			name:     "leading and trailing gaps",
+			segments: map[int][]OffsetSegment{0: {{2, 5}}},
+			expected: map[int]OffsetSegment{0: {0, 9}},
+			want: []string{
+				"partition 0: offsets 0-1 are not in any partial",
+				"partition 0: offsets 5-7 are not in any partial",
+			},
+		},
+		{
+			name:     "no partial for a partition",
+			segments: map[int][]OffsetSegment{0: {{0, 2}}},
+			expected: map[int]OffsetSegment{0: {0, 2}, 1: {3, 6}},
+			want:     []string{"partition 1: offsets 3-4 are not in any partial"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := checkSegments(tc.segments, tc.expected); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got: %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckMerged(t *testing.T) {
+	w := httptest.NewRecorder()
+	merged := MergedResults{
+		Replicas: map[string]string{"10.0.0.1:8080": "", "10.0.0.2:8080": ""},
+		Warnings: []string{"can't check offset ranges", "partition 0: offsets 0-1 are not in any partial"},
+	}
+	if !checkMerged(w, merged) {
+		t.Fatalf("got false with all replicas ok, want true")
+	}
+	if got := w.Header()[mergeWarningHeader]; !reflect.DeepEqual(got, merged.Warnings) {
+		t.Errorf("got warning headers: %q, want: %q", got, merged.Warnings)
+	}
+
+	w = httptest.NewRecorder()
+	merged.Replicas["10.0.0.2:8080"] = "status code 500"
+	if checkMerged(w, merged) || w.Code != http.StatusBadGateway {
+		t.Errorf("got status %v with a failed replica, want %v", w.Code, http.StatusBadGateway)
+	}
+}
+
+// writes results messages with two code 1s each to the results topic
+func writeTestResults(t *testing.T, kafkaBrokers string, n int) {
+	t.Helper()
+	w := newKafkaWriter(kafkaBrokers, results_topic)
+	defer w.Close()
+	for i := 0; i < n; i++ {
+		if err := w.WriteMessages(context.Background(), kafka.Message{Value: []byte("2020-01:1,1")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// gets the passed path from the passed http server and decodes the JSON response into v, if v isn't nil.
+// Returns the response, whose body is closed
+func getTestJSON(t *testing.T, url string, path string, v interface{}) *http.Response {
+	t.Helper()
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("error decoding %v: %v", path, err)
+		}
+	}
+	return resp
+}
+
+// Runs the results role against the fake broker with this process as its only replica, behind a results
+// gateway, and checks the merge of the gateway - including after the results are reset with /admin/reset,
+// which must not be reported as missing offsets
+func TestGatewayMergeAfterReset(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	createTestTopic(t, brokers, results_topic, 2)
+	aggregator.Restore(newAggregateState())
+	defer aggregator.Restore(newAggregateState())
+	replica := httptest.NewServer(resultsRouter(kafkaOffsets(brokers), testAdminToken, ""))
+	defer replica.Close()
+	replicas := strings.TrimPrefix(replica.URL, "http://")
+	gateway := httptest.NewServer(gatewayRouter(brokers, replicas))
+	defer gateway.Close()
+
+	r := newKafkaReader(brokers, results_topic)
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		consumeResults(r, false, 0)
+	}()
+	defer func() {
+		r.Close()
+		<-consumed
+	}()
+	// merges the partials once the passed number of results are applied, and checks that /results has the
+	// merged count and the warnings of the merge in its headers
+	merge := func(applied int64, count int) MergedResults {
+		t.Helper()
+		waitFor(t, 30*time.Second, "the results to be applied", func() bool { return aggregator.Applied() == applied })
+		var merged MergedResults
+		getTestJSON(t, gateway.URL, "/results/merge", &merged)
+		if got := merged.Results["2020-01"][1].Count; got != count {
+			t.Errorf("got code 1 count: %v, want %v", got, count)
+		}
+		var results map[string]map[int]HousingResult
+		resp := getTestJSON(t, gateway.URL, "/results", &results)
+		if resp.StatusCode != http.StatusOK || results["2020-01"][1].Count != count {
+			t.Errorf("got status %v and results: %v, want code 1 count: %v", resp.StatusCode, results["2020-01"], count)
+		}
+		if got := resp.Header[mergeWarningHeader]; len(got) != len(merged.Warnings) {
+			t.Errorf("got warning headers: %q, want: %q", got, merged.Warnings)
+		}
+		return merged
+	}
+
+	writeTestResults(t, brokers, 6)
+	if merged := merge(6, 12); len(merged.Warnings) != 0 {
+		t.Errorf("got warnings: %v", merged.Warnings)
+	}
+
+	if status := adminTestRequest(t, replica.URL, http.MethodPost, "/admin/reset", testAdminToken, http.StatusOK); status.Applied != 0 {
+		t.Errorf("got status after a reset: %+v", status)
+	}
+	merged := merge(0, 0)
+	if len(merged.Warnings) != 0 {
+		t.Errorf("got warnings after a reset: %v", merged.Warnings)
+	}
+	var baseline int64
+	for _, offset := range merged.Baseline {
+		baseline += offset
+	}
+	if baseline != 6 {
+		t.Errorf("got baseline: %v, want the 6 committed offsets", merged.Baseline)
+	}
+
+	writeTestResults(t, brokers, 4)
+	if merged := merge(4, 8); len(merged.Warnings) != 0 {
+		t.Errorf("got warnings after a reset and new results: %v", merged.Warnings)
+	}
+
+	// results cleared without a baseline - as by a restart without a snapshot - are missing, which is a
+	// warning but not a failure
+	aggregator.Restore(newAggregateState())
+	if merged := merge(0, 0); len(merged.Warnings) == 0 {
+		t.Errorf("got no warnings for results that were lost")
+	}
+
+	// a replica that can't be reached fails the merge
+	failing := httptest.NewServer(gatewayRouter(brokers, replicas+",127.0.0.1:1"))
+	defer failing.Close()
+	for _, path := range []string{"/results", "/reconcile", "/bench"} {
+		if resp := getTestJSON(t, failing.URL, path, nil); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("got status %v from %v with a failed replica, want %v", resp.StatusCode, path, http.StatusBadGateway)
+		}
+	}
+}
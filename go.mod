@@ -4,6 +4,8 @@ go 1.16
 
 require (
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/prometheus/client_golang v1.6.0
 	github.com/segmentio/kafka-go v0.4.12
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
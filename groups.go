@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// One member of a consumer group. Assignments maps each topic to the partitions of it assigned to the member.
+// Lag is the total lag of the group on those partitions
+type GroupMember struct {
+	MemberID    string
+	ClientID    string
+	Host        string
+	Assignments map[string][]int
+	Lag         int64
+}
+
+// one consumer group as listed by the groups command
+type GroupSummary struct {
+	Group   string
+	State   string
+	Members int
+	Error   string `json:",omitempty"`
+}
+
+// What the groups command shows for one group. Offsets has the committed and last offsets of each topic
+// the group is assigned
+type GroupDescription struct {
+	Group   string
+	State   string
+	Members []GroupMember
+	Offsets map[string][]PartitionOffsets
+	Error   string `json:",omitempty"`
+}
+
+// Lists the consumer groups to the console with their state and member count. If a group is passed, describes
+// that group instead: its state, its members with the partitions assigned to each and the lag of each, and the
+// offsets of the topics it is assigned. Topic - if not empty - is also shown even if no member is assigned it,
+// e.g. because the group is empty. If watch is true, refreshes every interval seconds until interrupted
+func groupsCmd(kafkaBrokers string, group string, topic string, watch bool, interval int, output string) {
+	for {
+		if watch && output == outputTable {
+			// clear the screen, like the watch command
+			fmt.Printf("\033[H\033[2J")
+		}
+		if group == "" {
+			listGroups(kafkaBrokers, output)
+		} else {
+			d, err := describeGroup(kafkaBrokers, group, topic)
+			if err != nil {
+				errorf(output, "%v\n", err)
+			} else {
+				if d.Error != "" {
+					outputErrorf(output, "%v\n", d.Error)
+				}
+				if !outputGroupDescription(d, output) {
+					printGroupDescription(d)
+				}
+			}
+		}
+		if !watch {
+			return
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// lists all the consumer groups with their state and member count, sorted by group ID
+func listGroups(kafkaBrokers string, output string) {
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+	// ListGroups is sent to each broker in the cluster metadata, so if the cluster can't be reached it is sent to
+	// none and lists no groups without an error. Getting the metadata first catches that
+	if _, err := client.Metadata(context.Background(), &kafka.MetadataRequest{}); err != nil {
+		errorf(output, "error listing groups, error is: %v\n", err)
+		return
+	}
+	res, err := client.ListGroups(context.Background(), &kafka.ListGroupsRequest{})
+	if err != nil {
+		errorf(output, "error listing groups, error is: %v\n", err)
+		return
+	} else if res.Error != nil {
+		errorf(output, "error listing groups, error is: %v\n", res.Error)
+		return
+	}
+	var groups []string
+	for _, g := range res.Groups {
+		groups = append(groups, g.GroupID)
+	}
+	sort.Strings(groups)
+	summaries := make([]GroupSummary, len(groups))
+	for i, g := range groups {
+		summaries[i] = GroupSummary{Group: g}
+		d, err := describeGroup(kafkaBrokers, g, "")
+		if err != nil {
+			summaries[i].Error = err.Error()
+			outputErrorf(output, "%v\n", err)
+			continue
+		}
+		summaries[i].State, summaries[i].Members = d.State, len(d.Members)
+	}
+	if writeOutput(output, summaries, []string{"group", "state", "members", "error"}, func() [][]string {
+		var rows [][]string
+		for _, s := range summaries {
+			rows = append(rows, []string{s.Group, s.State, cell(s.Members), s.Error})
+		}
+		return rows
+	}) {
+		return
+	}
+	fmt.Printf("Listing consumer groups\n\n")
+	format := "%-50v%-25v%-10v\n"
+	fmt.Printf(format, "Group", "State", "Members")
+	for _, s := range summaries {
+		if s.Error != "" {
+			fmt.Printf(format, s.Group, s.Error, "")
+			continue
+		}
+		fmt.Printf(format, s.Group, s.State, s.Members)
+	}
+}
+
+// Describes the passed group. The offsets of each topic assigned to the group - and of the passed topic if
+// not empty - are fetched to compute the lag of each member
+func describeGroup(kafkaBrokers string, group string, topic string) (d GroupDescription, err error) {
+	// the kafka-go client panics in DescribeGroups if it can't connect to the broker
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error describing group %v: %v", group, r)
+		}
+	}()
+	d = GroupDescription{Group: group, Offsets: map[string][]PartitionOffsets{}}
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+	res, err := client.DescribeGroups(context.Background(), &kafka.DescribeGroupsRequest{GroupIDs: []string{group}})
+	if err != nil {
+		return d, fmt.Errorf("error describing group %v: %v", group, err)
+	}
+	for _, g := range res.Groups {
+		if g.Error != nil {
+			return d, fmt.Errorf("error describing group %v: %v", group, g.Error)
+		}
+		d.State = g.GroupState
+		for _, m := range g.Members {
+			member := GroupMember{MemberID: m.MemberID, ClientID: m.ClientID, Host: m.ClientHost, Assignments: map[string][]int{}}
+			for _, t := range m.MemberAssignments.Topics {
+				partitions := append([]int{}, t.Partitions...)
+				sort.Ints(partitions)
+				member.Assignments[t.Topic] = partitions
+				d.Offsets[t.Topic] = nil
+			}
+			d.Members = append(d.Members, member)
+		}
+	}
+	sort.Slice(d.Members, func(i, j int) bool {
+		return d.Members[i].ClientID+d.Members[i].MemberID < d.Members[j].ClientID+d.Members[j].MemberID
+	})
+	if topic != "" {
+		d.Offsets[topic] = nil
+	}
+	for t := range d.Offsets {
+		offsets, err := getTopicOffsets(kafkaBrokers, t, group)
+		if err != nil {
+			d.Error = err.Error()
+			continue
+		}
+		d.Offsets[t] = offsets
+		byPartition := map[int]int64{}
+		for _, o := range offsets {
+			byPartition[o.Partition] = o.Lag
+		}
+		for i := range d.Members {
+			for _, p := range d.Members[i].Assignments[t] {
+				d.Members[i].Lag += byPartition[p]
+			}
+		}
+	}
+	return d, nil
+}
+
+// Writes a group description in the passed machine-readable output format. CSV has one row per member.
+// Returns false if the output is table
+func outputGroupDescription(d GroupDescription, output string) bool {
+	return writeOutput(output, d, []string{"group", "state", "member_id", "client_id", "host", "assignments", "lag"}, func() [][]string {
+		var rows [][]string
+		for _, m := range d.Members {
+			rows = append(rows, []string{d.Group, d.State, m.MemberID, m.ClientID, m.Host, formatAssignments(m.Assignments), cell(m.Lag)})
+		}
+		return rows
+	})
+}
+
+// prints a group description to the console
+func printGroupDescription(d GroupDescription) {
+	fmt.Printf("Group: %v  State: %v  Members: %v\n\n", d.Group, d.State, len(d.Members))
+	format := "%-45v%-25v%-40v%v\n"
+	fmt.Printf(format, "Client ID", "Host", "Assigned Partitions", "Lag")
+	for _, m := range d.Members {
+		fmt.Printf(format, m.ClientID, m.Host, formatAssignments(m.Assignments), m.Lag)
+	}
+	topics := make([]string, 0, len(d.Offsets))
+	for t := range d.Offsets {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	for _, t := range topics {
+		fmt.Printf("\nTopic: %v\n", t)
+		format := "%-12v%-20v%-20v%-15v\n"
+		fmt.Printf(format, "Partition", "CommittedOffset", "LastOffset", "Lag")
+		for _, o := range d.Offsets[t] {
+			fmt.Printf(format, o.Partition, o.Committed, o.Last, o.Lag)
+		}
+	}
+	if d.Error != "" {
+		fmt.Printf("\nerror: %v\n", d.Error)
+	}
+}
+
+// formats assignments like compute:0,1,2 sorted by topic
+func formatAssignments(assignments map[string][]int) string {
+	topics := make([]string, 0, len(assignments))
+	for t := range assignments {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	var parts []string
+	for _, t := range topics {
+		partitions := make([]string, len(assignments[t]))
+		for i, p := range assignments[t] {
+			partitions[i] = strconv.Itoa(p)
+		}
+		parts = append(parts, t+":"+strings.Join(partitions, ","))
+	}
+	return strings.Join(parts, " ")
+}
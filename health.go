@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/kafka-go"
+)
+
+// Components whose state is reported to the health registry. The role registers the components it uses
+// at startup and they start out in the 'pending' state
+const (
+	// the Kafka cluster can be reached
+	componentKafka = "kafka"
+	// the topic reader is fetching - or at least not failing to fetch
+	componentReader = "reader"
+	// the last message write succeeded
+	componentWriter = "writer"
+	// this process is a member of its consumer group
+	componentGroup = "group"
+
+	statePending = "pending"
+	stateOK      = "ok"
+	stateFailing = "failing"
+
+	// how often the background checks run
+	healthCheckInterval = 10 * time.Second
+)
+
+// The state of one component. Since is when the component entered the state
+type ComponentHealth struct {
+	State string
+	Error string `json:",omitempty"`
+	Since time.Time
+	// liveness components fail the liveness probe once they have been failing longer than --liveness-secs
+	Liveness bool
+	// readiness components fail the readiness probe unless they are ok
+	Readiness bool
+}
+
+// What /healthz and /readyz return. Status is 'ok' or 'fail'
+type HealthReport struct {
+	Status     string
+	Role       string
+	Components map[string]ComponentHealth
+}
+
+// tracks the state of each component of the role. The background checks only run if the admin server
+// is enabled
+type healthRegistry struct {
+	mu         sync.Mutex
+	enabled    bool
+	components map[string]*ComponentHealth
+}
+
+var health = &healthRegistry{components: map[string]*ComponentHealth{}}
+
+// the Kafka client ID of this process, so this process can find itself in its consumer group. Unique per pod
+var clientID string
+
+func init() {
+	host, _ := os.Hostname()
+	clientID = "kafka-scale-" + host
+}
+
+// registers a component. The passed flags say whether it participates in liveness and readiness
+func (h *healthRegistry) register(name string, liveness bool, readiness bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.components[name] = &ComponentHealth{State: statePending, Since: time.Now(), Liveness: liveness, Readiness: readiness}
+}
+
+// sets the state of a component. Components that were not registered are ignored - so the roles can report
+// state without regard to whether the admin server is running
+func (h *healthRegistry) set(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.components[name]
+	if !ok {
+		return
+	}
+	state, msg := stateOK, ""
+	if err != nil {
+		state, msg = stateFailing, err.Error()
+	}
+	if c.State != state {
+		c.Since = time.Now()
+	}
+	c.State, c.Error = state, msg
+}
+
+func (h *healthRegistry) ok(name string) {
+	h.set(name, nil)
+}
+
+func (h *healthRegistry) fail(name string, err error) {
+	h.set(name, err)
+}
+
+// builds the liveness or readiness report. The process is live unless a liveness component has been
+// failing longer than the passed threshold. It is ready if every readiness component is ok
+func (h *healthRegistry) report(readiness bool, threshold time.Duration) HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := HealthReport{Status: "ok", Role: command, Components: map[string]ComponentHealth{}}
+	for name, c := range h.components {
+		r.Components[name] = *c
+		if readiness && c.Readiness && c.State != stateOK {
+			r.Status = "fail"
+		} else if !readiness && c.Liveness && c.State == stateFailing && time.Since(c.Since) > threshold {
+			r.Status = "fail"
+		}
+	}
+	return r
+}
+
+// starts the admin http server with the health endpoints. Returns the router so a role can add routes
+func startAdmin(adminPort int) *mux.Router {
+	health.mu.Lock()
+	health.enabled = true
+	health.mu.Unlock()
+	r := mux.NewRouter()
+	threshold := time.Duration(livenessSecs) * time.Second
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, health.report(false, threshold))
+	})
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, health.report(true, threshold))
+	})
+	srv := &http.Server{
+		Handler:      r,
+		Addr:         fmt.Sprintf(":%v", adminPort),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	fmt.Printf("starting admin http server on port %v\n", adminPort)
+	go func() {
+		fmt.Printf("admin server exited with result: %v\n", srv.ListenAndServe())
+	}()
+	return r
+}
+
+// writes the health report with 200 if ok, else 503
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, report)
+}
+
+// Periodically checks that Kafka can be reached, until the context is done
+func monitorKafka(ctx context.Context, kafkaBrokers string) {
+	health.register(componentKafka, false, true)
+	every(ctx, func() {
+		conn, err := dialKafka(ctx, kafkaBrokers)
+		if err == nil {
+			_ = conn.SetDeadline(time.Now().Add(healthCheckInterval))
+			_, err = conn.Brokers()
+			conn.Close()
+		}
+		health.set(componentKafka, err)
+	})
+}
+
+// Periodically checks the stats of the passed reader, until the context is done. Stats are reset each
+// time they are read, so any fetch since the last check means the reader is working. Errors without any
+// fetch mean it isn't. Neither means the reader is idle - e.g. there are more consumers in the group than
+// partitions - so the state is unchanged
+func monitorReader(ctx context.Context, r *kafka.Reader) {
+	health.register(componentReader, true, false)
+	every(ctx, func() {
+		stats := r.Stats()
+		if stats.Fetches > 0 || stats.Messages > 0 {
+			health.ok(componentReader)
+		} else if stats.Errors > 0 {
+			health.fail(componentReader, fmt.Errorf("%v errors and no fetches in the last %v", stats.Errors, healthCheckInterval))
+		}
+	})
+}
+
+// Periodically checks that this process is a member of the passed consumer group, until the context is done
+func monitorGroup(ctx context.Context, kafkaBrokers string, group string) {
+	health.register(componentGroup, false, true)
+	every(ctx, func() {
+		health.set(componentGroup, checkMembership(kafkaBrokers, group))
+	})
+}
+
+// returns nil if a member of the passed group has this process's client ID
+func checkMembership(kafkaBrokers string, group string) (err error) {
+	// the kafka-go client panics in DescribeGroups if it can't connect to the broker
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error describing group %v: %v", group, r)
+		}
+	}()
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+	res, err := client.DescribeGroups(context.Background(), &kafka.DescribeGroupsRequest{GroupIDs: []string{group}})
+	if err != nil {
+		return err
+	}
+	for _, g := range res.Groups {
+		if g.Error != nil {
+			return g.Error
+		}
+		for _, m := range g.Members {
+			if m.ClientID == clientID {
+				return nil
+			}
+		}
+		var members []string
+		for _, m := range g.Members {
+			members = append(members, m.ClientID)
+		}
+		sort.Strings(members)
+		return fmt.Errorf("%v is not a member of group %v (state: %v, members: %v)", clientID, group, g.GroupState, members)
+	}
+	return fmt.Errorf("group %v not found", group)
+}
+
+// Starts the background checks for a role that consumes the passed topic as part of the passed group
+// using the passed reader. Does nothing if the admin server isn't running
+func monitorConsumer(ctx context.Context, kafkaBrokers string, r *kafka.Reader, group string) {
+	health.mu.Lock()
+	enabled := health.enabled
+	health.mu.Unlock()
+	if !enabled {
+		return
+	}
+	monitorKafka(ctx, kafkaBrokers)
+	monitorReader(ctx, r)
+	monitorGroup(ctx, kafkaBrokers, group)
+}
+
+// runs the passed func immediately and then every healthCheckInterval until the context is done
+func every(ctx context.Context, fn func()) {
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			fn()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -15,88 +15,103 @@ import (
 )
 
 // valid topics. The compute topic holds chunks for computation. The results topic holds the results
-// of a computation performed with data from the tabulation topic
-const (
+// of a computation performed with data from the tabulation topic. The defaults are changed by --pipeline,
+// --compute-topic and --results-topic
+var (
 	compute_topic = "compute"
 	results_topic = "results"
 )
 
 var crc32q = crc32.MakeTable(crc32.IEEE)
 
-// Writes the passed message to the passed writer (and therefore topic)
-func writeMessage(writer *kafka.Writer, message string, verbose bool) error {
-	k := fmt.Sprintf("%x", crc32.Checksum([]byte(message), crc32q))
+// Writes the passed message with the passed headers (if any) to the passed sink (and therefore topic)
+func writeMessage(sink MessageSink, message string, verbose bool, headers ...kafka.Header) error {
+	k := messageKey(message)
 	if verbose {
-		fmt.Printf("writing message with key %v to topic %v\n", k, writer.Topic)
+		fmt.Printf("writing message with key %v\n", k)
 	}
-	err := writer.WriteMessages(context.Background(),
+	err := sink.WriteMessages(context.Background(),
 		kafka.Message{
-			Key:   []byte(k),
-			Value: []byte(message),
+			Key:     []byte(k),
+			Value:   []byte(message),
+			Headers: headers,
 		},
 	)
 	if err != nil {
 		fmt.Printf("error writing message, error is: %v\n", err)
+		health.fail(componentWriter, err)
 		return err
 	}
+	health.ok(componentWriter)
 	return nil
 }
 
-// Creates a topic if it does not already exist. If topic exists, then no change is made to Kafka
-func createTopicIfNotExists(kafkaBrokers string, topic string, partitionCnt int, replFactorCnt int) error {
+// returns the key the app writes a message with - the CRC of the message in hex
+func messageKey(message string) string {
+	return fmt.Sprintf("%x", crc32.Checksum([]byte(message), crc32q))
+}
+
+// Creates a topic from the passed spec if it does not already exist. If the topic exists, then no change is made
+// to Kafka. Returns true if the topic was created
+func createTopicIfNotExists(kafkaBrokers string, spec TopicSpec) (bool, error) {
 	conn, err := connectKakfa(kafkaBrokers)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer conn.Close()
 	partitions, err := conn.ReadPartitions()
 	if err != nil {
-		fmt.Printf("error reading partitions. error is: %v\n", err)
-		return err
+		return false, fmt.Errorf("error reading partitions. error is: %v", err)
 	}
 	for _, p := range partitions {
-		if p.Topic == topic {
+		if p.Topic == spec.Topic {
 			// topic already exists
-			return nil
+			return false, nil
 		}
 	}
 	controller, err := conn.Controller()
 	if err != nil {
-		fmt.Printf("error getting controller. error is: %v\n", err)
-		return err
+		return false, fmt.Errorf("error getting controller. error is: %v", err)
 	}
 	var controllerConn *kafka.Conn
-	controllerConn, err = kafka.Dial("tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	controllerConn, err = newDialer().Dial("tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
 	if err != nil {
-		fmt.Printf("error getting controller connection. error is: %v\n", err)
-		return err
+		return false, fmt.Errorf("error getting controller connection. error is: %v", err)
 	}
 	defer controllerConn.Close()
-	topicConfigs := []kafka.TopicConfig{
-		{
-			Topic:             topic,
-			NumPartitions:     partitionCnt,
-			ReplicationFactor: replFactorCnt,
-		},
+	topicConfig := kafka.TopicConfig{
+		Topic:             spec.Topic,
+		NumPartitions:     spec.Partitions,
+		ReplicationFactor: spec.ReplicationFactor,
+	}
+	for _, name := range sortedKeys(spec.Configs) {
+		topicConfig.ConfigEntries = append(topicConfig.ConfigEntries, kafka.ConfigEntry{ConfigName: name, ConfigValue: spec.Configs[name]})
 	}
-	err = controllerConn.CreateTopics(topicConfigs...)
+	err = controllerConn.CreateTopics(topicConfig)
 	if err != nil {
-		fmt.Printf("error creating topic. error is: %v\n", err)
-		return err
+		return false, fmt.Errorf("error creating topic. error is: %v", err)
 	}
-	return nil
+	return true, nil
+}
+
+// One partition of a topic as listed by the topiclist command
+type TopicPartition struct {
+	Topic     string
+	Partition int
+	Leader    string
 }
 
 // Lists the topics in kafka to the console, sorted by partition name and then ID
-func topicListCmd(kafkaBrokers string) {
+func topicListCmd(kafkaBrokers string, output string) {
 	conn, err := connectKakfa(kafkaBrokers)
 	if err != nil {
+		errorf(output, "%v\n", err)
 		return
 	}
 	defer conn.Close()
 	partitions, err := conn.ReadPartitions()
 	if err != nil {
-		fmt.Printf("error reading partitions. error is: %v\n", err)
+		errorf(output, "error reading partitions. error is: %v\n", err)
 		return
 	}
 	sort.Slice(partitions[:], func(i, j int) bool {
@@ -112,6 +127,19 @@ func topicListCmd(kafkaBrokers string) {
 		}
 	})
 
+	list := make([]TopicPartition, len(partitions))
+	for i, p := range partitions {
+		list[i] = TopicPartition{Topic: p.Topic, Partition: p.ID, Leader: p.Leader.Host}
+	}
+	if writeOutput(output, list, []string{"topic", "partition", "leader"}, func() [][]string {
+		var rows [][]string
+		for _, p := range list {
+			rows = append(rows, []string{p.Topic, cell(p.Partition), p.Leader})
+		}
+		return rows
+	}) {
+		return
+	}
 	fmt.Printf("Listing topics\n\n")
 	format := "%-70v%-15v%-20v\n"
 	fmt.Printf(format, "Topic", "Partition ID", "Leader")
@@ -129,8 +157,7 @@ func getPartitionsForTopic(kafkaBrokers string, topic string) ([]int, error) {
 	defer conn.Close()
 	partitions, err := conn.ReadPartitions()
 	if err != nil {
-		fmt.Printf("error reading partitions. error is: %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("error reading partitions. error is: %v", err)
 	}
 	var topicPartitions []int
 	for _, p := range partitions {
@@ -151,7 +178,7 @@ func rmTopicsCmd(kafkaBrokers string, topics string, force bool) {
 		return
 	}
 
-	client, shutdown := newClient(kafka.TCP(kafkaBrokers))
+	client, shutdown := newClient(kafkaBrokers)
 	defer shutdown()
 
 	topicArray := strings.Split(topics, ",")
@@ -169,33 +196,41 @@ func rmTopicsCmd(kafkaBrokers string, topics string, force bool) {
 	}
 }
 
-// Lists the offsets for all partitions in the passed topic to the console.
-func offsetsCmd(kafkaBrokers string, topic string) {
+// The committed offset of a consumer group and the last offset for one partition of a topic. Lag is the
+// difference. If the group has never committed an offset for the partition then Committed is -1 and the
+// lag is the whole partition
+type PartitionOffsets struct {
+	Partition int
+	Committed int64
+	Last      int64
+	Lag       int64
+}
+
+// Gets the committed offsets of the passed consumer group and the last offsets for all partitions in the
+// passed topic, sorted by partition ID asc
+func getTopicOffsets(kafkaBrokers string, topic string, group string) ([]PartitionOffsets, error) {
 	partitions, err := getPartitionsForTopic(kafkaBrokers, topic)
 	if err != nil {
-		fmt.Printf("error getting partitions for topic: %v, error is: %v\n", topic, err)
-		return
+		return nil, fmt.Errorf("error getting partitions for topic: %v, error is: %v", topic, err)
 	}
-	client, shutdown := newClient(kafka.TCP(kafkaBrokers))
+	client, shutdown := newClient(kafkaBrokers)
 	defer shutdown()
 
 	// first get "Committed"
 	offsets, err := client.OffsetFetch(context.Background(), &kafka.OffsetFetchRequest{
-		GroupID: consumerGrpForTopic[topic],
+		GroupID: group,
 		Topics: map[string][]int{
 			topic: partitions,
 		},
 	})
 	if err != nil {
-		fmt.Printf("error fetching offsets for topic: %v, error is: %v\n", topic, err)
-		return
+		return nil, fmt.Errorf("error fetching offsets for topic: %v, error is: %v", topic, err)
 	}
-	type offsetInfo = struct {committed int; last int}
-	final := map[int]offsetInfo{}
-
+	final := map[int]PartitionOffsets{}
 	for _, offsetFetchPartition := range offsets.Topics[topic] {
-		final[offsetFetchPartition.Partition] = offsetInfo{
-			committed: int(offsetFetchPartition.CommittedOffset),
+		final[offsetFetchPartition.Partition] = PartitionOffsets{
+			Partition: offsetFetchPartition.Partition,
+			Committed: offsetFetchPartition.CommittedOffset,
 		}
 	}
 
@@ -210,34 +245,89 @@ func offsetsCmd(kafkaBrokers string, topic string) {
 		},
 	})
 	if err != nil {
-		fmt.Printf("error listing offsets for topic: %v, error is: %v\n", kafkaBrokers, err)
-		return
+		return nil, fmt.Errorf("error listing offsets for topic: %v, error is: %v", topic, err)
 	}
 	partitionOffsets, ok := res.Topics[topic]
 	if !ok {
-		fmt.Printf("error getting partition offsets for topic: %v, error is: %v\n", kafkaBrokers, err)
-		return
+		return nil, fmt.Errorf("error getting partition offsets for topic: %v", topic)
 	}
 
 	// combine committed and last into final
 	for _, partitionOffset := range partitionOffsets {
 		// assume we will find it
 		f := final[partitionOffset.Partition]
-		f.last = int(partitionOffset.LastOffset)
+		f.Partition = partitionOffset.Partition
+		f.Last = partitionOffset.LastOffset
+		if f.Committed >= 0 {
+			f.Lag = f.Last - f.Committed
+		} else {
+			f.Lag = f.Last
+		}
 		final[partitionOffset.Partition] = f
 	}
 
-	// sort final on partition ID asc and display
-	keys := make([]int, 0, len(final))
-	for k := range final {
-		keys = append(keys, k)
+	// sort final on partition ID asc
+	result := make([]PartitionOffsets, 0, len(final))
+	for _, f := range final {
+		result = append(result, f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Partition < result[j].Partition })
+	return result, nil
+}
+
+// Lists one offset for each of the passed partitions of the passed topic, keyed by partition. The passed func
+// makes the request for a partition - e.g. kafka.FirstOffsetOf. Brokers reject a request that names a partition
+// more than once, so the first and last offsets of a partition must be listed in separate calls
+func listOffsets(client *kafka.Client, topic string, partitions []int, request func(int) kafka.OffsetRequest) (map[int]kafka.PartitionOffsets, error) {
+	var offsetRequests []kafka.OffsetRequest
+	for _, partition := range partitions {
+		offsetRequests = append(offsetRequests, request(partition))
+	}
+	res, err := client.ListOffsets(context.Background(), &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{
+			topic: offsetRequests,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing offsets for topic: %v, error is: %v", topic, err)
+	}
+	offsets := map[int]kafka.PartitionOffsets{}
+	for _, o := range res.Topics[topic] {
+		offsets[o.Partition] = o
+	}
+	return offsets, nil
+}
+
+// The offsets of a consumer group on a topic as listed by the offsets command
+type TopicOffsets struct {
+	Topic      string
+	Group      string
+	Partitions []PartitionOffsets
+}
+
+// Lists the offsets for all partitions in the passed topic to the console.
+func offsetsCmd(kafkaBrokers string, topic string, output string) {
+	group := consumerGrpForTopic[topic]
+	offsets, err := getTopicOffsets(kafkaBrokers, topic, group)
+	if err != nil {
+		errorf(output, "%v\n", err)
+		return
+	}
+	report := TopicOffsets{Topic: topic, Group: group, Partitions: offsets}
+	if writeOutput(output, report, []string{"topic", "group", "partition", "committed", "last", "lag"}, func() [][]string {
+		var rows [][]string
+		for _, o := range offsets {
+			rows = append(rows, []string{topic, group, cell(o.Partition), cell(o.Committed), cell(o.Last), cell(o.Lag)})
+		}
+		return rows
+	}) {
+		return
 	}
-	sort.Ints(keys)
 	fmt.Printf("Listing offsets for topic: %v\n\n", topic)
 	format := "%-20v%-20v%-20v\n"
 	fmt.Printf(format, "Partition", "CommittedOffset", "LastOffset")
-	for _, k := range keys {
-		fmt.Printf(format, k, final[k].committed, final[k].last)
+	for _, o := range offsets {
+		fmt.Printf(format, o.Partition, o.Committed, o.Last)
 	}
 }
 
@@ -247,34 +337,82 @@ func offsetsCmd(kafkaBrokers string, topic string) {
 
 // Creates and returns a new Kafka writer for the passed topic
 func newKafkaWriter(kafkaBrokers string, topic string) *kafka.Writer {
+	brokers := brokerList(kafkaBrokers)
 	return &kafka.Writer{
-		Addr:      kafka.TCP(kafkaBrokers),
-		Topic:     topic,
-		BatchSize: 1,
-		Balancer:  &kafka.LeastBytes{},
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		BatchSize:    1,
+		Balancer:     &kafka.LeastBytes{},
 		RequiredAcks: kafka.RequireNone,
+		Transport:    newTransport(len(brokers)),
+	}
+}
+
+// Creates and returns a new Kafka reader that reads the passed topic as part of the consumer group for the
+// topic. The client ID identifies this process in the group
+func newKafkaReader(kafkaBrokers string, topic string) *kafka.Reader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:       brokerList(kafkaBrokers),
+		GroupID:       consumerGrpForTopic[topic],
+		Topic:         topic,
+		QueueCapacity: 1,
+		MinBytes:      10e3, // 10KB
+		MaxBytes:      10e6, // 10MB
+		Dialer:        newDialer(),
+	})
+}
+
+// how long to wait for one broker to accept a connection before trying the next one
+const brokerDialTimeout = 3 * time.Second
+
+// splits the comma-separated broker list passed with --kafka into broker addresses, ignoring blanks
+func brokerList(kafkaBrokers string) []string {
+	var brokers []string
+	for _, broker := range strings.Split(kafkaBrokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
+
+// Connects to the first broker in the passed list that responds, trying each in turn. Any broker can
+// answer for the whole cluster, so one broker being down doesn't matter as long as another is up
+func dialKafka(ctx context.Context, kafkaBrokers string) (*kafka.Conn, error) {
+	var errs []string
+	for _, broker := range brokerList(kafkaBrokers) {
+		dialCtx, cancel := context.WithTimeout(ctx, brokerDialTimeout)
+		conn, err := newDialer().DialContext(dialCtx, "tcp", broker)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no Kafka brokers in: %v", kafkaBrokers)
 	}
+	return nil, fmt.Errorf("no broker could be reached: %v", strings.Join(errs, "; "))
 }
 
 // Creates and returns a connection to Kafka
 func connectKakfa(kafkaBrokers string) (*kafka.Conn, error) {
-	conn, err := kafka.Dial("tcp", kafkaBrokers)
+	conn, err := dialKafka(context.Background(), kafkaBrokers)
 	if err != nil {
-		fmt.Printf("error connecting to Kafka url: %v, error is: %v\n", kafkaBrokers, err)
-		return nil, err
+		return nil, fmt.Errorf("error connecting to Kafka url: %v, error is: %v", kafkaBrokers, err)
 	}
 	return conn, nil
 }
 
-// Creates a new Kafka client which can be used to query topic partitions and offsets
-func newClient(addr net.Addr) (*kafka.Client, func()) {
-	transport := &kafka.Transport{
-		Dial:     (&net.Dialer{}).DialContext,
-		Resolver: kafka.NewBrokerResolver(nil),
-	}
+// Creates a new Kafka client which can be used to query topic partitions and offsets. The client bootstraps
+// from the first broker in the passed list that accepts a connection and discovers the rest of the cluster
+// from it. There's no broker resolver because the kafka-go resolver can't handle a list of addresses
+func newClient(kafkaBrokers string) (*kafka.Client, func()) {
+	brokers := brokerList(kafkaBrokers)
+	transport := newTransport(len(brokers))
 	client := &kafka.Client{
-		Addr:      addr,
-		Timeout:   5 * time.Second,
+		Addr:      kafka.TCP(brokers...),
+		Timeout:   5*time.Second + transport.DialTimeout,
 		Transport: transport,
 	}
 	type ConnWaitGroup struct {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The lag of a consumer group on one topic at one point in time. Consumed and Produced are the rates in
+// messages per second since the prior sample - the rate the group committed offsets and the rate messages
+// were written to the topic. They are zero for the first sample. ETA is how long the group will take to
+// drain the lag at the current net rate, or -1 if the lag isn't shrinking. ETASeconds is the same in whole
+// seconds for the machine-readable output. Error is set by the status command if the offsets couldn't be read
+type LagReport struct {
+	Time       time.Time
+	Topic      string
+	Group      string
+	Partitions []PartitionLag
+	TotalLag   int64
+	Consumed   float64
+	Produced   float64
+	ETA        time.Duration `json:"-"`
+	ETASeconds int64
+	Error      string `json:",omitempty"`
+}
+
+// the lag of one partition, with the consumption rate of the partition since the prior sample
+type PartitionLag struct {
+	PartitionOffsets
+	Consumed float64
+}
+
+// Prints the lag of the passed consumer group on the passed topic to the console, per partition and in
+// total. If the group is empty, the group the app uses for the topic is used. If watch is true, the lag is
+// printed every interval seconds until the process is interrupted, along with the consumption rate and an ETA
+// to drain the lag. With machine-readable output, each refresh is written as its own document - or as more CSV
+// rows without repeating the header
+func lagCmd(kafkaBrokers string, topic string, group string, watch bool, interval int, output string) {
+	if group == "" {
+		group = consumerGrpForTopic[topic]
+	}
+	var prev *LagReport
+	for {
+		report, err := getLag(kafkaOffsets(kafkaBrokers), topic, group, prev)
+		if err != nil {
+			errorf(output, "%v\n", err)
+		} else {
+			if !outputLag(report, output, prev == nil) {
+				if watch {
+					// clear the screen, like the watch command
+					fmt.Printf("\033[H\033[2J")
+				}
+				printLag(report, prev != nil)
+			}
+			prev = &report
+		}
+		if !watch {
+			return
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// gets the lag of the passed group on the passed topic from the offsets the passed func gets. If a prior report
+// is passed, the rates and the ETA are computed from the offsets in it
+func getLag(getOffsets OffsetsFunc, topic string, group string, prev *LagReport) (LagReport, error) {
+	report := LagReport{Time: time.Now(), Topic: topic, Group: group, ETA: -1}
+	offsets, err := getOffsets(topic, group)
+	if err != nil {
+		return report, err
+	}
+	prevOffsets := map[int]PartitionOffsets{}
+	var secs float64
+	if prev != nil {
+		secs = report.Time.Sub(prev.Time).Seconds()
+		for _, p := range prev.Partitions {
+			prevOffsets[p.Partition] = p.PartitionOffsets
+		}
+	}
+	for _, o := range offsets {
+		p := PartitionLag{PartitionOffsets: o}
+		if before, ok := prevOffsets[o.Partition]; ok && secs > 0 {
+			if before.Committed >= 0 && o.Committed >= before.Committed {
+				p.Consumed = float64(o.Committed-before.Committed) / secs
+			}
+			if o.Last >= before.Last {
+				report.Produced += float64(o.Last-before.Last) / secs
+			}
+		}
+		report.Consumed += p.Consumed
+		report.TotalLag += o.Lag
+		report.Partitions = append(report.Partitions, p)
+	}
+	if report.TotalLag == 0 {
+		report.ETA = 0
+	} else if net := report.Consumed - report.Produced; net > 0 {
+		report.ETA = time.Duration(float64(report.TotalLag) / net * float64(time.Second)).Round(time.Second)
+	}
+	report.ETASeconds = int64(report.ETA / time.Second)
+	if report.ETA < 0 {
+		report.ETASeconds = -1
+	}
+	return report, nil
+}
+
+// Writes a lag report in the passed machine-readable output format. The CSV header is only written if header is
+// true. Returns false if the output is table
+func outputLag(report LagReport, output string, header bool) bool {
+	var columns []string
+	if header {
+		columns = []string{"time", "topic", "group", "partition", "committed", "last", "lag", "consumed_per_sec"}
+	}
+	return writeOutput(output, report, columns, func() [][]string {
+		var rows [][]string
+		for _, p := range report.Partitions {
+			rows = append(rows, []string{report.Time.Format(time.RFC3339), report.Topic, report.Group, cell(p.Partition),
+				cell(p.Committed), cell(p.Last), cell(p.Lag), cell(p.Consumed)})
+		}
+		return rows
+	})
+}
+
+// prints a lag report to the console. The rates are only printed if there was a prior sample to compute them from
+func printLag(report LagReport, withRates bool) {
+	fmt.Printf("Lag for group: %v on topic: %v at %v\n\n", report.Group, report.Topic, report.Time.Format(time.RFC3339))
+	format := "%-12v%-20v%-20v%-15v%v\n"
+	fmt.Printf(format, "Partition", "CommittedOffset", "LastOffset", "Lag", "Consumed/s")
+	for _, p := range report.Partitions {
+		fmt.Printf(format, p.Partition, p.Committed, p.Last, p.Lag, rate(p.Consumed, withRates))
+	}
+	fmt.Printf(format, "Total", "", "", report.TotalLag, rate(report.Consumed, withRates))
+	if withRates {
+		eta := "never - the lag is not shrinking"
+		if report.ETA >= 0 {
+			eta = report.ETA.String()
+		}
+		fmt.Printf("\nProduced/s: %.1f  Consumed/s: %.1f  ETA to drain: %v\n", report.Produced, report.Consumed, eta)
+	}
+}
+
+// formats a rate, or a dash if there is no rate yet
+func rate(r float64, withRates bool) string {
+	if !withRates {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", r)
+}
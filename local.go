@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Runs the whole pipeline in this process with no Kafka: the reader, the passed number of compute workers
+// and the results role, connected by in-memory compute and results topics with the partition counts of their
+// specs. Each compute worker is a member of the compute consumer group, so the workers share the compute
+// partitions - as compute pods do - and workers beyond the partition count are idle. The census data to read
+// is given the same way as to the read command. Once the reader is done and both topics are drained, the
+// results stay served on the results port - with the dashboard and the other endpoints of the results role -
+// until interrupted
+func localCmd(computeSpec TopicSpec, resultsSpec TopicSpec, workers int, fromFile string, chunkCount int, yearsArr []int,
+	monthsArr []string, resultsPort int, adminToken string, snapshotFile string, snapshotSecs int, verbose bool, delay int) {
+	computeTopic := newMemTopic(compute_topic, computeSpec.Partitions)
+	resultsTopic := newMemTopic(results_topic, resultsSpec.Partitions)
+	if workers > len(computeTopic.partitions) {
+		fmt.Printf("%v compute workers but %v compute topic partitions - %v workers will be idle\n", workers,
+			len(computeTopic.partitions), workers-len(computeTopic.partitions))
+	}
+
+	go serveResults(memOffsets(computeTopic, resultsTopic), resultsPort, adminToken, snapshotFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := startSnapshots(ctx, snapshotFile, snapshotSecs); err != nil {
+		fatalf("error restoring snapshot - not running the pipeline, error is: %v\n", err)
+		return
+	}
+	go consumeResults(resultsTopic.reader(consumerGrpForTopic[results_topic]), verbose, delay)
+	for i := 0; i < workers; i++ {
+		go calc(resultsTopic, computeTopic.reader(consumerGrpForTopic[compute_topic]), verbose, delay)
+	}
+
+	if chunks, ok := readAndChunk(computeTopic, fromFile, chunkCount, yearsArr, monthsArr, verbose, delay); !ok {
+		fmt.Printf("error processing census data. %v chunks were processed before stopping\n", chunks)
+	} else {
+		fmt.Printf("no errors were encountered processing census data. %v chunks were processed\n", chunks)
+	}
+	// the compute topic is only committed once the results are written, so checking it first means every
+	// result is in the results topic by the time that is checked
+	for !computeTopic.drained(consumerGrpForTopic[compute_topic]) || !resultsTopic.drained(consumerGrpForTopic[results_topic]) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Printf("the pipeline is drained - %v results messages were applied. Serving results on port %v until interrupted\n",
+		aggregator.Applied(), resultsPort)
+	select {}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"context"
+	"os"
+)
+
 var command string
 var dryRun bool
 var years string
@@ -10,6 +15,15 @@ var yearsArr []int
 var monthsArr []string
 var partitionCnt int
 var replicationFactor int
+var resultsPartitionCnt int
+var resultsReplicationFactor int
+var computeTopicConfigs string
+var resultsTopicConfigs string
+var topicSpecFile string
+var onDrift string
+
+// the topic specs built from the topic flags and --topic-specs
+var topicSpecs map[string]TopicSpec
 var fromFile string
 var topic string
 var verbose bool
@@ -19,39 +33,112 @@ var withMetrics bool
 var metricsPort string
 var printVersion bool
 var writeTo string
+var writeFile string
+var readFrom string
+var readFile string
 var noShutdownReader bool
 var force bool
+var streamBuffer int
+var resultsReplicas string
+var adminPort int
+var livenessSecs int
+var snapshotFile string
+var snapshotSecs int
+var adminToken string
+var group string
+var watch bool
+var interval int
+var resetTo string
+var shiftBy int64
+var toOffsets string
+var execute bool
+var partition int
+var from string
+var limit int
+var follow bool
+var decode bool
+var input string
+var format string
+var partitions int
+var topicConfigs string
+var output string
+var resultsURL string
+var pipeline string
+var computeTopicName string
+var resultsTopicName string
+var computeGroup string
+var resultsGroup string
+var tlsEnabled bool
+var tlsCAFile string
+var tlsCertFile string
+var tlsKeyFile string
+var tlsServerName string
+var tlsInsecure bool
+var saslMechanism string
+var saslUsername string
+var saslPasswordFile string
+var benchRate int
+var benchTimeout int
+var benchReport string
+var workers int
 
 const (
 	// supported commands
 
 	// read a dataset, and chunk it into the 'compute' queue
-	read      = "read"
+	read = "read"
 	// read the 'compute` queue, compute results, write to the 'results' queue
-	compute   = "compute"
+	compute = "compute"
 	// read the 'results' queue, summarize results into memory, serve the results as JSON via a REST call
-	results   = "results"
+	results = "results"
+	// query the 'results' replicas for their partial results, and serve the merged results as JSON via a REST call
+	resultsGateway = "results-gateway"
 	// list all topics to the console
 	topiclist = "topiclist"
 	// remove comma-separated list of topics
-	rmtopics  = "rmtopics"
+	rmtopics = "rmtopics"
 	// list offsets of a specified topic to the console
-	offsets   = "offsets"
+	offsets = "offsets"
+	// describe the partitions, replicas, offsets and configs of topics to the console
+	describe = "describe"
+	// show the lag of a consumer group on a topic, optionally refreshing
+	lag = "lag"
+	// reset the committed offsets of a consumer group on a topic
+	resetoffsets = "resetoffsets"
+	// print messages from a topic to the console without committing
+	tail = "tail"
+	// write messages read from stdin or a file to a topic
+	produce = "produce"
+	// list consumer groups, or describe the members, assignments and lag of one
+	groups = "groups"
+	// add partitions to a topic, or change its configs
+	alterTopic = "alter-topic"
+	// create the topics in the topic specs, or converge them to their specs
+	applyTopics = "apply-topics"
+	// show the progress of the whole pipeline, optionally refreshing
+	status = "status"
+	// write synthetic chunks to the 'compute' queue and measure the throughput and latency of the pipeline
+	bench = "bench"
+	// run the read, compute and results roles in this process, connected by in-memory topics instead of Kafka
+	local = "local"
 
-	// Readers of the compute topic all read as part of this consumer group
+	// Readers of the compute topic all read as part of this consumer group - unless changed by --pipeline
+	// or --compute-group. Likewise the results topic and --results-group
 	computeConsumer = "kafka-scale-consumer-group"
-	resultConsumer = "kafka-scale-results-consumer-group"
+	resultConsumer  = "kafka-scale-results-consumer-group"
 
-	writeToKafka = "kafka"
+	writeToKafka  = "kafka"
 	writeToStdout = "stdout"
-	WriteToNull = "null"
+	WriteToNull   = "null"
+	writeToFile   = "file"
 )
 
 // maps consumer groups to topics. The code always reads from a topic as part of a consumer group because
-// that enables using the Kafka.NewReader functionality with auto-commit, etc.
-var consumerGrpForTopic = map[string]string {
-	compute: computeConsumer,
-	results: resultConsumer,
+// that enables using the Kafka.NewReader functionality with auto-commit, etc. Rebuilt from the command line
+// by configurePipeline
+var consumerGrpForTopic = map[string]string{
+	compute_topic: computeConsumer,
+	results_topic: resultConsumer,
 }
 
 // Some example usages:
@@ -61,11 +148,31 @@ var consumerGrpForTopic = map[string]string {
 //
 // ./kafka-scale --kafka=$IP:$PORT --years=2018,2019 --months=jan --compute-topic-partitions=10 --chunks=1 --verbose read
 // ./kafka-scale --years=2019 --months='*' --write-to=stdout read
+// ./kafka-scale --from-file=/home/eace/Downloads/dec20pub.dat.gz --years=2020 --compute-topic-partitions=4 --workers=4 local
 // ./kafka-scale --kafka=$IP:$PORT --from-file=/home/eace/Downloads/dec20pub.dat.gz --years=2019 --compute-topic-partitions=10 --chunks=1 read
 // ./kafka-scale --kafka=$IP:$PORT --write-to=stdout --verbose compute
+// ./kafka-scale --from-file=/home/eace/Downloads/dec20pub.dat.gz --years=2020 --write-to=file --write-file=chunks.ndjson read
+// ./kafka-scale --read-from=file --read-file=chunks.ndjson --write-to=file --write-file=results.ndjson compute
+// ./kafka-scale --read-from=file --read-file=results.ndjson --results-port=8888 results
 // ./kafka-scale --kafka=$IP:$PORT --verbose --results-port=8888 results
+// ./kafka-scale --kafka=$IP:$PORT --results-port=8888 --admin-port=8081 results
+// ./kafka-scale --kafka=$IP:$PORT --snapshot-file=/tmp/results.json --snapshot-secs=60 results
+// ./kafka-scale --kafka=$IP:$PORT --results-replicas=kafka-scale-results-headless:8888 --results-port=8888 results-gateway
 // ./kafka-scale --kafka=$IP:$PORT topiclist
 // ./kafka-scale --kafka=$IP:$PORT --topic=compute offsets
+// ./kafka-scale --kafka=$IP:$PORT --topic=compute,results describe
+// ./kafka-scale --kafka=$IP:$PORT --topic=compute --watch --interval=5 lag
+// ./kafka-scale --kafka=$IP:$PORT --topic=results --to=earliest --execute resetoffsets
+// ./kafka-scale --kafka=$IP:$PORT --topic=compute --partition=0 --from=2021-03-01T15:04:05Z --limit=10 --decode tail
+// ./kafka-scale --kafka=$IP:$PORT --topic=results --input=results.ndjson --format=ndjson produce
+// ./kafka-scale --kafka=$IP:$PORT --topic=compute --output=json lag
+// ./kafka-scale --kafka=$IP:$PORT --results-url=http://$IP:32099 --watch status
+// ./kafka-scale --kafka=$IP:$PORT --results-url=http://$IP:32099 --chunks=10000 --rate=500 --bench-report=bench.jsonl bench
+// ./kafka-scale --kafka=$IP:$PORT --pipeline=team-a --compute-topic-partitions=10 --years=2019 --months=jan read
+// ./kafka-scale --kafka=$IP:9093 --tls-ca-file=ca.crt --sasl-mechanism=scram-sha-512 --sasl-username=me --sasl-password-file=password topiclist
+// ./kafka-scale --kafka=$IP:$PORT --compute-topic-partitions=10 --results-topic-configs=retention.ms=604800000 apply-topics
+// ./kafka-scale --kafka=$IP:$PORT --group=kafka-scale-consumer-group --watch groups
+// ./kafka-scale --kafka=$IP:$PORT --topic=compute --partitions=20 --topic-configs=retention.ms=3600000 alter-topic
 // ./kafka-scale --kafka=$IP:$PORT --topic=compute,results rmtopics
 func main() {
 	if !validateCmdline() {
@@ -77,29 +184,78 @@ func main() {
 		return
 	}
 	// always init the metrics
-	initMetrics(command)
+	if command == local {
+		// local runs all the roles so needs the metrics of each
+		for _, role := range []string{read, compute, results} {
+			initMetrics(role)
+		}
+	} else {
+		initMetrics(command)
+	}
 	if withMetrics {
 		// but only start metrics exposition if --with-metrics is specified
 		startMetrics(metricsPort, command)
 		defer stopMetrics()
 	}
+	if adminPort > 0 && (command == read || command == compute || command == results || command == resultsGateway) {
+		// the health endpoints are only meaningful for the long-running roles
+		startAdmin(adminPort)
+		if (command == read || command == compute) && writeTo == writeToKafka {
+			health.register(componentWriter, true, false)
+		}
+		if command == read && writeTo == writeToKafka {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			monitorKafka(ctx, kafkaBrokers)
+		}
+	}
 	switch command {
 	case read:
-		readCmd(kafkaBrokers, partitionCnt, replicationFactor, fromFile, chunkCount, yearsArr, monthsArr, writeTo, verbose, delay)
+		readCmd(kafkaBrokers, topicSpecs[compute_topic], onDrift, fromFile, chunkCount, yearsArr, monthsArr, writeTo, writeFile, verbose, delay)
 		if noShutdownReader {
 			// this is just a development aid to leave the container running so the metrics endpoint continues
 			// to be available even if all gzips have been processed
-			select{}
+			select {}
 		}
 	case compute:
-		computeCmd(kafkaBrokers, partitionCnt, replicationFactor, verbose, writeTo, delay)
+		computeCmd(kafkaBrokers, topicSpecs[results_topic], onDrift, verbose, readFrom, readFile, writeTo, writeFile, delay)
 	case results:
-		resultsCmd(kafkaBrokers, resultsPort, verbose, delay)
+		resultsCmd(kafkaBrokers, readFrom, readFile, resultsPort, verbose, delay, snapshotFile, snapshotSecs, adminToken)
+	case resultsGateway:
+		resultsGatewayCmd(kafkaBrokers, resultsReplicas, resultsPort)
 	case topiclist:
-		topicListCmd(kafkaBrokers)
+		topicListCmd(kafkaBrokers, output)
 	case offsets:
-		offsetsCmd(kafkaBrokers, topic)
+		offsetsCmd(kafkaBrokers, topic, output)
 	case rmtopics:
 		rmTopicsCmd(kafkaBrokers, topic, force)
+	case describe:
+		describeCmd(kafkaBrokers, topic, output)
+	case lag:
+		lagCmd(kafkaBrokers, topic, group, watch, interval, output)
+	case resetoffsets:
+		resetOffsetsCmd(kafkaBrokers, topic, group, resetTo, shiftBy, toOffsets, execute, force, output)
+	case tail:
+		tailCmd(kafkaBrokers, topic, partition, from, limit, follow, decode)
+	case produce:
+		produceCmd(kafkaBrokers, topic, input, format, verbose)
+	case groups:
+		groupsCmd(kafkaBrokers, group, topic, watch, interval, output)
+	case alterTopic:
+		alterTopicCmd(kafkaBrokers, topic, partitions, topicConfigs, output)
+	case applyTopics:
+		applyTopicsCmd(kafkaBrokers, topicSpecs, output)
+	case status:
+		statusCmd(kafkaBrokers, resultsURL, watch, interval, output)
+	case local:
+		localCmd(topicSpecs[compute_topic], topicSpecs[results_topic], workers, fromFile, chunkCount, yearsArr, monthsArr,
+			resultsPort, adminToken, snapshotFile, snapshotSecs, verbose, delay)
+	case bench:
+		benchCmd(kafkaBrokers, topicSpecs[compute_topic], onDrift, chunkCount, benchRate, resultsURL, benchTimeout, benchReport, output)
+	}
+	if exitCode != 0 {
+		// os.Exit skips the deferred calls
+		stopMetrics()
+		os.Exit(exitCode)
 	}
 }
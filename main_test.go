@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// the metrics are package globals that the roles update unconditionally, so - like the local command - init
+// the metrics of every role before running any test
+func TestMain(m *testing.M) {
+	for _, role := range []string{read, compute, results, resultsGateway} {
+		initMetrics(role)
+	}
+	os.Exit(m.Run())
+}
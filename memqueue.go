@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// An in-memory stand-in for a Kafka topic, used by the local command: a log of messages for each partition,
+// and the consumer groups reading it. Writes spread messages over the partitions round-robin. The readers in
+// a group share the partitions the way the members of a Kafka consumer group do: each partition is assigned
+// to one reader, and the partitions are reassigned when a reader joins or leaves. A message is committed when
+// its reader asks for the next one - so a message is only committed once it has been processed - or when the
+// partitions are reassigned. The topic is a MessageSink
+type memTopic struct {
+	mu         sync.Mutex
+	name       string
+	partitions [][]kafka.Message
+	next       int
+	groups     map[string]*memGroup
+	// closed and replaced whenever there is something new to read or the assignments change
+	changed chan struct{}
+}
+
+// a consumer group of an in-memory topic. Position is the next offset to read from each partition, and
+// committed is the next offset to read after a reassignment
+type memGroup struct {
+	position  []int64
+	committed []int64
+	readers   []*memReader
+}
+
+// A reader of an in-memory topic as part of a consumer group. It is a MessageSource. It must not be used
+// concurrently - like a kafka.Reader
+type memReader struct {
+	topic    *memTopic
+	group    *memGroup
+	assigned []int
+	// the index in assigned of the partition to read first, so every partition gets a turn
+	cursor int
+	// the partition of the message read last, which is committed by the next read, or -1
+	pending       int
+	pendingOffset int64
+	closed        bool
+}
+
+// returns a new empty in-memory topic with the passed number of partitions
+func newMemTopic(name string, partitions int) *memTopic {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &memTopic{
+		name:       name,
+		partitions: make([][]kafka.Message, partitions),
+		groups:     map[string]*memGroup{},
+		changed:    make(chan struct{}),
+	}
+}
+
+// WriteMessages appends the passed messages to the partitions of the topic round-robin
+func (t *memTopic) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, m := range msgs {
+		p := t.next % len(t.partitions)
+		t.next++
+		m.Topic, m.Partition, m.Offset, m.Time = t.name, p, int64(len(t.partitions[p])), now
+		t.partitions[p] = append(t.partitions[p], m)
+	}
+	t.notify()
+	return nil
+}
+
+// Close does nothing - the topic stays readable
+func (t *memTopic) Close() error {
+	return nil
+}
+
+// returns a new reader of the topic that is a member of the passed group
+func (t *memTopic) reader(group string) *memReader {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.groups[group]
+	if !ok {
+		g = &memGroup{position: make([]int64, len(t.partitions)), committed: make([]int64, len(t.partitions))}
+		t.groups[group] = g
+	}
+	r := &memReader{topic: t, group: g, pending: -1}
+	g.readers = append(g.readers, r)
+	t.rebalance(g)
+	return r
+}
+
+// returns true if the passed group has committed every message in the topic
+func (t *memTopic) drained(group string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.groups[group]
+	for p, log := range t.partitions {
+		if !ok || g.committed[p] != int64(len(log)) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the committed and last offsets of the passed group for each partition. Committed is -1 if the
+// group has never read the topic - the same as Kafka
+func (t *memTopic) offsets(group string) []PartitionOffsets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.groups[group]
+	offsets := make([]PartitionOffsets, len(t.partitions))
+	for p, log := range t.partitions {
+		o := PartitionOffsets{Partition: p, Committed: -1, Last: int64(len(log)), Lag: int64(len(log))}
+		if ok {
+			o.Committed = g.committed[p]
+			o.Lag = o.Last - o.Committed
+		}
+		offsets[p] = o
+	}
+	return offsets
+}
+
+// returns an OffsetsFunc that gets the offsets from the passed in-memory topics
+func memOffsets(topics ...*memTopic) OffsetsFunc {
+	return func(topic string, group string) ([]PartitionOffsets, error) {
+		for _, t := range topics {
+			if t.name == topic {
+				return t.offsets(group), nil
+			}
+		}
+		return nil, fmt.Errorf("no in-memory topic %v", topic)
+	}
+}
+
+// assigns the partitions round-robin to the readers of the passed group. The message each reader read last
+// is committed first - as a kafka.Reader commits before a rebalance - and each partition is then read from
+// the committed offset. Must be called with the lock held
+func (t *memTopic) rebalance(g *memGroup) {
+	for _, r := range g.readers {
+		r.commit()
+		r.assigned, r.cursor = nil, 0
+	}
+	for p := range t.partitions {
+		g.position[p] = g.committed[p]
+		if len(g.readers) != 0 {
+			r := g.readers[p%len(g.readers)]
+			r.assigned = append(r.assigned, p)
+		}
+	}
+	t.notify()
+}
+
+// wakes up the readers waiting for messages. Must be called with the lock held
+func (t *memTopic) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// ReadMessage commits the message read last and returns the next message from the partitions assigned to the
+// reader. Blocks until there is one, the context is done, or the reader is closed - which returns io.EOF
+func (r *memReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	t := r.topic
+	for {
+		t.mu.Lock()
+		if r.closed {
+			t.mu.Unlock()
+			return kafka.Message{}, io.EOF
+		}
+		r.commit()
+		for i := range r.assigned {
+			idx := (r.cursor + i) % len(r.assigned)
+			p := r.assigned[idx]
+			if offset := r.group.position[p]; offset < int64(len(t.partitions[p])) {
+				r.group.position[p]++
+				r.pending, r.pendingOffset = p, offset
+				r.cursor = (idx + 1) % len(r.assigned)
+				m := t.partitions[p][offset]
+				t.mu.Unlock()
+				return m, nil
+			}
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		}
+	}
+}
+
+// commits the message read last, if any. Must be called with the lock held
+func (r *memReader) commit() {
+	if r.pending >= 0 {
+		r.group.committed[r.pending] = r.pendingOffset + 1
+		r.pending = -1
+	}
+}
+
+// Close commits the message read last and leaves the group, so its partitions are reassigned to the other
+// readers in the group
+func (r *memReader) Close() error {
+	t := r.topic
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.commit()
+	r.closed = true
+	for i, member := range r.group.readers {
+		if member == r {
+			r.group.readers = append(r.group.readers[:i], r.group.readers[i+1:]...)
+			break
+		}
+	}
+	t.rebalance(r.group)
+	return nil
+}
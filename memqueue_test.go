@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMemOffsets(t *testing.T) {
+	topic := newMemTopic("t1", 2)
+	other := newMemTopic("t2", 1)
+	ctx := context.Background()
+	if err := topic.WriteMessages(ctx, kafka.Message{Value: []byte("m1")}, kafka.Message{Value: []byte("m2")},
+		kafka.Message{Value: []byte("m3")}); err != nil {
+		t.Fatal(err)
+	}
+	r := topic.reader("g1")
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadMessage(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the message read last is in flight until the next read, so only one is committed
+	offsets := memOffsets(topic, other)
+	report, err := getLag(offsets, "t1", "g1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TotalLag != 2 || len(report.Partitions) != 2 {
+		t.Errorf("got lag: %+v, want 2 over 2 partitions", report)
+	}
+	r.Close()
+	if report, _ = getLag(offsets, "t1", "g1", nil); report.TotalLag != 1 {
+		t.Errorf("got lag %v after closing the reader, want 1", report.TotalLag)
+	}
+	if o, err := offsets("t2", "g1"); err != nil || len(o) != 1 || o[0].Committed != -1 {
+		t.Errorf("got offsets: %+v error: %v for a group that never read t2", o, err)
+	}
+	if _, err := offsets("t3", "g1"); err == nil {
+		t.Errorf("got no error for a topic that isn't in memory")
+	}
+}
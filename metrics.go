@@ -13,9 +13,19 @@ import (
 
 var downloadedGZips Counter
 var chunksWritten Counter
+var linesRead Counter
+var sourceErrors Counter
+var computeRecords Counter
+var computeDroppedRecords Counter
+var rejectedCodes Counter
+var reconcileMismatch GaugeVec
 var computeMessagesRead Counter
 var resultMessagesWritten Counter
 var resultMessagesRead Counter
+var resultReadErrors Counter
+var streamSubscribers Gauge
+var streamResyncs Counter
+var gatewayReplicaErrors Counter
 
 // these are just to have handy to clone
 //var TestCounterVec CounterVec
@@ -74,6 +84,18 @@ func initMetrics(command string) {
 				Help: fmt.Sprintf("The Count of Census data chunks written by the read command to the %v topic", compute_topic),
 			},
 		)
+		linesRead = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_lines_read",
+				Help: "The Count of census records read by the read command from census gzips",
+			},
+		)
+		sourceErrors = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_source_errors",
+				Help: "The Count of census gzips that the read command failed to read completely",
+			},
+		)
 	case compute:
 		computeMessagesRead = NewCounter(
 			prometheus.CounterOpts{
@@ -87,6 +109,18 @@ func initMetrics(command string) {
 				Help: fmt.Sprintf("The Count of messages written by the compute command to the %v topic", results_topic),
 			},
 		)
+		computeRecords = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_compute_records",
+				Help: "The Count of census records in the chunks computed by the compute command",
+			},
+		)
+		computeDroppedRecords = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_compute_dropped_records",
+				Help: "The Count of census records the compute command could not get a housing code from",
+			},
+		)
 	case results:
 		resultMessagesRead = NewCounter(
 			prometheus.CounterOpts{
@@ -94,6 +128,44 @@ func initMetrics(command string) {
 				Help: fmt.Sprintf("The Count of messages read by the result command from the %v topic", results_topic),
 			},
 		)
+		resultReadErrors = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_result_read_errors",
+				Help: fmt.Sprintf("The Count of errors reading messages by the result command from the %v topic", results_topic),
+			},
+		)
+		rejectedCodes = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_rejected_codes",
+				Help: "The Count of invalid housing codes the results command did not count",
+			},
+		)
+		reconcileMismatch = NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kafka_scale_reconcile_mismatched_records",
+				Help: "By census source, the records read that were not counted - or were counted more than once - by the results command",
+			},
+			[]string{"source"},
+		)
+		streamSubscribers = NewGauge(
+			prometheus.GaugeOpts{
+				Name: "kafka_scale_stream_subscribers",
+				Help: "The number of clients connected to the results streaming endpoints",
+			},
+		)
+		streamResyncs = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_stream_resyncs",
+				Help: "The Count of times a slow streaming client fell behind and was resynced with a snapshot",
+			},
+		)
+	case resultsGateway:
+		gatewayReplicaErrors = NewCounter(
+			prometheus.CounterOpts{
+				Name: "kafka_scale_gateway_replica_errors",
+				Help: "The Count of failures by the results gateway to get partial results from a results replica",
+			},
+		)
 	}
 
 	//TestCounterVec = NewCounterVec(
@@ -122,6 +194,7 @@ func initMetrics(command string) {
 
 type Counter interface {
 	Inc()
+	Add(val float64)
 }
 
 type CounterVec interface {
@@ -134,6 +207,7 @@ type Gauge interface {
 
 type GaugeVec interface {
 	With(labels prometheus.Labels) Gauge
+	Reset()
 }
 
 type promCounterVec struct {
@@ -148,6 +222,10 @@ func (cv *promGaugeVec) With(labels prometheus.Labels) Gauge {
 	return cv.vec.With(labels)
 }
 
+func (cv *promGaugeVec) Reset() {
+	cv.vec.Reset()
+}
+
 func (cv *promCounterVec) With(labels prometheus.Labels) Counter {
 	return cv.vec.With(labels)
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Valid values for --output. Table is the fixed-width console output. The others are for scripting: JSON and
+// YAML have the same schema - the field names of the value the command outputs - and CSV has one row per
+// partition (or member, for a group) with a header row. The schemas are documented in the README
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputCSV   = "csv"
+)
+
+// Writes the passed value to stdout as JSON or YAML, or the passed header and rows as CSV, according to the
+// passed output. A nil header writes no header row, for output that continues earlier rows. Returns false if
+// the output is table, in which case nothing is written and the command prints its own table
+func writeOutput(output string, v interface{}, header []string, rows func() [][]string) bool {
+	switch output {
+	case outputJSON:
+		js, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			errorf(output, "error marshaling output, error is: %v\n", err)
+			return true
+		}
+		fmt.Printf("%s\n", js)
+	case outputYAML:
+		// go through JSON so the YAML keys are the same as the JSON keys
+		js, err := json.Marshal(v)
+		if err != nil {
+			errorf(output, "error marshaling output, error is: %v\n", err)
+			return true
+		}
+		var generic interface{}
+		if err := json.Unmarshal(js, &generic); err != nil {
+			errorf(output, "error marshaling output, error is: %v\n", err)
+			return true
+		}
+		ym, err := yaml.Marshal(generic)
+		if err != nil {
+			errorf(output, "error marshaling output, error is: %v\n", err)
+			return true
+		}
+		fmt.Printf("---\n%s", ym)
+	case outputCSV:
+		w := csv.NewWriter(os.Stdout)
+		if header != nil {
+			_ = w.Write(header)
+		}
+		if err := w.WriteAll(rows()); err != nil {
+			errorf(output, "error writing output, error is: %v\n", err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// the exit status of the process. Set by errorf and outputErrorf, and used by main once the command returns
+var exitCode int
+
+// Prints an error the same way as logf - so with machine-readable output it goes to stderr and stdout has only
+// the output - and makes the process exit non-zero
+func errorf(output string, format string, args ...interface{}) {
+	exitCode = 1
+	logf(output, format, args...)
+}
+
+// Prints an error that stops a role to stderr and makes the process exit non-zero once the role returns
+func fatalf(format string, args ...interface{}) {
+	exitCode = 1
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+// Reports an error that is also in the output of the command - e.g. the error of one topic in a list. It makes
+// the process exit non-zero and, with machine-readable output, is printed to stderr so a script doesn't have to
+// look for it in the output. The table already shows it, so it isn't printed again
+func outputErrorf(output string, format string, args ...interface{}) {
+	exitCode = 1
+	if output != outputTable {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+// Prints an informational message. With table output it goes to stdout along with the table. Otherwise it goes
+// to stderr so stdout has only the machine-readable output
+func logf(output string, format string, args ...interface{}) {
+	if output == outputTable {
+		fmt.Printf(format, args...)
+	} else {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+// formats a value for a CSV cell
+func cell(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'f', 1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
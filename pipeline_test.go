@@ -0,0 +1,117 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a gzipped census file with one record for each passed housing code and returns its path. The file is
+// named like a CPS file for January so the reader takes the month from the name
+func writeCensusFile(t *testing.T, codes []int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jan20pub.dat.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	for _, code := range codes {
+		// the housing code is at position 30 of a record
+		if _, err := fmt.Fprintf(gz, "%v%2d%v\n", strings.Repeat("1", 30), code, strings.Repeat("2", 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Runs the read, compute and results roles against the fake broker: the reader chunks a census file to the
+// compute topic, compute writes the results topic, and the results role accumulates the results. Checks the
+// results and the reconciliation against the file, and the offsets the results were accumulated from against
+// the offsets committed by the results consumer group
+func TestPipeline(t *testing.T) {
+	_, brokers := startTestBroker(t)
+	var codes []int
+	want := map[int]int{}
+	for i := 0; i < 95; i++ {
+		code := i % 13
+		codes = append(codes, code)
+		want[code]++
+	}
+	// an invalid code is rejected by the results role, but still reconciles
+	codes = append(codes, 99, 99)
+	file := writeCensusFile(t, codes)
+	aggregator.Restore(newAggregateState())
+	defer aggregator.Restore(newAggregateState())
+
+	runCmd(t, func() {
+		readCmd(brokers, TopicSpec{Topic: compute_topic, Partitions: 3, ReplicationFactor: 1}, onDriftFail, file, -1,
+			[]int{2020}, nil, writeToKafka, "", false, 0)
+	})
+
+	sink, err := newSink(writeToKafka, "", brokers, TopicSpec{Topic: results_topic, Partitions: 2, ReplicationFactor: 1}, onDriftFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := newKafkaReader(brokers, compute_topic)
+	computed := make(chan struct{})
+	go func() {
+		defer close(computed)
+		calc(sink, chunks, false, 0)
+	}()
+	resultsReader := newKafkaReader(brokers, results_topic)
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		consumeResults(resultsReader, false, 0)
+	}()
+
+	var report []SourceReconciliation
+	waitFor(t, 60*time.Second, "the source to reconcile", func() bool {
+		report = reconcileReport(aggregator.Snapshot().Reconciliation)
+		return len(report) == 1 && report[0].Status == statusOK
+	})
+	chunks.Close()
+	resultsReader.Close()
+	<-computed
+	<-consumed
+	sink.Close()
+
+	r := report[0]
+	if r.Source != "jan20pub.dat.gz" || r.Period != "2020-01" || r.Expected != len(codes) || r.Records != len(codes) ||
+		r.Accepted != 95 || r.Rejected != 2 || r.Missing != 0 {
+		t.Errorf("got reconciliation: %+v", r)
+	}
+	state := aggregator.Snapshot()
+	for code, count := range want {
+		if got := state.Results["2020-01"][code].Count; got != count {
+			t.Errorf("got count %v for code %v, want %v", got, code, count)
+		}
+	}
+	expected, err := expectedSegments(brokers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings := checkSegments(state.Segments, expected); len(warnings) != 0 {
+		t.Errorf("got offset warnings: %v", warnings)
+	}
+
+	// everything written was consumed
+	for _, topic := range []string{compute_topic, results_topic} {
+		lag, err := getLag(kafkaOffsets(brokers), topic, consumerGrpForTopic[topic], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lag.TotalLag != 0 {
+			t.Errorf("got lag %v on topic %v, want 0", lag.TotalLag, topic)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// valid values for --format of the produce command. Lines: each line is the value of one message. NDJSON:
+// each line is a JSON object like {"key": "k", "value": "v", "headers": {"kind": "chunk"}}
+const (
+	formatLines  = "lines"
+	formatNDJSON = "ndjson"
+)
+
+// one line of NDJSON input to the produce command. If the key is empty the message is keyed like the app
+// keys its own messages
+type ProduceRecord struct {
+	Key     string            `json:"key"`
+	Value   string            `json:"value"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Writes messages read from the passed file - or stdin if the file is empty or '-' - to the passed topic.
+// Each message is written and acknowledged by all in-sync replicas before the next is read, so a failed
+// message is reported with its line number and the messages after it are still written
+func produceCmd(kafkaBrokers string, topic string, input string, format string, verbose bool) {
+	var rdr io.Reader = os.Stdin
+	if input != "" && input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			fmt.Printf("error opening file: %v, error is: %v\n", input, err)
+			return
+		}
+		defer f.Close()
+		rdr = f
+	}
+	writer := newKafkaWriter(kafkaBrokers, topic)
+	// the app's writers don't wait for acks, but without acks there would be no delivery errors to report
+	writer.RequiredAcks = kafka.RequireAll
+	defer writer.Close()
+
+	scanner := bufio.NewScanner(rdr)
+	// chunks are about 10 census records, so allow for lines much longer than the default max
+	scanner.Buffer(make([]byte, 64*1024), 10e6)
+	lineNum, written, failed := 0, 0, 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		m, err := parseProduceLine(line, format)
+		if err != nil {
+			fmt.Printf("line %v: error parsing message, error is: %v\n", lineNum, err)
+			failed++
+			continue
+		}
+		if verbose {
+			fmt.Printf("line %v: writing message with key %v to topic %v\n", lineNum, string(m.Key), topic)
+		}
+		if err := writer.WriteMessages(context.Background(), m); err != nil {
+			fmt.Printf("line %v: error writing message, error is: %v\n", lineNum, err)
+			failed++
+			continue
+		}
+		written++
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("error reading input after line %v, error is: %v\n", lineNum, err)
+	}
+	fmt.Printf("%v messages written to topic %v, %v failed\n", written, topic, failed)
+}
+
+// parses one line of input to the produce command into a message
+func parseProduceLine(line string, format string) (kafka.Message, error) {
+	record := ProduceRecord{Value: line}
+	if format == formatNDJSON {
+		record = ProduceRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return kafka.Message{}, err
+		}
+	}
+	if record.Key == "" {
+		record.Key = messageKey(record.Value)
+	}
+	m := kafka.Message{Key: []byte(record.Key), Value: []byte(record.Value)}
+	keys := make([]string, 0, len(record.Headers))
+	for k := range record.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.Headers = append(m.Headers, kafka.Header{Key: k, Value: []byte(record.Headers[k])})
+	}
+	return m, nil
+}
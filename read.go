@@ -3,10 +3,13 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -28,18 +31,15 @@ const gzurl = "https://www2.census.gov/programs-surveys/cps/datasets/%v/basic/%v
 // In both scenarios, returns the number of chunks processed and true if success, else false if error. Also,
 // supports throttling via the package-level 'chunkCount' variable initialized from the command line.
 
-func readCmd(kafkaBrokers string, partitionCnt int, replicationFactor int, fromFile string, chunkCount int,
-	yearsArr []int, monthsArr []string, writeTo string, verbose bool, delay int) {
-	var writer *kafka.Writer
-	if kafkaBrokers != "" {
-		if err := createTopicIfNotExists(kafkaBrokers, compute_topic, partitionCnt, replicationFactor); err != nil {
-			fmt.Printf("error creating topic %v, error is:%v\n", compute_topic, err)
-			return
-		}
-		writer = newKafkaWriter(kafkaBrokers, compute_topic)
-		defer writer.Close()
+func readCmd(kafkaBrokers string, spec TopicSpec, onDrift string, fromFile string, chunkCount int,
+	yearsArr []int, monthsArr []string, writeTo string, writeFile string, verbose bool, delay int) {
+	sink, err := newSink(writeTo, writeFile, kafkaBrokers, spec, onDrift)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
 	}
-	if chunks, ok := readAndChunk(writer, fromFile, chunkCount, yearsArr, monthsArr, writeTo, verbose, delay); !ok {
+	defer sink.Close()
+	if chunks, ok := readAndChunk(sink, fromFile, chunkCount, yearsArr, monthsArr, verbose, delay); !ok {
 		fmt.Printf("error processing census data. %v chunks were processed before stopping\n", chunks)
 	} else {
 		fmt.Printf("no errors were encountered processing census data. %v chunks were processed\n", chunks)
@@ -47,17 +47,17 @@ func readCmd(kafkaBrokers string, partitionCnt int, replicationFactor int, fromF
 }
 
 // reads from the passed file if not "" or builds census data urls to read from. Either way, reads the gzip
-// and writes to the passed writer
-func readAndChunk(writer *kafka.Writer, fromFile string, chunkCount int, yearsArr []int, monthsArr []string, writeTo string,
+// and writes to the passed sink
+func readAndChunk(sink MessageSink, fromFile string, chunkCount int, yearsArr []int, monthsArr []string,
 	verbose bool, delay int) (int, bool) {
 	chunks := 0
 	var ok bool
 	if fromFile != "" {
-		return oneGz(writer, chunkCount, chunks, fromFile, yearsArr[0], writeTo, verbose, delay)
+		return oneGz(sink, chunkCount, chunks, fromFile, yearsArr[0], monthForFile(fromFile, monthsArr), verbose, delay)
 	}
 	for _, year := range yearsArr {
 		for _, month := range monthsArr {
-			if chunks, ok = oneGz(writer, chunkCount, chunks, fmt.Sprintf(gzurl, year, month, strconv.Itoa(year)[2:]), year, writeTo, verbose, delay); !ok {
+			if chunks, ok = oneGz(sink, chunkCount, chunks, fmt.Sprintf(gzurl, year, month, strconv.Itoa(year)[2:]), year, monthNumber(month), verbose, delay); !ok {
 				// don't stop - just keep getting data if possible and ignore errors
 				continue
 			} else if chunkCount >= 0 && chunks >= chunkCount {
@@ -68,87 +68,156 @@ func readAndChunk(writer *kafka.Writer, fromFile string, chunkCount int, yearsAr
 	return chunks, true
 }
 
+// Determines the month of a census file being read via --from-file. If exactly one month was specified
+// with --months, then that is the month. Otherwise the month is taken from the census file naming
+// convention - e.g. dec20pub.dat.gz is December. If neither works, returns zero which means 'unknown'
+func monthForFile(fromFile string, monthsArr []string) int {
+	if len(monthsArr) == 1 {
+		return monthNumber(monthsArr[0])
+	}
+	base := filepath.Base(fromFile)
+	if len(base) >= 3 {
+		return monthNumber(strings.ToLower(base[:3]))
+	}
+	return 0
+}
+
 // Processes one census gzip dataset. Can take either a file (mostly for testing), or an http URL to the census
-// site. Either way streams the GZIP, chunks the output to Kafka, or to stdout, or doesn't chunk depending on
-// the command line. If chunking, each 10 lines of input is concatenated into a chunk and written to the
-// compute topic in Kafka. The first line is the year. (Can also chunk to the console if the package-level
-// 'stdout' var is set to true from the command line.)
+// site. Either way streams the GZIP and chunks the output to the passed sink - the compute topic in Kafka, or
+// the console, a file or nowhere depending on the command line. Each 10 lines of input is concatenated into a
+// chunk. The first line is the period - the year and month - like 2019-01. Whether the gzip is processed
+// successfully or not, a summary of the source is written after it for reconciliation.
 //
 // Returns the cumulative number of chunks processed so far (including chunks from prior calls) and true if success,
 // else false if error. Returns if package var 'chunkCount' count is met.
-func oneGz(writer *kafka.Writer, chunkCount int, chunks int, url string, year int, writeTo string, verbose bool, delay int) (int, bool) {
+func oneGz(sink MessageSink, chunkCount int, chunks int, url string, year int, month int, verbose bool, delay int) (int, bool) {
 	var rdr io.Reader
 	var err error
 
 	fmt.Printf("oneGz processing url %v with current value of chunks: %v\n", url, chunks)
 
+	summary := SourceSummary{Source: path.Base(url), Period: Period{year, month}.String()}
+	defer func() {
+		if summary.Error != "" {
+			sourceErrors.Inc()
+		}
+		writeSummary(sink, summary, verbose)
+	}()
+
 	if strings.HasPrefix(url, "http") {
 		fmt.Printf("Getting gzip: %v\n", url)
 		resp, err := http.Get(url)
 		if err != nil {
 			fmt.Printf("error getting gzip: %v, error is: %v\n", url, err)
+			summary.Error = err.Error()
 			return chunks, false
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != 200 {
 			fmt.Printf("error getting gzip: %v, status code is: %v\n", url, resp.StatusCode)
+			summary.Error = fmt.Sprintf("status code %v", resp.StatusCode)
 			return chunks, false
 		}
 		rdr, err = gzip.NewReader(resp.Body)
 		if err != nil {
 			fmt.Printf("error creating gzip reader over url: %v, error is: %v\n", url, err)
+			summary.Error = err.Error()
 			return chunks, false
 		}
 		downloadedGZips.Inc()
 	} else {
-		rdr, err = os.Open(url)
+		var f *os.File
+		f, err = os.Open(url)
 		if err != nil {
 			fmt.Printf("error opening file: %v, error is: %v\n", url, err)
+			summary.Error = err.Error()
 			return chunks, false
 		}
-		rdr, err = gzip.NewReader(rdr)
+		defer f.Close()
+		rdr, err = gzip.NewReader(f)
 		if err != nil {
 			fmt.Printf("error creating gzip reader over filesystem object: %v, error is: %v\n", url, err)
+			summary.Error = err.Error()
 			return chunks, false
 		}
 	}
-	return doChunk(writer, chunkCount, chunks, year, writeTo, verbose, rdr, delay)
+	return doChunk(sink, chunkCount, chunks, &summary, verbose, rdr, delay)
 }
 
-// Reads the passed reader until it provides no more data. Creates chunks and writes the chunks to Kafka or
-// stdout or null depending on the 'writeTo' arg
-func doChunk(writer *kafka.Writer, chunkCount int, chunks int, year int, writeTo string, verbose bool, rdr io.Reader, delay int) (int, bool) {
+// Reads the passed reader until it provides no more data. Creates chunks and writes the chunks to the passed
+// sink. Each chunk carries the source and the number of census
+// lines in the chunk as headers, and the line and chunk counts are accumulated in the passed summary. A
+// final chunk of fewer than ten lines is written at the end of the data so every line read is chunked
+func doChunk(sink MessageSink, chunkCount int, chunks int, summary *SourceSummary, verbose bool, rdr io.Reader, delay int) (int, bool) {
 	scanner := bufio.NewScanner(rdr)
-	// insert a line as the first line of each chunk - the entire contents of the line is the value of the year
-	// e.g. "2019\n"
-	chunk := strconv.Itoa(year) + "\n"
+	// insert a line as the first line of each chunk - the entire contents of the line is the period of
+	// the census file e.g. "2019-01\n"
+	chunk := summary.Period + "\n"
 	cnt := 0
+	flush := func() bool {
+		if verbose {
+			fmt.Printf("chunk: %v\n", chunk)
+		}
+		if err := writeMessage(sink, chunk, verbose, recordHeaders(kindChunk, summary.Source, cnt)...); err != nil {
+			summary.Error = err.Error()
+			return false
+		}
+		chunksWritten.Inc()
+		summary.LinesChunked += cnt
+		summary.Chunks++
+		chunks++
+		return true
+	}
 	for scanner.Scan() {
 		line := scanner.Text()
 		chunk += line + "\n"
 		cnt++
+		summary.LinesRead++
+		linesRead.Inc()
 		// chunk every ten lines
 		if cnt >= 10 {
-			if verbose || (writeTo == writeToStdout) {
-				fmt.Printf("chunk: %v\n", chunk)
+			if !flush() {
+				return chunks, false
 			}
-			if writeTo == writeToKafka {
-				if err := writeMessage(writer, chunk, verbose); err != nil {
-					return chunks, false
-				}
-				chunksWritten.Inc()
-			}
-			chunks++
 			if chunkCount >= 0 && chunks >= chunkCount {
 				fmt.Printf("chunk count met: %v. Stopping\n", chunks)
 				return chunks, true
 			}
-			chunk = strconv.Itoa(year) + "\n"
+			chunk = summary.Period + "\n"
 			cnt = 0
 			if delay > 0 {
 				time.Sleep(time.Duration(delay) * time.Millisecond)
 			}
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("error reading source: %v, error is: %v\n", summary.Source, err)
+		summary.Error = err.Error()
+		return chunks, false
+	}
+	if cnt > 0 && !flush() {
+		return chunks, false
+	}
+	summary.Complete = true
 	return chunks, true
 }
+
+// writes the summary of one census source to the passed sink - e.g. the compute topic, from where it is
+// forwarded to the results role for reconciliation
+func writeSummary(sink MessageSink, summary SourceSummary, verbose bool) {
+	if verbose {
+		printSummary(summary)
+	}
+	js, err := json.Marshal(summary)
+	if err != nil {
+		fmt.Printf("error marshaling source summary, error is: %v\n", err)
+		return
+	}
+	headers := []kafka.Header{
+		{Key: headerKind, Value: []byte(kindSummary)},
+		{Key: headerSource, Value: []byte(summary.Source)},
+	}
+	if err := writeMessage(sink, string(js), verbose, headers...); err != nil {
+		fmt.Printf("error writing summary for source: %v, error is: %v\n", summary.Source, err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka message headers that carry record counts through the pipeline so the results role can reconcile
+// what each census source produced against what was counted. Chunks and results carry the source and the
+// number of census records in the chunk. After the reader finishes a source it writes a summary message
+// with the totals for the source. The compute role forwards summaries to the results topic unchanged
+const (
+	headerKind    = "kind"
+	headerSource  = "source"
+	headerRecords = "records"
+
+	kindChunk   = "chunk"
+	kindResult  = "result"
+	kindSummary = "summary"
+
+	// the source of messages that don't carry a source header
+	unknownSource = "unknown"
+
+	// reconciliation statuses: no summary yet from the reader, all records accounted for, records
+	// missing or duplicated (which could just mean they are still in flight), or the reader failed
+	statusPending     = "pending"
+	statusOK          = "ok"
+	statusMismatch    = "mismatch"
+	statusSourceError = "source-error"
+)
+
+// What the reader writes after it finishes - or fails - reading one census source. LinesRead is the count
+// of lines read from the gzip. LinesChunked is the count of those lines written in chunks. They differ if
+// a chunk write fails or if the --chunks limit stopped the reader. Complete is true if the source was read
+// to the end without error
+type SourceSummary struct {
+	Source       string
+	Period       string
+	LinesRead    int
+	LinesChunked int
+	Chunks       int
+	Complete     bool
+	Error        string `json:",omitempty"`
+}
+
+// Raw counts accumulated by the results role for one source. Records is the sum of the records headers of
+// the results messages - i.e. the records that were in the chunks the results were computed from. Accepted
+// and Rejected are the valid and invalid codes in those results messages. Counts from multiple results
+// replicas can simply be summed
+type SourceCounts struct {
+	Summary        *SourceSummary `json:",omitempty"`
+	ResultMessages int
+	Records        int
+	Accepted       int
+	Rejected       int
+}
+
+// One line of the reconciliation report. Expected is the lines the reader chunked. Missing is expected
+// minus the records that reached the results role - positive if records are in flight or lost, negative if
+// records were counted more than once. Dropped is the records that reached the compute role but produced
+// no code
+type SourceReconciliation struct {
+	Source         string
+	Period         string
+	Status         string
+	Error          string `json:",omitempty"`
+	LinesRead      int
+	Expected       int
+	Chunks         int
+	ResultMessages int
+	Records        int
+	Accepted       int
+	Rejected       int
+	Missing        int
+	Dropped        int
+}
+
+// returns the value of the named header of the passed message or the empty string
+func headerValue(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// returns the headers for a chunk or result message
+func recordHeaders(kind string, source string, records int) []kafka.Header {
+	return []kafka.Header{
+		{Key: headerKind, Value: []byte(kind)},
+		{Key: headerSource, Value: []byte(source)},
+		{Key: headerRecords, Value: []byte(strconv.Itoa(records))},
+	}
+}
+
+// returns the counts for the passed source from the passed map, creating them if needed
+func sourceCounts(counts map[string]*SourceCounts, source string) *SourceCounts {
+	if source == "" {
+		source = unknownSource
+	}
+	c, ok := counts[source]
+	if !ok {
+		c = &SourceCounts{}
+		counts[source] = c
+	}
+	return c
+}
+
+// sets the mismatch gauge for the passed source
+func updateReconcileMetrics(source string, c SourceCounts) {
+	r := reconcileSource(source, c)
+	mismatch := 0
+	if r.Status == statusMismatch {
+		mismatch = abs(r.Missing) + r.Dropped
+	}
+	reconcileMismatch.With(prometheus.Labels{"source": source}).Set(float64(mismatch))
+}
+
+// builds the reconciliation report line for one source
+func reconcileSource(source string, c SourceCounts) SourceReconciliation {
+	r := SourceReconciliation{
+		Source:         source,
+		Status:         statusPending,
+		ResultMessages: c.ResultMessages,
+		Records:        c.Records,
+		Accepted:       c.Accepted,
+		Rejected:       c.Rejected,
+		Dropped:        c.Records - c.Accepted - c.Rejected,
+	}
+	if c.Summary != nil {
+		r.Period = c.Summary.Period
+		r.Error = c.Summary.Error
+		r.LinesRead = c.Summary.LinesRead
+		r.Expected = c.Summary.LinesChunked
+		r.Chunks = c.Summary.Chunks
+		r.Missing = r.Expected - c.Records
+		if r.Error != "" {
+			r.Status = statusSourceError
+		} else if r.Missing != 0 || r.Dropped != 0 {
+			r.Status = statusMismatch
+		} else {
+			r.Status = statusOK
+		}
+	}
+	return r
+}
+
+// builds the reconciliation report for all sources, sorted by source
+func reconcileReport(counts map[string]*SourceCounts) []SourceReconciliation {
+	report := []SourceReconciliation{}
+	for source, c := range counts {
+		report = append(report, reconcileSource(source, *c))
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Source < report[j].Source })
+	return report
+}
+
+// adds the counts in src into dst. A source summary is written once by the reader so only one replica
+// will have it. Nothing in src is referenced by dst afterwards
+func mergeSourceCounts(dst map[string]*SourceCounts, src map[string]*SourceCounts) {
+	for source, c := range src {
+		d, ok := dst[source]
+		if !ok {
+			d = &SourceCounts{}
+			dst[source] = d
+		}
+		if c.Summary != nil {
+			summary := *c.Summary
+			d.Summary = &summary
+		}
+		d.ResultMessages += c.ResultMessages
+		d.Records += c.Records
+		d.Accepted += c.Accepted
+		d.Rejected += c.Rejected
+	}
+}
+
+// provides a JSON response of the reconciliation report
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, reconcileReport(aggregator.Snapshot().Reconciliation))
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// prints a source summary to the console
+func printSummary(summary SourceSummary) {
+	fmt.Printf("source summary: %v lines read: %v lines chunked: %v chunks: %v complete: %v error: %v\n",
+		summary.Source, summary.LinesRead, summary.LinesChunked, summary.Chunks, summary.Complete, summary.Error)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// the values of --to other than a timestamp
+const (
+	resetToEarliest = "earliest"
+	resetToLatest   = "latest"
+)
+
+// how a reset of one partition would move the committed offset of the group. Committed is -1 if the group
+// has never committed an offset for the partition. Target is always between Earliest and Latest
+type OffsetReset struct {
+	Partition int
+	Committed int64
+	Target    int64
+	Earliest  int64
+	Latest    int64
+}
+
+// What the resetoffsets command reports: the planned resets, the active members of the group, and whether
+// the new offsets were committed
+type ResetReport struct {
+	Group         string
+	Topic         string
+	Resets        []OffsetReset
+	ActiveMembers []string
+	Committed     bool
+	Error         string `json:",omitempty"`
+}
+
+// Resets the committed offsets of the passed consumer group on the passed topic. Exactly one of 'to' (earliest,
+// latest or an RFC3339 timestamp), 'shiftBy' (a positive or negative number of messages from the committed offset)
+// or 'explicit' (comma-separated partition:offset pairs) says where to reset to. If the group is empty, the group
+// the app uses for the topic is reset. Without execute, the resets are only previewed. The reset is refused if
+// the group has active members - whose commits would overwrite the reset - unless force is true. With
+// machine-readable output the report is written once the command is done and the messages go to stderr
+func resetOffsetsCmd(kafkaBrokers string, topic string, group string, to string, shiftBy int64, explicit string, execute bool, force bool, output string) {
+	if group == "" {
+		group = consumerGrpForTopic[topic]
+	}
+	resets, err := planOffsetResets(kafkaBrokers, topic, group, to, shiftBy, explicit)
+	if err != nil {
+		errorf(output, "%v\n", err)
+		return
+	}
+	report := ResetReport{Group: group, Topic: topic, Resets: resets}
+	defer outputResetReport(&report, output)
+	if output == outputTable {
+		fmt.Printf("Offset resets for group: %v on topic: %v\n\n", group, topic)
+		format := "%-12v%-20v%-20v%-20v%-20v\n"
+		fmt.Printf(format, "Partition", "CommittedOffset", "NewOffset", "EarliestOffset", "LatestOffset")
+		for _, r := range resets {
+			fmt.Printf(format, r.Partition, r.Committed, r.Target, r.Earliest, r.Latest)
+		}
+		fmt.Printf("\n")
+	}
+
+	members, err := groupMembers(kafkaBrokers, group)
+	if err != nil {
+		report.Error = err.Error()
+		errorf(output, "%v\n", err)
+		return
+	}
+	report.ActiveMembers = members
+	if len(members) != 0 {
+		logf(output, "group %v has active members: %v\n", group, strings.Join(members, ","))
+		if !force {
+			msg := "Stop the members first - they would overwrite the reset with their own commits - or specify --force\n"
+			if execute {
+				// the reset was asked for and refused
+				errorf(output, "%v", msg)
+			} else {
+				logf(output, "%v", msg)
+			}
+			return
+		}
+	}
+	if !execute {
+		logf(output, "Dry run - no offsets were changed. Specify --execute to commit the new offsets\n")
+		return
+	}
+	if err := commitOffsets(kafkaBrokers, topic, group, resets); err != nil {
+		report.Error = err.Error()
+		errorf(output, "error committing offsets for group: %v, error is: %v\n", group, err)
+		return
+	}
+	report.Committed = true
+	logf(output, "Committed the new offsets for group: %v on topic: %v\n", group, topic)
+}
+
+// writes a reset report in the passed machine-readable output format. CSV has one row per partition
+func outputResetReport(report *ResetReport, output string) {
+	writeOutput(output, report, []string{"group", "topic", "partition", "committed", "target", "earliest", "latest", "executed"}, func() [][]string {
+		var rows [][]string
+		for _, r := range report.Resets {
+			rows = append(rows, []string{report.Group, report.Topic, cell(r.Partition), cell(r.Committed), cell(r.Target),
+				cell(r.Earliest), cell(r.Latest), cell(report.Committed)})
+		}
+		return rows
+	})
+}
+
+// works out the new offset of each affected partition, sorted by partition ID asc
+func planOffsetResets(kafkaBrokers string, topic string, group string, to string, shiftBy int64, explicit string) ([]OffsetReset, error) {
+	current, err := getTopicOffsets(kafkaBrokers, topic, group)
+	if err != nil {
+		return nil, err
+	}
+	var partitions []int
+	for _, o := range current {
+		partitions = append(partitions, o.Partition)
+	}
+	client, shutdown := newClient(kafkaBrokers)
+	defer shutdown()
+	first, err := listOffsets(client, topic, partitions, kafka.FirstOffsetOf)
+	if err != nil {
+		return nil, err
+	}
+
+	// the target for each partition before it is clamped between the earliest and latest offsets
+	targets := map[int]int64{}
+	switch {
+	case explicit != "":
+		if targets, err = parsePartitionOffsets(explicit); err != nil {
+			return nil, err
+		}
+		for partition := range targets {
+			if _, ok := first[partition]; !ok {
+				return nil, fmt.Errorf("topic %v has no partition %v", topic, partition)
+			}
+		}
+	case to == resetToEarliest:
+		for _, o := range current {
+			targets[o.Partition] = first[o.Partition].FirstOffset
+		}
+	case to == resetToLatest:
+		for _, o := range current {
+			targets[o.Partition] = o.Last
+		}
+	case to != "":
+		at, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --to: %v. Valid values are %v, %v or an RFC3339 timestamp like 2021-03-01T15:04:05Z", to, resetToEarliest, resetToLatest)
+		}
+		byTime, err := listOffsets(client, topic, partitions, func(partition int) kafka.OffsetRequest {
+			return kafka.TimeOffsetOf(partition, at)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range current {
+			// the broker returns the first offset whose timestamp is at or after the time, or -1 if there
+			// is none - in which case every message is older, so the reset is to the end of the partition
+			targets[o.Partition] = o.Last
+			for offset := range byTime[o.Partition].Offsets {
+				if offset >= 0 {
+					targets[o.Partition] = offset
+				}
+			}
+		}
+	default:
+		for _, o := range current {
+			base := o.Committed
+			if base < 0 {
+				// the group never committed - it would start at the beginning
+				base = first[o.Partition].FirstOffset
+			}
+			targets[o.Partition] = base + shiftBy
+		}
+	}
+
+	var resets []OffsetReset
+	for _, o := range current {
+		target, ok := targets[o.Partition]
+		if !ok {
+			continue
+		}
+		r := OffsetReset{Partition: o.Partition, Committed: o.Committed, Earliest: first[o.Partition].FirstOffset, Latest: o.Last}
+		r.Target = target
+		if r.Target < r.Earliest {
+			r.Target = r.Earliest
+		} else if r.Target > r.Latest {
+			r.Target = r.Latest
+		}
+		resets = append(resets, r)
+	}
+	sort.Slice(resets, func(i, j int) bool { return resets[i].Partition < resets[j].Partition })
+	return resets, nil
+}
+
+// parses comma-separated partition:offset pairs like 0:100,1:250
+func parsePartitionOffsets(s string) (map[int]int64, error) {
+	offsets := map[int]int64{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid partition:offset pair: %v", pair)
+		}
+		partition, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition in: %v", pair)
+		}
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset in: %v", pair)
+		}
+		offsets[partition] = offset
+	}
+	return offsets, nil
+}
+
+// returns the client IDs of the active members of the passed group
+func groupMembers(kafkaBrokers string, group string) ([]string, error) {
+	d, err := describeGroup(kafkaBrokers, group, "")
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, m := range d.Members {
+		members = append(members, m.ClientID)
+	}
+	return members, nil
+}
+
+// Commits the passed offsets for the passed group. Offsets can only be committed by a member of the group,
+// so this joins the group, commits as part of the generation it was given, and leaves the group
+func commitOffsets(kafkaBrokers string, topic string, group string, resets []OffsetReset) error {
+	cg, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:      group,
+		Brokers: brokerList(kafkaBrokers),
+		Topics:  []string{topic},
+		Dialer:  newDialer(),
+	})
+	if err != nil {
+		return err
+	}
+	defer cg.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	gen, err := cg.Next(ctx)
+	if err != nil {
+		return err
+	}
+	offsets := map[int]int64{}
+	for _, r := range resets {
+		offsets[r.Partition] = r.Target
+	}
+	return gen.CommitOffsets(map[string]map[int]int64{topic: offsets})
+}
@@ -4,89 +4,253 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/segmentio/kafka-go"
 )
 
-// synchronize access to the in-mem results struct since it can be updated and requested
-// via separate goroutines
-var mu sync.Mutex
-
 // says how many of a given housing type was accumulated
 type HousingResult struct {
 	Description string
 	Count       int
 }
 
-// HousingResults is a map. The key is a year. For each year, there is a map. The key of that nested
-// map is a housing code (int) and the value of the sub-map is the description and count for that housing code
-// accumulated from the Kafka results topic
-var HousingResults = map[int]map[int]HousingResult{}
+// The results are a map. The key is a period - a year and month like 2019-01. For each period, there is a
+// map. The key of that nested map is a housing code (int) and the value of the sub-map is the description and
+// count for that housing code accumulated from the Kafka results topic. The results are accumulated by the
+// Aggregator in aggregator.go
+
+// The time period that a census file - and so every chunk and result derived from it - covers. Each CPS
+// file is one month. Month zero means the month is unknown. That is the case for results messages that
+// carry only a year (written before the month was carried through the pipeline) and for files read via
+// --from-file whose month couldn't be determined
+type Period struct {
+	Year  int
+	Month int
+}
+
+// formats the period as yyyy-mm. This is how the period is carried in chunks and results messages,
+// and how the results are keyed
+func (p Period) String() string {
+	return fmt.Sprintf("%04d-%02d", p.Year, p.Month)
+}
+
+// parses yyyy-mm, or just yyyy which is month zero
+func parsePeriod(s string) (Period, error) {
+	var p Period
+	var err error
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	if p.Year, err = strconv.Atoi(parts[0]); err != nil {
+		return p, fmt.Errorf("invalid period year: %v", s)
+	}
+	if len(parts) == 2 {
+		if p.Month, err = strconv.Atoi(parts[1]); err != nil || p.Month < 0 || p.Month > 12 {
+			return p, fmt.Errorf("invalid period month: %v", s)
+		}
+	}
+	return p, nil
+}
+
+// valid values for the 'rollup' query param of the results endpoints. The default is month
+const (
+	rollupMonth = "month"
+	rollupYear  = "year"
+)
+
+// Returns the passed results rolled up as requested. Rolling up by month returns the results as is. Rolling
+// up by year sums the months of each year into a new map keyed by year, like "2019"
+func rollup(results map[string]map[int]HousingResult, by string) (map[string]map[int]HousingResult, error) {
+	switch by {
+	case "", rollupMonth:
+		return results, nil
+	case rollupYear:
+		years := map[string]map[int]HousingResult{}
+		for key, codes := range results {
+			p, err := parsePeriod(key)
+			if err != nil {
+				return nil, err
+			}
+			mergeHousingResults(years, map[string]map[int]HousingResult{strconv.Itoa(p.Year): codes})
+		}
+		return years, nil
+	}
+	return nil, fmt.Errorf("unknown rollup: %v. Valid values are %v and %v", by, rollupMonth, rollupYear)
+}
+
+// A contiguous range of offsets [First, Next) from one partition of the results topic that were applied
+// to the results by this replica
+type OffsetSegment struct {
+	First int64
+	Next  int64
+}
+
+// What one results replica exposes to the results gateway: the state it accumulated, including the
+// offsets it accumulated the results from
+type ResultsPartial struct {
+	Replica string
+	AggregateState
+}
 
 // Reads from the 'results' topic indefinitely, blocking until a result is available. Each result message
-// is a comma-separated list of housing codes like: nnnn:1,1,1,6,5,1,4,1,1,1,12 etc. where nnnn is a year, and
-// the values are housing codes. The function splits the message into its codes, and the for each code, increments
-// the count of the `housingResult` item in the `housingResults' map whose entry is identified by the code. Invalid
-// codes are simply ignored. Modifications to the `housingResults' variable are guarded by a mutex since this data
-// is also available for consumption via a REST endpoint.
-func resultsCmd(kafkaBrokers string, resultsPort int, verbose bool, delay int) {
-	go serveResults(resultsPort)
-	r := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:       strings.Split(kafkaBrokers, ","),
-		GroupID:       consumerGrpForTopic[results_topic],
-		Topic:         results_topic,
-		QueueCapacity: 1,
-		MinBytes:      10e3, // 10KB
-		MaxBytes:      10e6, // 10MB
-	})
+// is a comma-separated list of housing codes like: yyyy-mm:1,1,1,6,5,1,4,1,1,1,12 etc. where yyyy-mm is a period,
+// and the values are housing codes. The function parses each message and applies it to the aggregator, which
+// increments the count of each code for the period. Invalid codes and messages with an invalid period are not
+// counted in the results, but invalid codes are counted by source in the reconciliation report. Source summaries
+// forwarded from the reader are also recorded there. The aggregator is safe for concurrent use, and the REST
+// endpoints only ever see copies of its state.
+//
+// Multiple replicas can run in the same consumer group, each consuming a disjoint set of partitions and
+// serving its partial results to the 'results-gateway' role for merging. ReadMessage commits the offset
+// of a message before returning it, and a commit from a member whose generation has ended fails. So a
+// message is only applied by a replica that still owns the partition, and a replica that takes over a
+// partition in a rebalance starts after the last message applied by the prior owner. This means the
+// partials never overlap and can simply be summed. (For this reason the reader must not be configured
+// with a CommitInterval, which would make commits asynchronous.)
+//
+// If a snapshot file is configured, the results are restored from it before reading the results topic,
+// and written to it every snapshotSecs seconds, and on demand via the admin routes.
+//
+// With --read-from=file the results are read from a file instead of the results topic, and stay served
+// after the end of the file.
+func resultsCmd(kafkaBrokers string, readFrom string, readFile string, resultsPort int, verbose bool, delay int, snapshotFile string,
+	snapshotSecs int, adminToken string) {
+	offsets := kafkaOffsets(kafkaBrokers)
+	go serveResults(offsets, resultsPort, adminToken, snapshotFile)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := startSnapshots(ctx, snapshotFile, snapshotSecs); err != nil {
+		fatalf("error restoring snapshot - not reading topic %v, error is: %v\n", results_topic, err)
+		return
+	}
+	r, err := newSource(readFrom, readFile, kafkaBrokers, results_topic)
+	if err != nil {
+		fatalf("%v\n", err)
+		return
+	}
 	defer r.Close()
+	if kr, ok := r.(*kafka.Reader); ok {
+		monitorConsumer(ctx, kafkaBrokers, kr, consumerGrpForTopic[results_topic])
+		if len(aggregator.Snapshot().Segments) == 0 {
+			// nothing was restored, so the results start from the committed offsets - as after a reset
+			aggregator.Reset(committedOffsets(offsets))
+		}
+	}
+	consumeResults(r, verbose, delay)
+	// keep serving the results
+	select {}
+}
+
+// how long consumeResults waits after the first of a run of read errors. Doubled on each error
+// in the run up to maxReadBackoff
+const minReadBackoff = 100 * time.Millisecond
+const maxReadBackoff = 10 * time.Second
 
+// Reads the passed source and applies each message to the aggregator. Blocks until the source has no more
+// messages - which for Kafka is never. A read error is logged and retried with a backoff
+func consumeResults(r MessageSource, verbose bool, delay int) {
 	if verbose {
 		fmt.Printf("beginning read message from topic: %v\n", results_topic)
 	}
+	backoff := minReadBackoff
 	for {
+		// blocks while consumption is paused via the admin routes
+		gate.wait()
 		// ReadMessage blocks
 		m, err := r.ReadMessage(context.Background())
+		if err == io.EOF {
+			fmt.Printf("no more messages from topic %v\n", results_topic)
+			return
+		}
+		if err != nil {
+			fmt.Printf("error reading message from topic %v - retrying in %v, error is: %v\n", results_topic, backoff, err)
+			resultReadErrors.Inc()
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxReadBackoff {
+				backoff = maxReadBackoff
+			}
+			continue
+		}
+		backoff = minReadBackoff
 		if verbose {
 			fmt.Printf("read message from topic %v - message: %v\n", results_topic, string(m.Value))
 		}
 		resultMessagesRead.Inc()
-		if err == nil {
-			messageParts := strings.Split(string(m.Value), ":")
-			year, _ := strconv.Atoi(messageParts[0])
-			var housingResult map[int]HousingResult
-			var ok = false
-			if housingResult, ok = HousingResults[year]; !ok {
-				housingResult = newHousingResults(year)
-			}
-			for _, codeStr := range strings.Split(string(messageParts[1]), ",") {
-				if code, err := strconv.Atoi(codeStr); err == nil {
-					if result, ok := housingResult[code]; ok {
-						result.Count++
-						housingResult[code] = result
-					}
-					// if the code isn't valid, just ignore it
-				}
+		if run := headerValue(m, headerBenchRun); run != "" {
+			if sent, records, err := parseBenchMessage(m); err != nil {
+				fmt.Printf("ignoring invalid bench message from topic %v - error is: %v\n", results_topic, err)
+				aggregator.Skip(m.Partition, m.Offset)
+			} else {
+				aggregator.ApplyBench(m.Partition, m.Offset, run, records, sent, time.Now())
 			}
-			mu.Lock()
-			HousingResults[year] = housingResult
-			mu.Unlock()
-			if delay > 0 {
-				time.Sleep(time.Duration(delay) * time.Millisecond)
+			continue
+		}
+		if headerValue(m, headerKind) == kindSummary {
+			var summary SourceSummary
+			if err := json.Unmarshal(m.Value, &summary); err != nil {
+				fmt.Printf("ignoring invalid summary from topic %v - error is: %v\n", results_topic, err)
+				aggregator.Skip(m.Partition, m.Offset)
+			} else {
+				aggregator.ApplySummary(m.Partition, m.Offset, summary)
 			}
+			continue
+		}
+		rm, err := parseResultMessage(m)
+		if err != nil {
+			fmt.Printf("ignoring invalid message from topic %v - message: %v\n", results_topic, string(m.Value))
+			aggregator.Skip(m.Partition, m.Offset)
+			continue
+		}
+		_, rejected := aggregator.Apply(rm)
+		rejectedCodes.Add(float64(rejected))
+		if delay > 0 {
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+		}
+	}
+}
+
+// parses a results message: the period and codes from the value, and the source and record count from
+// the headers. Returns an error if the message doesn't have a valid period
+func parseResultMessage(m kafka.Message) (ResultMessage, error) {
+	rm := ResultMessage{
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Source:    headerValue(m, headerSource),
+		Records:   -1,
+		Codes:     map[int]int{},
+	}
+	messageParts := strings.Split(string(m.Value), ":")
+	if len(messageParts) != 2 {
+		return rm, fmt.Errorf("invalid results message: %v", string(m.Value))
+	}
+	period, err := parsePeriod(messageParts[0])
+	if err != nil {
+		return rm, err
+	}
+	rm.Period = period.String()
+	for _, codeStr := range strings.Split(messageParts[1], ",") {
+		if codeStr == "" {
+			continue
+		} else if code, err := strconv.Atoi(codeStr); err == nil {
+			rm.Codes[code]++
+		} else {
+			rm.Unparsable++
 		}
 	}
+	if records, err := strconv.Atoi(headerValue(m, headerRecords)); err == nil {
+		rm.Records = records
+	}
+	return rm, nil
 }
 
-// returns a struct that can accumulate housing values for one calendar year. The map key and descriptions
+// returns a struct that can accumulate housing values for one period. The map key and descriptions
 // are exactly as defined by the census data documentation
-func newHousingResults(year int) map[int]HousingResult {
+func newHousingResults() map[int]HousingResult {
 	hr := map[int]HousingResult{
 		0:  {"OTHER UNIT", 0},
 		1:  {"HOUSE, APARTMENT, FLAT", 0},
@@ -105,33 +269,64 @@ func newHousingResults(year int) map[int]HousingResult {
 	return hr
 }
 
-// starts an http server to serve the accumulated in-memory results
-func serveResults(resultsPort int) {
+// starts an http server to serve the accumulated in-memory results, and the dashboard. The passed func gets
+// the offsets of the compute and results topics for the /pipeline endpoint and the admin routes
+func serveResults(offsets OffsetsFunc, resultsPort int, adminToken string, snapshotFile string) {
 	fmt.Printf("Starting http server on port: %v\n", resultsPort)
 
-	r := mux.NewRouter()
-	r.HandleFunc("/results", resultsHandler)
-
 	// address can't be loopback - does not work in cluster - possibly I need to configure the pod
-	// networking to handle that? Anyway - the ":PORT" form used below works on the desktop and in cluster
+	// networking to handle that? Anyway - the ":PORT" form used below works on the desktop and in cluster.
+	// There is no WriteTimeout because it would terminate the long-lived streaming responses
 	srv := &http.Server{
-		Handler:      r,
-		Addr:         ":" + strconv.Itoa(resultsPort),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Handler:     resultsRouter(offsets, adminToken, snapshotFile),
+		Addr:        ":" + strconv.Itoa(resultsPort),
+		ReadTimeout: 15 * time.Second,
 	}
 	fmt.Printf("Results server terminated with result: %v\n", srv.ListenAndServe())
 }
 
-// provides a JSON response of the current summarized results
+// returns the routes of the results http server
+func resultsRouter(offsets OffsetsFunc, adminToken string, snapshotFile string) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/results", resultsHandler)
+	r.HandleFunc("/results/partials", partialsHandler)
+	r.HandleFunc("/reconcile", reconcileHandler)
+	r.HandleFunc("/bench", benchHandler)
+	r.HandleFunc("/pipeline", pipelineHandler(offsets))
+	r.Handle("/", http.RedirectHandler("/dashboard/", http.StatusFound))
+	r.PathPrefix("/dashboard/").Handler(dashboardHandler())
+	addAdminRoutes(r, offsets, adminToken, snapshotFile)
+	r.HandleFunc("/results/stream", streamSSEHandler)
+	r.HandleFunc("/results/ws", streamWSHandler)
+	return r
+}
+
+// provides a JSON response of the current summarized results, keyed by month, or by year if the
+// request has the query param rollup=year
 func resultsHandler(w http.ResponseWriter, r *http.Request) {
 	// todo don't ref global var
 	if verbose {
 		fmt.Printf("Http response handler invoked\n")
 	}
-	mu.Lock()
-	js, err := json.Marshal(HousingResults)
-	defer mu.Unlock()
+	res, err := rollup(aggregator.Snapshot().Results, r.URL.Query().Get("rollup"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	js, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// provides a JSON response of this replica's results along with the offsets that produced them. The
+// results gateway merges these across replicas
+func partialsHandler(w http.ResponseWriter, r *http.Request) {
+	replica, _ := os.Hostname()
+	js, err := json.Marshal(ResultsPartial{Replica: replica, AggregateState: aggregator.Snapshot()})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
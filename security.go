@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Environment variables the SASL credentials are read from if they aren't passed on the command line. The
+// password can't be passed as a flag - it would show up in the process list - only as a file or from the env
+const (
+	saslUsernameEnv = "KAFKA_SCALE_SASL_USERNAME"
+	saslPasswordEnv = "KAFKA_SCALE_SASL_PASSWORD"
+)
+
+// valid values for --sasl-mechanism
+const (
+	saslPlain       = "plain"
+	saslScramSHA256 = "scram-sha-256"
+	saslScramSHA512 = "scram-sha-512"
+)
+
+// The TLS config and SASL mechanism every Kafka connection uses: readers, writers, dialed connections, and
+// clients. Nil means plaintext and no authentication. Initialized from the command line
+var kafkaTLS *tls.Config
+var kafkaSASL sasl.Mechanism
+
+// Builds the TLS config from the passed files. TLS is on if enabled is true or any file is passed. The CA file
+// replaces the system roots - e.g. the Strimzi cluster CA. The cert and key files are the client certificate
+// for mutual TLS, and must be passed together. If the server name is empty, the host name of each broker is
+// verified. Returns nil if TLS is off
+func newTLSConfig(enabled bool, caFile string, certFile string, keyFile string, serverName string, insecure bool) (*tls.Config, error) {
+	if !enabled && caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v, error is: %v", caFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in CA file: %v", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--tls-cert-file and --tls-key-file must be specified together")
+	} else if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v, error is: %v", certFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Builds the SASL mechanism. The username is taken from the env if empty, and the password from the password
+// file - or the env if the file is empty. Returns nil if the mechanism is empty
+func newSASLMechanism(mechanism string, username string, passwordFile string) (sasl.Mechanism, error) {
+	if mechanism == "" {
+		return nil, nil
+	}
+	if username == "" {
+		username = os.Getenv(saslUsernameEnv)
+	}
+	password := os.Getenv(saslPasswordEnv)
+	if passwordFile != "" {
+		b, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading SASL password file: %v, error is: %v", passwordFile, err)
+		}
+		// secret files often end with a newline that isn't part of the password
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("SASL needs a username (--sasl-username or %v) and a password (--sasl-password-file or %v)", saslUsernameEnv, saslPasswordEnv)
+	}
+	switch mechanism {
+	case saslPlain:
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case saslScramSHA256:
+		return scram.Mechanism(scram.SHA256, username, password)
+	case saslScramSHA512:
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+	return nil, fmt.Errorf("unknown value %v for --sasl-mechanism. Valid values are: %v, %v and %v", mechanism, saslPlain, saslScramSHA256, saslScramSHA512)
+}
+
+// If not nil, the dialers and transports connect to the brokers with this rather than with TCP. Tests set it to
+// connect to a fake broker running in the test process
+var kafkaDialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// Creates a dialer for readers, consumer groups and dialed connections, with the TLS config and SASL mechanism
+// from the command line
+func newDialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		ClientID:      clientID,
+		DialFunc:      kafkaDialFunc,
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		TLS:           kafkaTLS,
+		SASLMechanism: kafkaSASL,
+	}
+}
+
+// Creates a transport for writers and clients, with the TLS config and SASL mechanism from the command line.
+// Each of the passed number of brokers gets brokerDialTimeout to accept a connection
+func newTransport(brokers int) *kafka.Transport {
+	dial := (&net.Dialer{Timeout: brokerDialTimeout}).DialContext
+	if kafkaDialFunc != nil {
+		dial = kafkaDialFunc
+	}
+	return &kafka.Transport{
+		Dial:        dial,
+		DialTimeout: time.Duration(brokers) * brokerDialTimeout,
+		ClientID:    clientID,
+		TLS:         kafkaTLS,
+		SASL:        kafkaSASL,
+	}
+}
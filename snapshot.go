@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the health component for restoring the results from the snapshot file at startup
+const componentRestore = "restore"
+
+// The state of the results role that is written to the snapshot file. Segments records the offsets that
+// the results were accumulated from so - after a restore - it is possible to tell whether messages were
+// applied after the snapshot was taken and were then lost
+type ResultsSnapshot struct {
+	Time time.Time
+	AggregateState
+}
+
+// Writes the current results to the snapshot file. The file is written to a temp file in the same directory
+// and then renamed so a crash never leaves a partial snapshot
+func writeSnapshot(snapshotFile string) error {
+	js, err := json.Marshal(ResultsSnapshot{Time: time.Now(), AggregateState: aggregator.Snapshot()})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(snapshotFile), filepath.Base(snapshotFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(js); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), snapshotFile)
+}
+
+// Restores the results from the snapshot file, if it exists. Must be called before the results topic
+// is read. A missing file is not an error - there is just nothing to restore
+func restoreSnapshot(snapshotFile string) error {
+	js, err := ioutil.ReadFile(snapshotFile)
+	if os.IsNotExist(err) {
+		fmt.Printf("no snapshot file %v - starting with empty results\n", snapshotFile)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot ResultsSnapshot
+	if err := json.Unmarshal(js, &snapshot); err != nil {
+		return fmt.Errorf("error parsing snapshot file %v: %v", snapshotFile, err)
+	}
+	aggregator.Restore(snapshot.AggregateState)
+	fmt.Printf("restored results from snapshot file %v taken at %v\n", snapshotFile, snapshot.Time)
+	return nil
+}
+
+// Restores the results from the snapshot file - reporting the outcome to the health registry - and then
+// writes a snapshot every snapshotSecs seconds until the context is done. Does nothing if no snapshot file
+// is configured. Returns an error if the restore failed, in which case the results topic must not be read
+// because the messages would be applied to empty results and committed - so the restored counts would
+// be lost for good
+func startSnapshots(ctx context.Context, snapshotFile string, snapshotSecs int) error {
+	if snapshotFile == "" {
+		return nil
+	}
+	health.register(componentRestore, false, true)
+	if err := restoreSnapshot(snapshotFile); err != nil {
+		health.fail(componentRestore, err)
+		return err
+	}
+	health.ok(componentRestore)
+	if snapshotSecs <= 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(snapshotSecs) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := writeSnapshot(snapshotFile); err != nil {
+					fmt.Printf("error writing snapshot, error is: %v\n", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	aggregator.Restore(newAggregateState())
+	defer aggregator.Restore(newAggregateState())
+	aggregator.Apply(resultMessage(0, 0, "s1", 2, map[int]int{1: 2}))
+	aggregator.Reset(map[int]int64{1: 4})
+	aggregator.Apply(resultMessage(0, 1, "s1", 1, map[int]int{1: 1}))
+	if err := writeSnapshot(snapshotFile); err != nil {
+		t.Fatal(err)
+	}
+	want := aggregator.Snapshot()
+
+	aggregator.Restore(newAggregateState())
+	if err := startSnapshots(context.Background(), snapshotFile, 0); err != nil {
+		t.Fatal(err)
+	}
+	got := aggregator.Snapshot()
+	if got.Seq != 1 || got.Results["2020-01"][1].Count != 1 || got.Baseline[0] != 1 || got.Baseline[1] != 4 {
+		t.Errorf("got: %+v, want: %+v", got, want)
+	}
+	if r := health.report(true, 0); r.Components[componentRestore].State != stateOK {
+		t.Errorf("got restore health: %+v, want %v", r.Components[componentRestore], stateOK)
+	}
+}
+
+func TestSnapshotRestoreFailure(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := ioutil.WriteFile(snapshotFile, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := startSnapshots(context.Background(), snapshotFile, 0); err == nil {
+		t.Errorf("got no error restoring an unreadable snapshot")
+	}
+	if r := health.report(true, 0); r.Status != "fail" || r.Components[componentRestore].State != stateFailing {
+		t.Errorf("got readiness: %+v, want the restore failing", r)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// What the status command reports for the whole pipeline at one point in time. Stages has the lag, rates and
+// ETA of the compute group on the compute topic and of the results group on the results topic. Sources is the
+// reconciliation report of the results role, if a results URL was passed - it is how far the census records
+// got, as opposed to the Kafka messages the stages count. Expected is the records the reader chunked for the
+// sources it finished, Counted the records of those sources the results role counted, and InFlight the
+// difference. ETASeconds is how long until both stages are drained, or -1 if either isn't shrinking
+type PipelineReport struct {
+	Time         time.Time
+	Stages       []LagReport
+	Sources      []SourceReconciliation `json:",omitempty"`
+	Expected     int
+	Counted      int
+	InFlight     int
+	ETASeconds   int64
+	ResultsError string `json:",omitempty"`
+}
+
+// Prints the status of the pipeline to the console: for each stage the messages produced to and consumed from
+// its topic, the messages in flight and the rates, then - if resultsURL isn't empty - the per-source record
+// counts from the /reconcile endpoint of the results role or gateway at that URL. If watch is true, refreshes
+// every interval seconds until interrupted. The rates and ETAs need two samples, so are only shown when watching
+func statusCmd(kafkaBrokers string, resultsURL string, watch bool, interval int, output string) {
+	var prev *PipelineReport
+	for {
+		report := getPipelineReport(kafkaBrokers, resultsURL, prev)
+		for _, s := range report.Stages {
+			if s.Error != "" {
+				outputErrorf(output, "%v\n", s.Error)
+			}
+		}
+		if report.ResultsError != "" {
+			outputErrorf(output, "%v\n", report.ResultsError)
+		}
+		if !outputPipelineReport(report, output, prev == nil) {
+			if watch {
+				// clear the screen, like the watch command
+				fmt.Printf("\033[H\033[2J")
+			}
+			printPipelineReport(report, resultsURL, prev != nil)
+		}
+		prev = &report
+		if !watch {
+			return
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// gets the status of the pipeline. If a prior report is passed, the rates and ETAs are computed from it
+func getPipelineReport(kafkaBrokers string, resultsURL string, prev *PipelineReport) PipelineReport {
+	report := PipelineReport{Time: time.Now()}
+	for i, topic := range []string{compute_topic, results_topic} {
+		var prevStage *LagReport
+		if prev != nil && i < len(prev.Stages) && prev.Stages[i].Error == "" {
+			prevStage = &prev.Stages[i]
+		}
+		stage, err := getLag(kafkaOffsets(kafkaBrokers), topic, consumerGrpForTopic[topic], prevStage)
+		if err != nil {
+			stage.Error = err.Error()
+			stage.ETASeconds = -1
+		}
+		if stage.ETASeconds < 0 || report.ETASeconds < 0 {
+			report.ETASeconds = -1
+		} else if stage.ETASeconds > report.ETASeconds {
+			report.ETASeconds = stage.ETASeconds
+		}
+		report.Stages = append(report.Stages, stage)
+	}
+	if resultsURL != "" {
+		sources, err := getReconciliation(resultsURL)
+		if err != nil {
+			report.ResultsError = err.Error()
+		}
+		report.Sources = sources
+		for _, s := range sources {
+			// a source the reader hasn't finished has no expected count to compare to
+			if s.Status != statusPending {
+				report.Expected += s.Expected
+				report.Counted += s.Records
+				report.InFlight += s.Missing
+			}
+		}
+	}
+	return report
+}
+
+// gets the reconciliation report from the /reconcile endpoint of the results role or gateway at the passed URL
+func getReconciliation(resultsURL string) ([]SourceReconciliation, error) {
+	url := strings.TrimSuffix(resultsURL, "/") + "/reconcile"
+	resp, err := gatewayClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error getting %v, error is: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error getting %v, status is: %v", url, resp.Status)
+	}
+	var sources []SourceReconciliation
+	if err := json.NewDecoder(resp.Body).Decode(&sources); err != nil {
+		return nil, fmt.Errorf("error decoding %v, error is: %v", url, err)
+	}
+	return sources, nil
+}
+
+// Writes a pipeline report in the passed machine-readable output format. CSV has one row per stage and the
+// header is only written if header is true. Returns false if the output is table
+func outputPipelineReport(report PipelineReport, output string, header bool) bool {
+	var columns []string
+	if header {
+		columns = []string{"time", "topic", "group", "produced", "consumed", "in_flight", "produced_per_sec", "consumed_per_sec", "eta_seconds", "error"}
+	}
+	return writeOutput(output, report, columns, func() [][]string {
+		var rows [][]string
+		for _, s := range report.Stages {
+			produced, consumed := stageTotals(s)
+			rows = append(rows, []string{report.Time.Format(time.RFC3339), s.Topic, s.Group, cell(produced), cell(consumed),
+				cell(s.TotalLag), cell(s.Produced), cell(s.Consumed), cell(s.ETASeconds), s.Error})
+		}
+		return rows
+	})
+}
+
+// returns the messages produced to and consumed from the topic of a stage, summed over the partitions
+func stageTotals(s LagReport) (produced int64, consumed int64) {
+	for _, p := range s.Partitions {
+		produced += p.Last
+		if p.Committed > 0 {
+			consumed += p.Committed
+		}
+	}
+	return produced, consumed
+}
+
+// prints a pipeline report to the console. The rates and ETAs are only printed if there was a prior sample
+func printPipelineReport(report PipelineReport, resultsURL string, withRates bool) {
+	fmt.Printf("Pipeline status at %v\n\n", report.Time.Format(time.RFC3339))
+	format := "%-20v%-45v%-15v%-15v%-15v%-15v%-15v%v\n"
+	fmt.Printf(format, "Topic", "Group", "Produced", "Consumed", "InFlight", "Produced/s", "Consumed/s", "ETA")
+	for _, s := range report.Stages {
+		if s.Error != "" {
+			fmt.Printf(format, s.Topic, s.Group, "error: "+s.Error, "", "", "", "", "")
+			continue
+		}
+		produced, consumed := stageTotals(s)
+		fmt.Printf(format, s.Topic, s.Group, produced, consumed, s.TotalLag, rate(s.Produced, withRates), rate(s.Consumed, withRates), eta(s.ETASeconds, withRates))
+	}
+	if resultsURL != "" {
+		fmt.Printf("\nSources (from %v)\n\n", resultsURL)
+		if report.ResultsError != "" {
+			fmt.Printf("error: %v\n", report.ResultsError)
+		} else {
+			format := "%-25v%-15v%-15v%-15v%-15v%v\n"
+			fmt.Printf(format, "Source", "Period", "Status", "Expected", "Counted", "Missing")
+			for _, s := range report.Sources {
+				fmt.Printf(format, s.Source, s.Period, s.Status, s.Expected, s.Records, s.Missing)
+			}
+			fmt.Printf("\nRecords: %v counted of %v expected from finished sources. In flight: %v\n", report.Counted, report.Expected, report.InFlight)
+		}
+	}
+	if withRates {
+		fmt.Printf("\nETA to drain the pipeline: %v\n", eta(report.ETASeconds, true))
+	}
+}
+
+// formats an ETA in seconds, or a dash if there is no ETA yet
+func eta(seconds int64, withRates bool) string {
+	if !withRates {
+		return "-"
+	} else if seconds < 0 {
+		return "never"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Types of updates pushed to streaming subscribers. A delta carries the code count increments from one
+// results message. A snapshot carries the full results
+const (
+	updateDelta    = "delta"
+	updateSnapshot = "snapshot"
+
+	// subscribers either get deltas (preceded by a snapshot) or get only periodic snapshots
+	streamModeDelta    = "delta"
+	streamModeSnapshot = "snapshot"
+)
+
+// One update pushed to a streaming subscriber. Seq is the number of results messages applied so far, so a
+// client can tell a delta from a snapshot that already includes it. For a delta, Period and Counts are populated
+// where Counts maps a housing code to the increment. For a snapshot, Results is populated
+type ResultsUpdate struct {
+	Type    string
+	Seq     int64
+	Period  string                           `json:",omitempty"`
+	Counts  map[int]int                      `json:",omitempty"`
+	Results map[string]map[int]HousingResult `json:",omitempty"`
+}
+
+// one streaming client. Updates are queued on a bounded channel. If the client can't keep up and the channel
+// fills, the client is marked as lagged: deltas are no longer queued for it and the next thing it gets is a
+// fresh snapshot, after which it resumes getting deltas. So a slow client never blocks the results loop
+type subscriber struct {
+	mode    string
+	updates chan []byte
+	resync  chan struct{}
+	lagged  bool
+}
+
+// fans results updates out to streaming subscribers. The hub observes the aggregator, so it is notified of
+// each change with the aggregator lock held
+type streamHub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+var hub = &streamHub{subs: map[*subscriber]struct{}{}}
+
+// registers a new subscriber with a queue of the passed size
+func (h *streamHub) subscribe(mode string, bufSize int) *subscriber {
+	s := &subscriber{
+		mode:    mode,
+		updates: make(chan []byte, bufSize),
+		resync:  make(chan struct{}, 1),
+	}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	streamSubscribers.Set(float64(len(h.subs)))
+	h.mu.Unlock()
+	return s
+}
+
+// removes a subscriber
+func (h *streamHub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	streamSubscribers.Set(float64(len(h.subs)))
+	h.mu.Unlock()
+}
+
+// makes every delta-mode subscriber resync with a snapshot because the results were reset or restored
+func (h *streamHub) replaced() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if s.mode != streamModeDelta {
+			continue
+		}
+		s.lagged = true
+		select {
+		case s.resync <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// publishes a delta to all delta-mode subscribers. Never blocks. Called by the aggregator immediately after
+// the delta is applied. That way a snapshot - taken by the aggregator's View - always agrees with the sequence
+// number on it
+func (h *streamHub) applied(seq int64, period string, counts map[int]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	js, err := json.Marshal(ResultsUpdate{Type: updateDelta, Seq: seq, Period: period, Counts: counts})
+	if err != nil {
+		fmt.Printf("error marshaling results delta, error is: %v\n", err)
+		return
+	}
+	for s := range h.subs {
+		if s.mode != streamModeDelta || s.lagged {
+			continue
+		}
+		select {
+		case s.updates <- js:
+		default:
+			s.lagged = true
+			streamResyncs.Inc()
+			select {
+			case s.resync <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// returns a marshaled snapshot for the passed subscriber, discarding any queued deltas since the snapshot
+// supersedes them, and clears the lagged state of the subscriber
+func (h *streamHub) snapshot(s *subscriber) ([]byte, error) {
+	var state AggregateState
+	aggregator.View(func(st AggregateState) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for len(s.updates) > 0 {
+			<-s.updates
+		}
+		s.lagged = false
+		state = st
+	})
+	// the state is a copy so it can be marshaled without holding any lock
+	return json.Marshal(ResultsUpdate{Type: updateSnapshot, Seq: state.Seq, Results: state.Results})
+}
+
+// parses the query params shared by the streaming endpoints: 'mode' is 'delta' (the default) or
+// 'snapshot', and 'interval' is the number of seconds between snapshots. In delta mode interval
+// defaults to zero - meaning only send a snapshot on connect and on resync. In snapshot mode the
+// interval defaults to 5 seconds
+func streamParams(r *http.Request) (string, time.Duration, error) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = streamModeDelta
+	} else if mode != streamModeDelta && mode != streamModeSnapshot {
+		return "", 0, fmt.Errorf("unknown mode: %v", mode)
+	}
+	secs := 0
+	if mode == streamModeSnapshot {
+		secs = 5
+	}
+	if s := r.URL.Query().Get("interval"); s != "" {
+		var err error
+		if secs, err = strconv.Atoi(s); err != nil || secs < 0 {
+			return "", 0, fmt.Errorf("invalid interval: %v", s)
+		}
+	}
+	if mode == streamModeSnapshot && secs == 0 {
+		return "", 0, fmt.Errorf("snapshot mode requires a non-zero interval")
+	}
+	return mode, time.Duration(secs) * time.Second, nil
+}
+
+// Runs the send loop for one subscriber, calling the passed send func for each update until send fails
+// or the done channel is closed. The first update is always a snapshot
+func streamLoop(s *subscriber, interval time.Duration, done <-chan struct{}, send func([]byte) error) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	sendSnapshot := func() error {
+		js, err := hub.snapshot(s)
+		if err != nil {
+			return err
+		}
+		return send(js)
+	}
+	if err := sendSnapshot(); err != nil {
+		return
+	}
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case js := <-s.updates:
+			err = send(js)
+		case <-s.resync:
+			if verbose {
+				fmt.Printf("stream subscriber lagged - resyncing with a snapshot\n")
+			}
+			err = sendSnapshot()
+		case <-tick:
+			err = sendSnapshot()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serves results updates as Server-Sent Events. E.g.: curl -N http://localhost:8888/results/stream
+func streamSSEHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	mode, interval, err := streamParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := hub.subscribe(mode, streamBuffer)
+	defer hub.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	streamLoop(s, interval, r.Context().Done(), func(js []byte) error {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", js); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// this is a demo app - let any page connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serves results updates over a WebSocket. Each update is one text message
+func streamWSHandler(w http.ResponseWriter, r *http.Request) {
+	mode, interval, err := streamParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		fmt.Printf("error upgrading websocket connection, error is: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	s := hub.subscribe(mode, streamBuffer)
+	defer hub.unsubscribe(s)
+
+	// the client doesn't send anything but the read loop is required to process control frames and to
+	// detect that the client went away
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	streamLoop(s, interval, done, func(js []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
+		return conn.WriteMessage(websocket.TextMessage, js)
+	})
+}
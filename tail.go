@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// the values of --from other than an offset or a timestamp
+const (
+	fromEarliest = "earliest"
+	fromLatest   = "latest"
+)
+
+// Prints messages from the passed topic to the console. Each partition is read by a reader that is not part
+// of any consumer group, so nothing is committed and the pipeline's consumer groups are never affected. If
+// partition is -1 all partitions are read. From is where to start in each partition: 'earliest', 'latest',
+// an offset, or an RFC3339 timestamp. Reading stops after limit messages (if limit > 0) or - unless follow
+// is true - once each partition is read up to the last offset it had when the command started. If decode
+// is true, chunk, result and summary messages are printed in decoded form rather than raw
+func tailCmd(kafkaBrokers string, topic string, partition int, from string, limit int, follow bool, decode bool) {
+	partitions, err := getPartitionsForTopic(kafkaBrokers, topic)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	} else if len(partitions) == 0 {
+		fmt.Printf("topic %v not found\n", topic)
+		return
+	}
+	if partition >= 0 {
+		found := false
+		for _, p := range partitions {
+			found = found || p == partition
+		}
+		if !found {
+			fmt.Printf("topic %v has no partition %v\n", topic, partition)
+			return
+		}
+		partitions = []int{partition}
+	}
+	client, shutdown := newClient(kafkaBrokers)
+	first, err := listOffsets(client, topic, partitions, kafka.FirstOffsetOf)
+	if err != nil {
+		shutdown()
+		fmt.Printf("%v\n", err)
+		return
+	}
+	last, err := listOffsets(client, topic, partitions, kafka.LastOffsetOf)
+	shutdown()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := make(chan kafka.Message)
+	var wg sync.WaitGroup
+	for _, p := range partitions {
+		start, end := first[p].FirstOffset, last[p].LastOffset
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			if err := tailPartition(ctx, kafkaBrokers, topic, p, from, start, end, follow, messages); err != nil && ctx.Err() == nil {
+				fmt.Printf("error reading partition %v of topic %v, error is: %v\n", p, topic, err)
+			}
+		}(p)
+	}
+	go func() {
+		wg.Wait()
+		close(messages)
+	}()
+	printed := 0
+	for m := range messages {
+		printMessage(m, decode)
+		printed++
+		if limit > 0 && printed >= limit {
+			cancel()
+			break
+		}
+	}
+	fmt.Printf("%v messages\n", printed)
+}
+
+// Reads one partition from the passed start position and sends each message to the passed channel. First and
+// end are the first and last offsets of the partition. Unless follow is true, returns once the message before
+// the end offset was sent
+func tailPartition(ctx context.Context, kafkaBrokers string, topic string, partition int, from string, first int64, end int64, follow bool, messages chan<- kafka.Message) error {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   brokerList(kafkaBrokers),
+		Topic:     topic,
+		Partition: partition,
+		MinBytes:  1,
+		MaxBytes:  10e6, // 10MB
+		Dialer:    newDialer(),
+	})
+	defer r.Close()
+	var err error
+	switch from {
+	case fromEarliest:
+		err = r.SetOffset(first)
+	case fromLatest:
+		err = r.SetOffset(end)
+	default:
+		if offset, perr := strconv.ParseInt(from, 10, 64); perr == nil {
+			err = r.SetOffset(offset)
+		} else if at, perr := time.Parse(time.RFC3339, from); perr == nil {
+			err = r.SetOffsetAt(ctx, at)
+		} else {
+			err = fmt.Errorf("invalid --from: %v", from)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !follow && r.Offset() >= end {
+		// nothing to read before the end
+		return nil
+	}
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+		select {
+		case messages <- m:
+		case <-ctx.Done():
+			return nil
+		}
+		if !follow && m.Offset >= end-1 {
+			return nil
+		}
+	}
+}
+
+// prints one message with its partition, offset, time, key and headers
+func printMessage(m kafka.Message, decode bool) {
+	var headers []string
+	for _, h := range m.Headers {
+		headers = append(headers, h.Key+"="+string(h.Value))
+	}
+	fmt.Printf("partition: %v offset: %v time: %v key: %v headers: [%v]\n", m.Partition, m.Offset,
+		m.Time.Format(time.RFC3339), string(m.Key), strings.Join(headers, " "))
+	if decode {
+		fmt.Printf("%v\n\n", decodeMessage(m))
+	} else {
+		fmt.Printf("%v\n\n", string(m.Value))
+	}
+}
+
+// Decodes a message of the app. The kind header says what the message is. Messages written before the
+// kind header was carried are decoded by their topic
+func decodeMessage(m kafka.Message) string {
+	kind := headerValue(m, headerKind)
+	if kind == "" && m.Topic == compute_topic {
+		kind = kindChunk
+	} else if kind == "" && m.Topic == results_topic {
+		kind = kindResult
+	}
+	switch kind {
+	case kindSummary:
+		var summary SourceSummary
+		if err := json.Unmarshal(m.Value, &summary); err != nil {
+			return fmt.Sprintf("invalid summary: %v", err)
+		}
+		return fmt.Sprintf("summary: source: %v period: %v lines read: %v lines chunked: %v chunks: %v complete: %v error: %v",
+			summary.Source, summary.Period, summary.LinesRead, summary.LinesChunked, summary.Chunks, summary.Complete, summary.Error)
+	case kindChunk:
+		// the first line is the period and each other line is a census record
+		scanner := bufio.NewScanner(strings.NewReader(string(m.Value)))
+		period, records, truncated := "", 0, 0
+		counts := map[int]int{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			if period == "" {
+				period = strings.TrimSpace(line)
+				continue
+			}
+			records++
+			if len(line) < 32 {
+				truncated++
+			} else if code, err := strconv.Atoi(strings.TrimSpace(line[30:32])); err == nil {
+				counts[code]++
+			}
+		}
+		return fmt.Sprintf("chunk: period: %v records: %v truncated: %v housing codes: %v", period, records, truncated, formatCounts(counts))
+	case kindResult:
+		rm, err := parseResultMessage(m)
+		if err != nil {
+			return fmt.Sprintf("invalid result: %v", err)
+		}
+		return fmt.Sprintf("result: period: %v unparsable: %v housing codes: %v", rm.Period, rm.Unparsable, formatCounts(rm.Codes))
+	}
+	return string(m.Value)
+}
+
+// formats housing code counts as code=count pairs sorted by code
+func formatCounts(counts map[int]int) string {
+	codes := make([]int, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	pairs := make([]string, len(codes))
+	for i, code := range codes {
+		pairs[i] = fmt.Sprintf("%v=%v", code, counts[code])
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// what the read and compute commands do at startup when a topic they write to has drifted from its spec
+const (
+	onDriftWarn = "warn"
+	onDriftFail = "fail"
+)
+
+// The declared state of a topic. Configs can hold any of the configs the describe command shows - retention,
+// cleanup policy, min ISR and compression. Configs not in the spec are left as the broker sets them.
+// PartitionsSet and ReplicationSet say whether the partitions and the replication factor were set by a flag
+// or the spec file, rather than defaulted - an existing topic is only held to a default partition count as a
+// minimum, and isn't held to a default replication factor at all
+type TopicSpec struct {
+	Topic             string            `yaml:"topic"`
+	Partitions        int               `yaml:"partitions"`
+	ReplicationFactor int               `yaml:"replicationFactor"`
+	Configs           map[string]string `yaml:"configs"`
+	PartitionsSet     bool              `yaml:"-"`
+	ReplicationSet    bool              `yaml:"-"`
+}
+
+// One way a topic differs from its spec. Fixable is false for what Kafka can't change in place - a partition
+// count above the spec, or a different replication factor. Fixed is true once apply-topics fixed it
+type TopicDrift struct {
+	Setting  string
+	Declared string
+	Actual   string
+	Fixable  bool
+	Fixed    bool
+}
+
+// What the apply-topics command did to one topic
+type TopicApplyResult struct {
+	Topic   string
+	Created bool
+	Drift   []TopicDrift
+	Error   string `json:",omitempty"`
+}
+
+// Builds the topic specs from the compute and results topic flags, then from the passed YAML spec file if not
+// empty. The file is a YAML list of specs with the topic, partitions, replicationFactor and configs keys. A spec in the file overrides the partitions and replication factor of the flag spec for the same topic if
+// they are set, and is merged into its configs. The file can also declare other topics for apply-topics
+func loadTopicSpecs(flagSpecs []TopicSpec, specFile string) (map[string]TopicSpec, error) {
+	specs := map[string]TopicSpec{}
+	for _, spec := range flagSpecs {
+		specs[spec.Topic] = spec
+	}
+	if specFile != "" {
+		data, err := ioutil.ReadFile(specFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading topic spec file: %v, error is: %v", specFile, err)
+		}
+		var fileSpecs []TopicSpec
+		// a misspelled key would otherwise be silently ignored
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&fileSpecs); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error parsing topic spec file: %v, error is: %v", specFile, err)
+		}
+		for _, fileSpec := range fileSpecs {
+			if fileSpec.Topic == "" {
+				return nil, fmt.Errorf("topic spec file: %v has a spec without a topic", specFile)
+			}
+			spec, ok := specs[fileSpec.Topic]
+			if !ok {
+				spec = TopicSpec{Topic: fileSpec.Topic, Partitions: 1, ReplicationFactor: 1}
+			}
+			if fileSpec.Partitions != 0 {
+				spec.Partitions = fileSpec.Partitions
+				spec.PartitionsSet = true
+			}
+			if fileSpec.ReplicationFactor != 0 {
+				spec.ReplicationFactor = fileSpec.ReplicationFactor
+				spec.ReplicationSet = true
+			}
+			configs := map[string]string{}
+			for name, value := range spec.Configs {
+				configs[name] = value
+			}
+			for name, value := range fileSpec.Configs {
+				configs[name] = value
+			}
+			spec.Configs = configs
+			specs[spec.Topic] = spec
+		}
+	}
+	for _, spec := range specs {
+		if spec.Partitions < 1 || spec.ReplicationFactor < 1 {
+			return nil, fmt.Errorf("topic %v must have at least 1 partition and a replication factor of at least 1", spec.Topic)
+		}
+		for name := range spec.Configs {
+			if !isSpecConfig(name) {
+				return nil, fmt.Errorf("topic %v: config %v can't be declared. Valid configs are: %v", spec.Topic, name, strings.Join(describeConfigNames, ","))
+			}
+		}
+	}
+	return specs, nil
+}
+
+// returns true if the passed config can be declared in a topic spec
+func isSpecConfig(name string) bool {
+	for _, n := range describeConfigNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates the topic in the passed spec if it doesn't exist. If it does, reports each way it has drifted from
+// the spec. With onDrift 'fail' drift is returned as an error, so the command doesn't start against a topic
+// that isn't what it expects. Nothing is changed on an existing topic - that is what apply-topics is for
+func ensureTopic(kafkaBrokers string, spec TopicSpec, onDrift string) error {
+	created, err := createTopicIfNotExists(kafkaBrokers, spec)
+	if err != nil || created {
+		return err
+	}
+	descriptions, err := describeTopics(kafkaBrokers, []string{spec.Topic})
+	if err != nil {
+		return err
+	} else if descriptions[0].Error != "" {
+		return fmt.Errorf("error describing topic %v: %v", spec.Topic, descriptions[0].Error)
+	}
+	drift := topicDrift(spec, descriptions[0])
+	if len(drift) == 0 {
+		return nil
+	}
+	for _, d := range drift {
+		fmt.Printf("WARNING: topic %v has drifted from its spec: %v is %v but %v is declared\n", spec.Topic, d.Setting, d.Actual, d.Declared)
+	}
+	fmt.Printf("To converge the topic run the apply-topics command with the same topic flags\n")
+	if onDrift == onDriftFail {
+		return fmt.Errorf("topic %v has drifted from its spec", spec.Topic)
+	}
+	return nil
+}
+
+// compares a topic description to its spec. Fewer partitions than the spec is always drift, but more is only
+// drift if the partitions were set, and a different replication factor only if it was set - so a topic created
+// by other means isn't drift just because the app's defaults differ. Declared configs are compared to the
+// values in effect on the topic, whether set on the topic or inherited from the broker
+func topicDrift(spec TopicSpec, d TopicDescription) []TopicDrift {
+	var drift []TopicDrift
+	if actual := len(d.Partitions); actual < spec.Partitions || (actual > spec.Partitions && spec.PartitionsSet) {
+		drift = append(drift, TopicDrift{Setting: "partitions", Declared: cell(spec.Partitions), Actual: cell(actual), Fixable: actual < spec.Partitions})
+	}
+	if len(d.Partitions) != 0 && spec.ReplicationSet {
+		// offline replicas still count - the topic has them, their brokers are just down
+		if actual := len(d.Partitions[0].Replicas) + d.Partitions[0].Offline; actual != spec.ReplicationFactor {
+			drift = append(drift, TopicDrift{Setting: "replication factor", Declared: cell(spec.ReplicationFactor), Actual: cell(actual)})
+		}
+	}
+	for _, name := range sortedKeys(spec.Configs) {
+		if actual, ok := d.Configs[name]; !ok || actual != spec.Configs[name] {
+			drift = append(drift, TopicDrift{Setting: name, Declared: spec.Configs[name], Actual: actual, Fixable: true})
+		}
+	}
+	return drift
+}
+
+// Converges the cluster to the passed topic specs: creates missing topics, adds partitions and sets configs
+// that drifted. A partition count above the spec or a different replication factor can't be changed in
+// place, so they are only reported. Prints what was done for each topic
+func applyTopicsCmd(kafkaBrokers string, specs map[string]TopicSpec, output string) {
+	var results []TopicApplyResult
+	for _, topic := range sortedTopics(specs) {
+		r := applyTopic(kafkaBrokers, specs[topic], output)
+		if r.Error != "" {
+			outputErrorf(output, "error applying topic: %v, error is: %v\n", r.Topic, r.Error)
+		}
+		results = append(results, r)
+	}
+	if writeOutput(output, results, []string{"topic", "created", "setting", "declared", "actual", "fixable", "fixed", "error"}, func() [][]string {
+		var rows [][]string
+		for _, r := range results {
+			if len(r.Drift) == 0 {
+				rows = append(rows, []string{r.Topic, cell(r.Created), "", "", "", "", "", r.Error})
+			}
+			for _, d := range r.Drift {
+				rows = append(rows, []string{r.Topic, cell(r.Created), d.Setting, d.Declared, d.Actual, cell(d.Fixable), cell(d.Fixed), r.Error})
+			}
+		}
+		return rows
+	}) {
+		return
+	}
+	fmt.Printf("Applying topic specs\n\n")
+	format := "%-20v%-25v%-20v%-20v%v\n"
+	fmt.Printf(format, "Topic", "Setting", "Declared", "Actual", "Status")
+	for _, r := range results {
+		switch {
+		case r.Created:
+			fmt.Printf(format, r.Topic, "", "", "", "created")
+		case len(r.Drift) == 0 && r.Error == "":
+			fmt.Printf(format, r.Topic, "", "", "", "in sync")
+		}
+		for _, d := range r.Drift {
+			status := "fixed"
+			if !d.Fixable {
+				status = "can't be changed in place"
+			} else if !d.Fixed {
+				status = "not fixed"
+			}
+			fmt.Printf(format, r.Topic, d.Setting, d.Declared, d.Actual, status)
+		}
+		if r.Error != "" {
+			fmt.Printf(format, r.Topic, "", "", "", "error: "+r.Error)
+		}
+	}
+}
+
+// creates or converges one topic
+func applyTopic(kafkaBrokers string, spec TopicSpec, output string) TopicApplyResult {
+	result := TopicApplyResult{Topic: spec.Topic}
+	created, err := createTopicIfNotExists(kafkaBrokers, spec)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	} else if created {
+		result.Created = true
+		return result
+	}
+	descriptions, err := describeTopics(kafkaBrokers, []string{spec.Topic})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	} else if descriptions[0].Error != "" {
+		result.Error = descriptions[0].Error
+		return result
+	}
+	result.Drift = topicDrift(spec, descriptions[0])
+	configs := map[string]string{}
+	for i, d := range result.Drift {
+		if !d.Fixable {
+			continue
+		}
+		if d.Setting == "partitions" {
+			if err := addPartitions(kafkaBrokers, spec.Topic, spec.Partitions, output); err != nil {
+				result.Error = err.Error()
+				return result
+			}
+			result.Drift[i].Fixed = true
+		} else {
+			configs[d.Setting] = d.Declared
+		}
+	}
+	if len(configs) != 0 {
+		if err := setTopicConfigs(kafkaBrokers, spec.Topic, configs, output); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		for i, d := range result.Drift {
+			if _, ok := configs[d.Setting]; ok {
+				result.Drift[i].Fixed = true
+			}
+		}
+	}
+	return result
+}
+
+// formats a topic spec for the console like: compute partitions=10 replication=3 retention.ms=3600000
+func formatTopicSpec(spec TopicSpec) string {
+	parts := []string{spec.Topic, fmt.Sprintf("partitions=%v", spec.Partitions), fmt.Sprintf("replication=%v", spec.ReplicationFactor)}
+	for _, name := range sortedKeys(spec.Configs) {
+		parts = append(parts, name+"="+spec.Configs[name])
+	}
+	return strings.Join(parts, " ")
+}
+
+// returns the topics of the passed specs sorted
+func sortedTopics(specs map[string]TopicSpec) []string {
+	topics := make([]string, 0, len(specs))
+	for topic := range specs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// returns the keys of the passed map sorted
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// valid values for --read-from
+const (
+	readFromKafka = "kafka"
+	readFromFile  = "file"
+)
+
+// What the compute and results roles read messages from. A kafka.Reader is a MessageSource, and so are a
+// file of messages and the in-memory topics of local mode. ReadMessage returns io.EOF when there are no more
+// messages - which for Kafka only happens once the reader is closed
+type MessageSource interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	Close() error
+}
+
+// What the read and compute roles write messages to. A kafka.Writer is a MessageSink, and so are stdout, a
+// file, the null sink, and the in-memory topics of local mode
+type MessageSink interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Gets the offsets of the passed consumer group on the passed topic. The code that reports progress gets its
+// offsets through one, so it works the same against Kafka and against the in-memory topics of local mode
+type OffsetsFunc func(topic string, group string) ([]PartitionOffsets, error)
+
+// returns an OffsetsFunc that gets the offsets from Kafka
+func kafkaOffsets(kafkaBrokers string) OffsetsFunc {
+	return func(topic string, group string) ([]PartitionOffsets, error) {
+		return getTopicOffsets(kafkaBrokers, topic, group)
+	}
+}
+
+// Creates the sink for --write-to. The Kafka sink writes to the topic of the passed spec, which is created -
+// or checked for drift - first. The file sink writes to writeFile
+func newSink(writeTo string, writeFile string, kafkaBrokers string, spec TopicSpec, onDrift string) (MessageSink, error) {
+	switch writeTo {
+	case writeToKafka:
+		if err := ensureTopic(kafkaBrokers, spec, onDrift); err != nil {
+			return nil, fmt.Errorf("error creating topic %v, error is: %v", spec.Topic, err)
+		}
+		return newKafkaWriter(kafkaBrokers, spec.Topic), nil
+	case writeToStdout:
+		return stdoutSink{}, nil
+	case WriteToNull:
+		return nullSink{}, nil
+	case writeToFile:
+		f, err := os.OpenFile(writeFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file: %v, error is: %v", writeFile, err)
+		}
+		return &fileSink{f: f}, nil
+	}
+	return nil, fmt.Errorf("unknown value %v for --write-to", writeTo)
+}
+
+// Creates the source for --read-from. The Kafka source reads the passed topic as part of the consumer group
+// for the topic. The file source reads readFile
+func newSource(readFrom string, readFile string, kafkaBrokers string, topic string) (MessageSource, error) {
+	switch readFrom {
+	case readFromKafka:
+		return newKafkaReader(kafkaBrokers, topic), nil
+	case readFromFile:
+		f, err := os.Open(readFile)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file: %v, error is: %v", readFile, err)
+		}
+		scanner := bufio.NewScanner(f)
+		// chunks are about 10 census records, so allow for lines much longer than the default max
+		scanner.Buffer(make([]byte, 64*1024), 10e6)
+		return &fileSource{f: f, scanner: scanner}, nil
+	}
+	return nil, fmt.Errorf("unknown value %v for --read-from", readFrom)
+}
+
+// prints each message to the console, prefixed by its kind. Summaries are printed decoded
+type stdoutSink struct{}
+
+func (stdoutSink) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, m := range msgs {
+		var summary SourceSummary
+		if kind := headerValue(m, headerKind); kind == kindSummary && json.Unmarshal(m.Value, &summary) == nil {
+			printSummary(summary)
+		} else {
+			fmt.Printf("%v: %v\n", kind, string(m.Value))
+		}
+	}
+	return nil
+}
+
+func (stdoutSink) Close() error {
+	return nil
+}
+
+// discards every message
+type nullSink struct{}
+
+func (nullSink) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return nil
+}
+
+func (nullSink) Close() error {
+	return nil
+}
+
+// Appends each message to a file as a line of NDJSON - the format of the produce command, so the file can be
+// written to a topic with --format=ndjson, or read by another role with --read-from=file
+type fileSink struct {
+	f *os.File
+}
+
+func (s *fileSink) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	var lines []byte
+	for _, m := range msgs {
+		record := ProduceRecord{Key: string(m.Key), Value: string(m.Value), Headers: map[string]string{}}
+		for _, h := range m.Headers {
+			record.Headers[h.Key] = string(h.Value)
+		}
+		js, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, js...), '\n')
+	}
+	_, err := s.f.Write(lines)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
+
+// Reads messages from a file of NDJSON lines in the format of the produce command. Blank lines are skipped,
+// and a line that can't be parsed is returned as an error. The other lines are given partition zero and
+// consecutive offsets from zero, so the results role sees one contiguous range of offsets
+type fileSource struct {
+	f       *os.File
+	scanner *bufio.Scanner
+	line    int
+	offset  int64
+}
+
+func (s *fileSource) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	for s.scanner.Scan() {
+		s.line++
+		if s.scanner.Text() == "" {
+			continue
+		}
+		m, err := parseProduceLine(s.scanner.Text(), formatNDJSON)
+		if err != nil {
+			return m, fmt.Errorf("line %v of %v: %v", s.line, s.f.Name(), err)
+		}
+		m.Partition, m.Offset = 0, s.offset
+		s.offset++
+		return m, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		// the scanner can't go on, so there are no more messages
+		fmt.Printf("error reading file: %v after line %v, error is: %v\n", s.f.Name(), s.line, err)
+	}
+	return kafka.Message{}, io.EOF
+}
+
+func (s *fileSource) Close() error {
+	return s.f.Close()
+}